@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+)
+
+// statusForError maps errors returned by the policy store to HTTP status codes,
+// using fallback for errors without a specific mapping
+func statusForError(err error, fallback int) int {
+	var maxDepthErr *policy.MaxDepthExceededError
+	var cycleErr *policy.CycleDetectedError
+
+	switch {
+	case errors.Is(err, policy.ErrInvalidZookie),
+		errors.Is(err, policy.ErrInvalidConsistency),
+		errors.Is(err, policy.ErrInvalidCursor),
+		errors.Is(err, policy.ErrInvalidContextualRelationship),
+		errors.Is(err, policy.ErrInvalidCaveatContext),
+		errors.Is(err, datastore.ErrFutureRevision):
+		return http.StatusBadRequest
+	case errors.Is(err, policy.ErrRelationshipExists),
+		errors.Is(err, policy.ErrPreconditionFailed):
+		return http.StatusConflict
+	case errors.Is(err, datastore.ErrSnapshotExpired):
+		return http.StatusGone
+	case errors.As(err, &maxDepthErr),
+		errors.As(err, &cycleErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return fallback
+	}
+}
+
+// writeError writes an error response with the status mapped from err
+func writeError(w http.ResponseWriter, err error, fallback int) {
+	http.Error(w, err.Error(), statusForError(err, fallback))
+}
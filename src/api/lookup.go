@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kanywst/zanzibar/src/policy"
+)
+
+// LookupResourcesRequest represents a request for the resources a subject can act on
+type LookupResourcesRequest struct {
+	Subject      string             `json:"subject"`
+	ResourceType string             `json:"resource_type"`
+	Permission   string             `json:"permission"`
+	Consistency  policy.Consistency `json:"consistency,omitempty"`
+	Limit        int                `json:"limit,omitempty"`
+	Cursor       string             `json:"cursor,omitempty"`
+}
+
+// LookupSubjectsRequest represents a request for the subjects that have a permission on a resource
+type LookupSubjectsRequest struct {
+	Resource    string             `json:"resource"`
+	Permission  string             `json:"permission"`
+	SubjectType string             `json:"subject_type"`
+	Consistency policy.Consistency `json:"consistency,omitempty"`
+	Limit       int                `json:"limit,omitempty"`
+	Cursor      string             `json:"cursor,omitempty"`
+}
+
+// handleLookupResources returns a page of the resources on which a subject has a permission
+func (s *Server) handleLookupResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LookupResourcesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Subject == "" || req.ResourceType == "" || req.Permission == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+	if req.Limit < 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	result, err := s.policyStore.LookupResources(ctx, policy.LookupResourcesRequest{
+		Subject:      req.Subject,
+		ResourceType: req.ResourceType,
+		Permission:   req.Permission,
+		Consistency:  req.Consistency,
+		Limit:        req.Limit,
+		Cursor:       req.Cursor,
+	})
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleLookupSubjects returns a page of the subjects that have a permission on a resource
+func (s *Server) handleLookupSubjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LookupSubjectsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Resource == "" || req.Permission == "" || req.SubjectType == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+	if req.Limit < 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	result, err := s.policyStore.LookupSubjects(ctx, policy.LookupSubjectsRequest{
+		Resource:    req.Resource,
+		Permission:  req.Permission,
+		SubjectType: req.SubjectType,
+		Consistency: req.Consistency,
+		Limit:       req.Limit,
+		Cursor:      req.Cursor,
+	})
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -1,12 +1,16 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/kanywst/zanzibar/src/datastore"
 	"github.com/kanywst/zanzibar/src/policy"
 	"github.com/kanywst/zanzibar/src/schema"
 )
@@ -39,16 +43,60 @@ type Resource struct {
 
 // AuthorizeRequest represents an authorization request
 type AuthorizeRequest struct {
-	Principal Principal              `json:"principal"`
-	Resource  Resource               `json:"resource"`
-	Action    string                 `json:"action"`
-	Context   map[string]interface{} `json:"context,omitempty"`
+	Principal   Principal              `json:"principal"`
+	Resource    Resource               `json:"resource"`
+	Action      string                 `json:"action"`
+	Context     map[string]interface{} `json:"context,omitempty"`
+	Consistency policy.Consistency     `json:"consistency,omitempty"`
+	// Relationships assumed to hold for this check only; they are never written
+	ContextualRelationships []policy.Relationship `json:"contextual_relationships,omitempty"`
 }
 
 // AuthorizeResponse represents an authorization response
 type AuthorizeResponse struct {
+	// ALLOW, DENY, or CONDITIONAL when caveat context is missing
 	Decision string `json:"decision"`
-	Reason   string `json:"reason,omitempty"`
+	// Context fields to supply to decide a CONDITIONAL decision
+	MissingContext []string `json:"missing_context,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+	ZookieToken    string   `json:"zookie_token,omitempty"`
+	// Evaluation counters, returned with ?debug=true
+	Debug *policy.EvalStats `json:"debug,omitempty"`
+	// Evaluation tree, returned with ?explain=true
+	Explain *policy.TraceNode `json:"explain,omitempty"`
+}
+
+// BulkCheckItem represents one check of a bulk authorization request
+type BulkCheckItem struct {
+	Principal Principal `json:"principal"`
+	Resource  Resource  `json:"resource"`
+	Action    string    `json:"action"`
+}
+
+// BulkAuthorizeRequest represents a batch of authorization checks evaluated at one revision
+type BulkAuthorizeRequest struct {
+	Items       []BulkCheckItem    `json:"items"`
+	Consistency policy.Consistency `json:"consistency,omitempty"`
+	// Relationships assumed to hold for every check of the batch; they are never written
+	ContextualRelationships []policy.Relationship `json:"contextual_relationships,omitempty"`
+	// Values of caveat parameters for every check of the batch
+	Context map[string]interface{} `json:"context,omitempty"`
+}
+
+// BulkCheckItemResponse represents the outcome of one check of a bulk authorization request
+type BulkCheckItemResponse struct {
+	Decision       string   `json:"decision,omitempty"`
+	MissingContext []string `json:"missing_context,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// BulkAuthorizeResponse represents a bulk authorization response, with results in request order
+type BulkAuthorizeResponse struct {
+	Results     []BulkCheckItemResponse `json:"results"`
+	ZookieToken string                  `json:"zookie_token,omitempty"`
+	// Evaluation counters for the whole batch, returned with ?debug=true
+	Debug *policy.EvalStats `json:"debug,omitempty"`
 }
 
 // RelationshipRequest represents a relationship management request
@@ -56,6 +104,10 @@ type RelationshipRequest struct {
 	Resource Resource  `json:"resource"`
 	Relation string    `json:"relation"`
 	Subject  Principal `json:"subject"`
+	// Optional time from which the relationship is treated as absent
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Optional caveat the relationship is conditioned on
+	Caveat *datastore.ContextualizedCaveat `json:"caveat,omitempty"`
 }
 
 // RelationshipResponse represents a relationship management response
@@ -63,19 +115,43 @@ type RelationshipResponse struct {
 	ZookieToken string `json:"zookie_token"`
 }
 
+// WriteRelationshipsRequest represents an atomic batch write request
+type WriteRelationshipsRequest struct {
+	Updates       []policy.RelationshipUpdate `json:"updates"`
+	Preconditions []policy.Precondition       `json:"preconditions,omitempty"`
+}
+
+// DeleteRelationshipsRequest represents a filtered delete request
+type DeleteRelationshipsRequest struct {
+	Filter policy.RelationshipFilter `json:"filter"`
+	Limit  int                       `json:"limit,omitempty"`
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/authorize", s.handleAuthorize)
+	mux.HandleFunc("/v1/authorize/bulk", s.handleBulkAuthorize)
+	mux.HandleFunc("/v1/relationships", s.handleRelationships)
+	mux.HandleFunc("/v1/relationships/write", s.handleWriteRelationships)
+	mux.HandleFunc("/v1/relationships/delete", s.handleDeleteRelationships)
+	mux.HandleFunc("/v1/resources/", s.handleResources)
+	mux.HandleFunc("/v1/lookup/resources", s.handleLookupResources)
+	mux.HandleFunc("/v1/lookup/subjects", s.handleLookupSubjects)
+	mux.HandleFunc("/v1/watch", s.handleWatch)
+	mux.HandleFunc("/v1/schema", s.handleSchema)
+	mux.HandleFunc("/v1/debug/gc", s.handleGCStats)
+	mux.HandleFunc("/v1/debug/leopard", s.handleVerifyLeopard)
+	mux.HandleFunc("/v1/debug/cache", s.handleCacheStats)
+	mux.HandleFunc("/health", s.handleHealth)
+	return mux
+}
+
 // Start starts the API server
 func (s *Server) Start(port int) error {
-	// Register handlers
-	http.HandleFunc("/v1/authorize", s.handleAuthorize)
-	http.HandleFunc("/v1/relationships", s.handleRelationships)
-	http.HandleFunc("/v1/resources/", s.handleResources)
-	http.HandleFunc("/v1/schema", s.handleSchema)
-	http.HandleFunc("/health", s.handleHealth)
-
-	// Start server
 	addr := fmt.Sprintf(":%d", port)
 	log.Printf("Starting server on %s", addr)
-	return http.ListenAndServe(addr, nil)
+	return http.ListenAndServe(addr, s.Handler())
 }
 
 // handleAuthorize handles authorization requests
@@ -97,22 +173,131 @@ func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
 	// Check authorization
-	allowed, reason, err := s.policyStore.Check(req.Principal.ID, req.Resource.ID, req.Action)
+	result, err := s.policyStore.CheckPermission(ctx, policy.CheckRequest{
+		Subject:                 req.Principal.ID,
+		Resource:                req.Resource.ID,
+		Action:                  req.Action,
+		Consistency:             req.Consistency,
+		ContextualRelationships: req.ContextualRelationships,
+		Context:                 caveatContext(req.Context, req.Principal, req.Resource),
+		Explain:                 r.URL.Query().Get("explain") == "true",
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	// Prepare response
-	decision := "DENY"
-	if allowed {
-		decision = "ALLOW"
+	resp := AuthorizeResponse{
+		Decision:       decisionFor(result.Permissionship),
+		MissingContext: result.MissingContext,
+		Reason:         result.Reason,
+		ZookieToken:    result.ZookieToken,
+	}
+	if r.URL.Query().Get("debug") == "true" {
+		resp.Debug = &result.Stats
 	}
+	resp.Explain = result.Trace
 
-	resp := AuthorizeResponse{
-		Decision: decision,
-		Reason:   reason,
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decisionFor returns the decision reported for a permissionship
+func decisionFor(p policy.Permissionship) string {
+	switch p {
+	case policy.HasPermission:
+		return "ALLOW"
+	case policy.ConditionalPermission:
+		return "CONDITIONAL"
+	default:
+		return "DENY"
+	}
+}
+
+// caveatContext returns the values caveats are evaluated against: the request
+// context, and the attributes of the principal and resource as principal.<name>
+// and resource.<name>
+func caveatContext(values map[string]any, principal Principal, resource Resource) map[string]any {
+	result := make(map[string]any, len(values)+len(principal.Attributes)+len(resource.Attributes))
+	for name, value := range principal.Attributes {
+		result["principal."+name] = value
+	}
+	for name, value := range resource.Attributes {
+		result["resource."+name] = value
+	}
+	for name, value := range values {
+		result[name] = value
+	}
+	return result
+}
+
+// handleBulkAuthorize handles batches of authorization requests
+func (s *Server) handleBulkAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BulkAuthorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	items := make([]policy.BulkCheckItem, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = policy.BulkCheckItem{Subject: item.Principal.ID, Resource: item.Resource.ID, Action: item.Action}
+		if len(item.Principal.Attributes) > 0 || len(item.Resource.Attributes) > 0 {
+			// Attributes are evaluated as in a single check, under the batch context
+			items[i].Context = caveatContext(req.Context, item.Principal, item.Resource)
+		}
+	}
+	result, err := s.policyStore.BulkCheck(ctx, policy.BulkCheckRequest{
+		Items:                   items,
+		Consistency:             req.Consistency,
+		ContextualRelationships: req.ContextualRelationships,
+		Context:                 req.Context,
+	})
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resp := BulkAuthorizeResponse{
+		Results:     make([]BulkCheckItemResponse, len(result.Results)),
+		ZookieToken: result.ZookieToken,
+	}
+	for i, item := range result.Results {
+		switch {
+		case item.Err != nil:
+			resp.Results[i] = BulkCheckItemResponse{Error: item.Err.Error()}
+		default:
+			resp.Results[i] = BulkCheckItemResponse{
+				Decision:       decisionFor(item.Permissionship),
+				MissingContext: item.MissingContext,
+				Reason:         item.Reason,
+			}
+		}
+	}
+	if r.URL.Query().Get("debug") == "true" {
+		resp.Debug = &result.Stats
 	}
 
 	// Send response
@@ -120,6 +305,23 @@ func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// requestContext returns the context of a request, limited by the optional
+// ?timeout={duration} query parameter. Evaluation also stops when the client goes away.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	value := r.URL.Query().Get("timeout")
+	if value == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return nil, nil, fmt.Errorf("invalid timeout: %s", value)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
 // handleRelationships handles relationship management
 func (s *Server) handleRelationships(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -149,7 +351,13 @@ func (s *Server) addRelationship(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add relationship
-	zookieToken, err := s.policyStore.AddRelationship(req.Resource.ID, req.Relation, req.Subject.ID)
+	zookieToken, err := s.policyStore.TouchRelationship(policy.Relationship{
+		Resource:  req.Resource.ID,
+		Relation:  req.Relation,
+		Subject:   req.Subject.ID,
+		ExpiresAt: req.ExpiresAt,
+		Caveat:    req.Caveat,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -181,25 +389,95 @@ func (s *Server) removeRelationship(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Remove relationship
-	err := s.policyStore.RemoveRelationship(req.Resource.ID, req.Relation, req.Subject.ID)
+	zookieToken, err := s.policyStore.RemoveRelationship(req.Resource.ID, req.Relation, req.Subject.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	// Send response
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RelationshipResponse{ZookieToken: zookieToken})
+}
+
+// handleWriteRelationships applies a batch of relationship updates atomically
+func (s *Server) handleWriteRelationships(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req WriteRelationshipsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	zookieToken, err := s.policyStore.WriteRelationships(req.Updates, req.Preconditions)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RelationshipResponse{ZookieToken: zookieToken})
+}
+
+// handleDeleteRelationships deletes every relationship matching a filter
+func (s *Server) handleDeleteRelationships(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DeleteRelationshipsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Limit < 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.policyStore.DeleteRelationships(req.Filter, req.Limit)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 // listRelationships lists all relationships
 func (s *Server) listRelationships(w http.ResponseWriter, r *http.Request) {
-	relationships := s.policyStore.ListRelationships()
+	relationships, zookieToken, err := s.policyStore.ListRelationshipsWithConsistency(consistencyFromQuery(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(zookieHeader, zookieToken)
 	json.NewEncoder(w).Encode(relationships)
 }
 
+// zookieHeader carries the zookie of the revision a read was evaluated at
+const zookieHeader = "X-Zookie-Token"
+
+// consistencyFromQuery reads the ?consistency={mode}&zookie={zookie} query parameters
+func consistencyFromQuery(r *http.Request) policy.Consistency {
+	query := r.URL.Query()
+	return policy.Consistency{
+		Mode:   policy.ConsistencyMode(query.Get("consistency")),
+		Zookie: query.Get("zookie"),
+	}
+}
+
 // handleResources handles resource-related operations
 func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -207,11 +485,11 @@ func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse path: /v1/resources/{resource_id}/relations/{relation}/subjects
+	// Parse path: /v1/resources/{resource_id}/relations/{relation}/{subjects|tree}
 	path := strings.TrimPrefix(r.URL.Path, "/v1/resources/")
 	parts := strings.Split(path, "/")
 
-	if len(parts) != 3 || parts[1] != "relations" {
+	if len(parts) < 3 || len(parts) > 4 || parts[1] != "relations" {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
@@ -219,12 +497,147 @@ func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
 	resourceID := parts[0]
 	relation := parts[2]
 
-	// Get subjects
-	subjects := s.policyStore.Expand(resourceID, relation)
+	if len(parts) == 4 {
+		switch parts[3] {
+		case "subjects":
+		case "tree":
+			s.expandTree(w, r, resourceID, relation)
+			return
+		default:
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.lookupRelationSubjects(w, r, resourceID, relation)
+}
+
+// lookupRelationSubjects returns the subjects of a type, given by ?subject_type= and
+// defaulting to user, that have a permission or relation on a resource. It answers
+// from LookupSubjects, so it agrees with POST /v1/lookup/subjects.
+func (s *Server) lookupRelationSubjects(w http.ResponseWriter, r *http.Request, resourceID, relation string) {
+	query := r.URL.Query()
+	subjectType := query.Get("subject_type")
+	if subjectType == "" {
+		subjectType = "user"
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	result, err := s.policyStore.LookupSubjects(ctx, policy.LookupSubjectsRequest{
+		Resource:    resourceID,
+		Permission:  relation,
+		SubjectType: subjectType,
+		Consistency: consistencyFromQuery(r),
+		Limit:       limit,
+		Cursor:      query.Get("cursor"),
+	})
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(zookieHeader, result.ZookieToken)
+	json.NewEncoder(w).Encode(result)
+}
+
+// expandTree returns the userset tree of a permission or relation on a resource
+func (s *Server) expandTree(w http.ResponseWriter, r *http.Request, resourceID, relation string) {
+	depth := 0
+	if value := r.URL.Query().Get("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			http.Error(w, "Invalid depth", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tree, zookieToken, err := s.policyStore.ExpandTree(r.Context(), policy.ExpandTreeRequest{
+		Resource:    resourceID,
+		Relation:    relation,
+		Depth:       depth,
+		Consistency: consistencyFromQuery(r),
+	})
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string][]string{"subjects": subjects})
+	w.Header().Set(zookieHeader, zookieToken)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tree":         tree,
+		"zookie_token": zookieToken,
+	})
+}
+
+// handleWatch streams relationship changes as newline-delimited JSON
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Parse query: ?after={zookie}&resource_type={type}&relation={relation}&heartbeat={duration}
+	query := r.URL.Query()
+	filter := policy.WatchFilter{
+		ResourceType: query.Get("resource_type"),
+		Relation:     query.Get("relation"),
+	}
+
+	heartbeat := policy.DefaultWatchHeartbeat
+	if value := query.Get("heartbeat"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+			return
+		}
+		heartbeat = parsed
+	}
+
+	// The stream ends when the client disconnects
+	events, err := s.policyStore.Watch(r.Context(), query.Get("after"), filter, heartbeat)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
 }
 
 // handleSchema handles schema operations
@@ -261,6 +674,45 @@ func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleGCStats reports garbage collection statistics
+func (s *Server) handleGCStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.policyStore.GCStats())
+}
+
+// handleCacheStats reports check cache statistics
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.policyStore.CacheStats())
+}
+
+// handleVerifyLeopard rebuilds the Leopard index from scratch and compares it with the live one
+func (s *Server) handleVerifyLeopard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.policyStore.VerifyLeopardIndex()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 // handleHealth handles health check
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Revision identifies a committed state of the datastore
+type Revision int64
+
+var (
+	// ErrFutureRevision is returned when reading at a revision that has not been committed yet
+	ErrFutureRevision = errors.New("revision is newer than the head revision")
+	// ErrSnapshotExpired is returned when reading at a revision whose history has been garbage collected
+	ErrSnapshotExpired = errors.New("snapshot expired")
+)
+
+// Tuple represents a stored version of a relation tuple
+type Tuple struct {
+	Resource string `json:"resource"`
+	Relation string `json:"relation"`
+	Subject  string `json:"subject"`
+	// Revision at which this version of the tuple was written
+	CreatedAt Revision `json:"created_at_revision"`
+	// Revision at which this version was deleted, or zero while it is live
+	DeletedAt Revision  `json:"deleted_at_revision,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Time from which the tuple is treated as absent, or zero if it never expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Caveat the tuple is conditioned on, or nil if it always applies
+	Caveat *ContextualizedCaveat `json:"caveat,omitempty"`
+}
+
+// ContextualizedCaveat names a caveat of the schema and binds values to some of its parameters
+type ContextualizedCaveat struct {
+	Name    string         `json:"name"`
+	Context map[string]any `json:"context,omitempty"`
+}
+
+// VisibleAt reports whether this version of the tuple exists at the given revision
+func (t Tuple) VisibleAt(revision Revision) bool {
+	return t.CreatedAt <= revision && (t.DeletedAt == 0 || t.DeletedAt > revision)
+}
+
+// ExpiredAt reports whether the tuple has expired at the given time
+func (t Tuple) ExpiredAt(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// SameMetadata reports whether two versions of a tuple have the same expiry and caveat
+func (t Tuple) SameMetadata(other Tuple) bool {
+	return t.ExpiresAt.Equal(other.ExpiresAt) && reflect.DeepEqual(t.Caveat, other.Caveat)
+}
+
+// IndirectSubject reports whether the tuple's subject stands for other subjects:
+// a subject set (type:id#relation) or a wildcard (type:*)
+func (t Tuple) IndirectSubject() bool {
+	return strings.Contains(t.Subject, "#") || strings.HasSuffix(t.Subject, ":*")
+}
+
+// ResourceType returns the type part of the tuple's resource
+func (t Tuple) ResourceType() string {
+	return objectType(t.Resource)
+}
+
+// Key returns the identity of the tuple, ignoring its metadata
+func (t Tuple) Key() string {
+	return t.Resource + "#" + t.Relation + "@" + t.Subject
+}
+
+// UpdateOperation defines the kind of change applied to a tuple
+type UpdateOperation string
+
+const (
+	// UpdateTouch creates the tuple, or leaves it in place if it already exists with the
+	// same expiry and caveat. A tuple that exists with different metadata, or has expired,
+	// is replaced.
+	UpdateTouch UpdateOperation = "TOUCH"
+	// UpdateDelete removes the tuple if it exists
+	UpdateDelete UpdateOperation = "DELETE"
+)
+
+// Update is a single change applied as part of a write
+type Update struct {
+	Operation UpdateOperation `json:"operation"`
+	Tuple     Tuple           `json:"tuple"`
+}
+
+// RevisionChanges lists the effective changes committed at a single revision
+type RevisionChanges struct {
+	Revision  Revision  `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	// Updates that changed the datastore; touches of existing tuples and
+	// deletes of missing tuples are omitted
+	Updates []Update `json:"updates"`
+}
+
+// GCResult reports what a garbage collection pass removed
+type GCResult struct {
+	// Oldest revision that can still be read after the pass
+	MinRevision Revision `json:"min_revision"`
+	// Number of deleted tuple versions removed
+	CollectedVersions int `json:"collected_versions"`
+	// Number of changelog entries removed
+	CollectedChanges int `json:"collected_changes"`
+}
+
+// Filter selects tuples by their fields. Empty fields match anything.
+type Filter struct {
+	ResourceType string
+	Resource     string
+	Relation     string
+	Subject      string
+	SubjectType  string
+	// IndirectSubjects selects only tuples whose subject is a subject set or a wildcard
+	IndirectSubjects bool
+}
+
+// Matches reports whether the tuple satisfies the filter
+func (f Filter) Matches(t Tuple) bool {
+	if f.ResourceType != "" && t.ResourceType() != f.ResourceType {
+		return false
+	}
+	if f.Resource != "" && t.Resource != f.Resource {
+		return false
+	}
+	if f.Relation != "" && t.Relation != f.Relation {
+		return false
+	}
+	if f.Subject != "" && t.Subject != f.Subject {
+		return false
+	}
+	if f.SubjectType != "" && objectType(t.Subject) != f.SubjectType {
+		return false
+	}
+	if f.IndirectSubjects && !t.IndirectSubject() {
+		return false
+	}
+	return true
+}
+
+// Reader reads tuples as of a single revision
+type Reader interface {
+	// Revision returns the revision observed by the reader
+	Revision() Revision
+	// QueryTuples returns all tuples matching the filter that are live at the reader's
+	// revision. Tuples that have expired by the time of the query are omitted.
+	QueryTuples(filter Filter) ([]Tuple, error)
+}
+
+// Datastore is the storage backend used by the policy store.
+// Implementations must be safe for concurrent use.
+type Datastore interface {
+	// Write applies all updates atomically and returns the new revision
+	Write(updates []Update) (Revision, error)
+	// HeadRevision returns the latest committed revision
+	HeadRevision() (Revision, error)
+	// SnapshotReader returns a reader that observes the datastore exactly as it was at
+	// the given revision. Reading beyond the head revision returns ErrFutureRevision,
+	// and reading below the oldest retained revision returns ErrSnapshotExpired.
+	SnapshotReader(revision Revision) (Reader, error)
+	// Changes returns the changes committed after the given revision, one entry per
+	// revision in order, and a channel that is closed once a newer revision is committed.
+	// Changes after a revision below the oldest retained revision return ErrSnapshotExpired.
+	Changes(after Revision) ([]RevisionChanges, <-chan struct{}, error)
+	// ExpiredTuples returns the tuples live at the head revision that have expired at
+	// the given time. They stay stored until they are deleted with a write.
+	ExpiredTuples(now time.Time) ([]Tuple, error)
+	// GarbageCollect drops the history of every revision older than the newest revision
+	// committed at or before the given time. That revision becomes the oldest one that
+	// can be read; the head revision is always retained.
+	GarbageCollect(before time.Time) (GCResult, error)
+	// Close releases any resources held by the datastore
+	Close() error
+}
+
+// objectType returns the type part of a "type:id" object reference
+func objectType(object string) string {
+	if i := strings.Index(object, ":"); i >= 0 {
+		return object[:i]
+	}
+	return object
+}
+
+// sortByCreation orders tuple versions by the revision that created them
+func sortByCreation(tuples []Tuple) {
+	sort.SliceStable(tuples, func(i, j int) bool {
+		return tuples[i].CreatedAt < tuples[j].CreatedAt
+	})
+}
@@ -0,0 +1,293 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// walFileName is the name of the write-ahead log inside the data directory
+	walFileName = "wal.log"
+	// snapshotFileName is the name of the latest snapshot inside the data directory
+	snapshotFileName = "snapshot.json"
+	// DefaultSnapshotEvery is the default number of writes between snapshots
+	DefaultSnapshotEvery = 1000
+)
+
+// FileOptions configures a FileDatastore
+type FileOptions struct {
+	// SnapshotEvery is the number of writes after which the state is snapshotted
+	// and the write-ahead log is truncated. Zero uses DefaultSnapshotEvery.
+	SnapshotEvery int
+}
+
+// snapshotFile is the on-disk format of a snapshot. It holds every retained
+// tuple version, including deleted ones, and the changelog, so history
+// survives a restart.
+type snapshotFile struct {
+	Revision    Revision          `json:"revision"`
+	MinRevision Revision          `json:"min_revision,omitempty"`
+	Tuples      []Tuple           `json:"tuples"`
+	Changes     []RevisionChanges `json:"changes"`
+}
+
+// FileDatastore is a durable datastore that serves reads from memory and appends
+// every write to a write-ahead log before acknowledging it. On startup, the latest
+// snapshot is loaded and the log is replayed on top of it.
+type FileDatastore struct {
+	dir           string
+	memory        *MemoryDatastore
+	wal           *writeAheadLog
+	snapshotEvery int
+	// Number of writes logged since the last snapshot
+	pending int
+	// Serializes writes, snapshots and close
+	mu sync.Mutex
+}
+
+// NewFileDatastore opens or creates a file-backed datastore in dir
+func NewFileDatastore(dir string, options FileOptions) (*FileDatastore, error) {
+	if options.SnapshotEvery <= 0 {
+		options.SnapshotEvery = DefaultSnapshotEvery
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f := &FileDatastore{
+		dir:           dir,
+		memory:        NewMemoryDatastore(),
+		snapshotEvery: options.SnapshotEvery,
+	}
+
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, err := openWriteAheadLog(filepath.Join(dir, walFileName))
+	if err != nil {
+		return nil, err
+	}
+	f.wal = wal
+
+	if err := f.replay(); err != nil {
+		wal.close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// loadSnapshot restores the latest snapshot, if one exists
+func (f *FileDatastore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot snapshotFile
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	f.memory.restore(snapshot)
+	return nil
+}
+
+// replay applies every logged write newer than the snapshot
+func (f *FileDatastore) replay() error {
+	head, _ := f.memory.HeadRevision()
+
+	return f.wal.replay(func(record walRecord) error {
+		// Records at or below the snapshot revision were written before the
+		// snapshot, but the log was not truncated before a crash
+		if record.Revision <= head {
+			return nil
+		}
+		if record.Revision != head+1 {
+			return fmt.Errorf("write-ahead log is missing revision %d", head+1)
+		}
+		if err := validateUpdates(record.Updates); err != nil {
+			return err
+		}
+
+		f.memory.commit(record.Revision, record.Timestamp, record.Updates)
+		f.pending++
+		head = record.Revision
+		return nil
+	})
+}
+
+// Write logs the updates, applies them atomically and returns the new revision
+func (f *FileDatastore) Write(updates []Update) (Revision, error) {
+	if err := validateUpdates(updates); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return 0, fmt.Errorf("datastore is closed")
+	}
+
+	head, _ := f.memory.HeadRevision()
+	record := walRecord{
+		Revision:  head + 1,
+		Timestamp: time.Now(),
+		Updates:   updates,
+	}
+
+	// The write is acknowledged only once it is durable in the log
+	if err := f.wal.append(record); err != nil {
+		return 0, err
+	}
+	f.memory.commit(record.Revision, record.Timestamp, record.Updates)
+
+	f.pending++
+	if f.pending >= f.snapshotEvery {
+		if err := f.snapshot(); err != nil {
+			// The write itself is durable; the next write retries the snapshot
+			log.Printf("Failed to snapshot datastore: %v", err)
+		}
+	}
+
+	return record.Revision, nil
+}
+
+// Snapshot writes the current state to disk and truncates the write-ahead log
+func (f *FileDatastore) Snapshot() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return fmt.Errorf("datastore is closed")
+	}
+	return f.snapshot()
+}
+
+// snapshot writes the current state to disk. The caller must hold f.mu.
+func (f *FileDatastore) snapshot() error {
+	data, err := json.Marshal(f.memory.dump())
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a partial snapshot
+	path := filepath.Join(f.dir, snapshotFileName)
+	tmp, err := os.CreateTemp(f.dir, snapshotFileName+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+
+	// Every logged record is now covered by the snapshot
+	if err := f.wal.reset(); err != nil {
+		return err
+	}
+	f.pending = 0
+	return nil
+}
+
+// syncDir fsyncs a directory so that renames inside it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// HeadRevision returns the latest committed revision
+func (f *FileDatastore) HeadRevision() (Revision, error) {
+	return f.memory.HeadRevision()
+}
+
+// SnapshotReader returns a reader that observes the datastore at the given revision
+func (f *FileDatastore) SnapshotReader(revision Revision) (Reader, error) {
+	return f.memory.SnapshotReader(revision)
+}
+
+// Changes returns the changes committed after the given revision and a channel
+// that is closed once a newer revision is committed
+func (f *FileDatastore) Changes(after Revision) ([]RevisionChanges, <-chan struct{}, error) {
+	return f.memory.Changes(after)
+}
+
+// ExpiredTuples returns the tuples live at the head revision that have expired at the given time
+func (f *FileDatastore) ExpiredTuples(now time.Time) ([]Tuple, error) {
+	return f.memory.ExpiredTuples(now)
+}
+
+// GarbageCollect drops old history in memory and snapshots the result, so the
+// collected versions are also removed from disk
+func (f *FileDatastore) GarbageCollect(before time.Time) (GCResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return GCResult{}, fmt.Errorf("datastore is closed")
+	}
+
+	result, err := f.memory.GarbageCollect(before)
+	if err != nil {
+		return result, err
+	}
+	if result.CollectedVersions > 0 || result.CollectedChanges > 0 {
+		if err := f.snapshot(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Close snapshots the state and closes the write-ahead log
+func (f *FileDatastore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.wal == nil {
+		return nil
+	}
+
+	var snapshotErr error
+	if f.pending > 0 {
+		snapshotErr = f.snapshot()
+	}
+	closeErr := f.wal.close()
+	f.wal = nil
+
+	if snapshotErr != nil {
+		return snapshotErr
+	}
+	return closeErr
+}
@@ -0,0 +1,462 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// versionSet is a set of tuple versions
+type versionSet map[*Tuple]struct{}
+
+// MemoryDatastore keeps every version of every tuple in memory, with indexes for the
+// common lookups. Each version records the revisions at which it was created and
+// deleted, so reads can be served at any revision.
+type MemoryDatastore struct {
+	// Uniqueness index: every version of a tuple by key, oldest first.
+	// Only the last version can be live.
+	versions map[string][]*Tuple
+	// Index by resource, then relation
+	byResource map[string]map[string]versionSet
+	// Index by subject
+	bySubject map[string]versionSet
+	// Index by resource type, then relation
+	byResourceType map[string]map[string]versionSet
+	// Index by resource, then relation, of the versions whose subject is a
+	// subject set or a wildcard
+	indirect map[string]map[string]versionSet
+	// Live versions that carry an expiry
+	expiring versionSet
+	// Deleted versions in the order they were deleted, for garbage collection
+	deleted []*Tuple
+	// Changes committed after minRevision, one entry per revision in order
+	changelog []RevisionChanges
+	// Closed and replaced whenever a revision is committed
+	notify   chan struct{}
+	revision Revision
+	// Oldest revision that can be read; older history has been garbage collected
+	minRevision Revision
+	mu          sync.RWMutex
+}
+
+// NewMemoryDatastore creates a new empty in-memory datastore
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{
+		versions:       make(map[string][]*Tuple),
+		byResource:     make(map[string]map[string]versionSet),
+		bySubject:      make(map[string]versionSet),
+		byResourceType: make(map[string]map[string]versionSet),
+		indirect:       make(map[string]map[string]versionSet),
+		expiring:       make(versionSet),
+		notify:         make(chan struct{}),
+	}
+}
+
+// Write applies all updates atomically and returns the new revision
+func (m *MemoryDatastore) Write(updates []Update) (Revision, error) {
+	if err := validateUpdates(updates); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revision := m.revision + 1
+	m.apply(revision, time.Now(), updates)
+	return revision, nil
+}
+
+// commit applies already validated updates at the given revision
+func (m *MemoryDatastore) commit(revision Revision, timestamp time.Time, updates []Update) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.apply(revision, timestamp, updates)
+}
+
+// apply applies updates at the given revision. The caller must hold the write lock.
+func (m *MemoryDatastore) apply(revision Revision, timestamp time.Time, updates []Update) {
+	changes := RevisionChanges{Revision: revision, Timestamp: timestamp}
+
+	for _, u := range updates {
+		key := u.Tuple.Key()
+		live := m.live(key)
+		switch u.Operation {
+		case UpdateTouch:
+			if live != nil && live.SameMetadata(u.Tuple) && !live.ExpiredAt(timestamp) {
+				continue
+			}
+			if live != nil {
+				// Replace the version with different metadata or a lapsed expiry
+				m.markDeleted(live, revision)
+			}
+			t := u.Tuple
+			t.CreatedAt = revision
+			t.DeletedAt = 0
+			t.UpdatedAt = timestamp
+			m.insert(key, &t)
+			changes.Updates = append(changes.Updates, Update{Operation: UpdateTouch, Tuple: t})
+		case UpdateDelete:
+			if live != nil {
+				m.markDeleted(live, revision)
+				changes.Updates = append(changes.Updates, Update{Operation: UpdateDelete, Tuple: *live})
+			}
+		}
+	}
+
+	m.revision = revision
+	m.changelog = append(m.changelog, changes)
+
+	// Wake up watchers waiting for this revision
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+// live returns the live version of the tuple with the given key, or nil
+func (m *MemoryDatastore) live(key string) *Tuple {
+	versions := m.versions[key]
+	if len(versions) == 0 {
+		return nil
+	}
+	if last := versions[len(versions)-1]; last.DeletedAt == 0 {
+		return last
+	}
+	return nil
+}
+
+// markDeleted marks a live version as deleted at the given revision
+func (m *MemoryDatastore) markDeleted(t *Tuple, revision Revision) {
+	t.DeletedAt = revision
+	delete(m.expiring, t)
+	m.deleted = append(m.deleted, t)
+}
+
+// dump returns a copy of every stored version and the changelog
+func (m *MemoryDatastore) dump() snapshotFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var tuples []Tuple
+	for _, versions := range m.versions {
+		for _, t := range versions {
+			tuples = append(tuples, *t)
+		}
+	}
+	changelog := make([]RevisionChanges, len(m.changelog))
+	copy(changelog, m.changelog)
+	return snapshotFile{
+		Revision:    m.revision,
+		MinRevision: m.minRevision,
+		Tuples:      tuples,
+		Changes:     changelog,
+	}
+}
+
+// restore replaces the contents of the datastore with the given snapshot
+func (m *MemoryDatastore) restore(snapshot snapshotFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.versions = make(map[string][]*Tuple)
+	m.byResource = make(map[string]map[string]versionSet)
+	m.bySubject = make(map[string]versionSet)
+	m.byResourceType = make(map[string]map[string]versionSet)
+	m.indirect = make(map[string]map[string]versionSet)
+	m.expiring = make(versionSet)
+	m.deleted = nil
+
+	// Insert versions oldest first so that the live version ends up last
+	tuples := snapshot.Tuples
+	sortByCreation(tuples)
+	for i := range tuples {
+		t := tuples[i]
+		m.insert(t.Key(), &t)
+		if t.DeletedAt != 0 {
+			m.deleted = append(m.deleted, m.versions[t.Key()][len(m.versions[t.Key()])-1])
+		}
+	}
+	sort.SliceStable(m.deleted, func(i, j int) bool {
+		return m.deleted[i].DeletedAt < m.deleted[j].DeletedAt
+	})
+
+	m.changelog = snapshot.Changes
+	m.revision = snapshot.Revision
+	m.minRevision = snapshot.MinRevision
+}
+
+// validateUpdates checks that every update uses a known operation
+func validateUpdates(updates []Update) error {
+	for _, u := range updates {
+		if u.Operation != UpdateTouch && u.Operation != UpdateDelete {
+			return fmt.Errorf("unknown update operation: %s", u.Operation)
+		}
+	}
+	return nil
+}
+
+// insert adds a new version to every index
+func (m *MemoryDatastore) insert(key string, t *Tuple) {
+	m.versions[key] = append(m.versions[key], t)
+	addToNested(m.byResource, t.Resource, t.Relation, t)
+	addToNested(m.byResourceType, t.ResourceType(), t.Relation, t)
+	if t.IndirectSubject() {
+		addToNested(m.indirect, t.Resource, t.Relation, t)
+	}
+
+	subjects, ok := m.bySubject[t.Subject]
+	if !ok {
+		subjects = make(versionSet)
+		m.bySubject[t.Subject] = subjects
+	}
+	subjects[t] = struct{}{}
+
+	if t.DeletedAt == 0 && !t.ExpiresAt.IsZero() {
+		m.expiring[t] = struct{}{}
+	}
+}
+
+// remove drops a deleted version from every index
+func (m *MemoryDatastore) remove(t *Tuple) {
+	key := t.Key()
+	versions := m.versions[key]
+	for i, v := range versions {
+		if v == t {
+			versions = append(versions[:i:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(m.versions, key)
+	} else {
+		m.versions[key] = versions
+	}
+
+	removeFromNested(m.byResource, t.Resource, t.Relation, t)
+	removeFromNested(m.byResourceType, t.ResourceType(), t.Relation, t)
+	if t.IndirectSubject() {
+		removeFromNested(m.indirect, t.Resource, t.Relation, t)
+	}
+	if subjects := m.bySubject[t.Subject]; subjects != nil {
+		delete(subjects, t)
+		if len(subjects) == 0 {
+			delete(m.bySubject, t.Subject)
+		}
+	}
+}
+
+// addToNested adds a version to a two-level index
+func addToNested(index map[string]map[string]versionSet, outer, inner string, t *Tuple) {
+	relations, ok := index[outer]
+	if !ok {
+		relations = make(map[string]versionSet)
+		index[outer] = relations
+	}
+	set, ok := relations[inner]
+	if !ok {
+		set = make(versionSet)
+		relations[inner] = set
+	}
+	set[t] = struct{}{}
+}
+
+// removeFromNested removes a version from a two-level index, dropping empty sets
+func removeFromNested(index map[string]map[string]versionSet, outer, inner string, t *Tuple) {
+	relations := index[outer]
+	set := relations[inner]
+	if set == nil {
+		return
+	}
+	delete(set, t)
+	if len(set) == 0 {
+		delete(relations, inner)
+	}
+	if len(relations) == 0 {
+		delete(index, outer)
+	}
+}
+
+// candidates returns the smallest indexed sets that can contain every version matching the filter
+func (m *MemoryDatastore) candidates(filter Filter) []versionSet {
+	if filter.Resource != "" && filter.Subject != "" && filter.Relation != "" {
+		key := Tuple{Resource: filter.Resource, Relation: filter.Relation, Subject: filter.Subject}.Key()
+		set := make(versionSet)
+		for _, t := range m.versions[key] {
+			set[t] = struct{}{}
+		}
+		return []versionSet{set}
+	}
+
+	if filter.Resource != "" && filter.IndirectSubjects {
+		return selectNested(m.indirect[filter.Resource], filter.Relation)
+	}
+
+	if filter.Resource != "" {
+		return selectNested(m.byResource[filter.Resource], filter.Relation)
+	}
+
+	if filter.Subject != "" {
+		return []versionSet{m.bySubject[filter.Subject]}
+	}
+
+	if filter.ResourceType != "" {
+		return selectNested(m.byResourceType[filter.ResourceType], filter.Relation)
+	}
+
+	sets := make([]versionSet, 0, len(m.byResourceType))
+	for _, relations := range m.byResourceType {
+		sets = append(sets, selectNested(relations, "")...)
+	}
+	return sets
+}
+
+// selectNested returns the sets for one relation, or for all relations if none is given
+func selectNested(relations map[string]versionSet, relation string) []versionSet {
+	if relation != "" {
+		return []versionSet{relations[relation]}
+	}
+
+	sets := make([]versionSet, 0, len(relations))
+	for _, set := range relations {
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// HeadRevision returns the latest committed revision
+func (m *MemoryDatastore) HeadRevision() (Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.revision, nil
+}
+
+// SnapshotReader returns a reader that observes the datastore at the given revision
+func (m *MemoryDatastore) SnapshotReader(revision Revision) (Reader, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if revision > m.revision {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFutureRevision, revision, m.revision)
+	}
+	if revision < m.minRevision {
+		return nil, fmt.Errorf("%w: %d < %d", ErrSnapshotExpired, revision, m.minRevision)
+	}
+
+	return &memoryReader{
+		datastore: m,
+		revision:  revision,
+	}, nil
+}
+
+// Changes returns the changes committed after the given revision and a channel
+// that is closed once a newer revision is committed
+func (m *MemoryDatastore) Changes(after Revision) ([]RevisionChanges, <-chan struct{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if after > m.revision {
+		return nil, nil, fmt.Errorf("%w: %d > %d", ErrFutureRevision, after, m.revision)
+	}
+	if after < m.minRevision {
+		return nil, nil, fmt.Errorf("%w: %d < %d", ErrSnapshotExpired, after, m.minRevision)
+	}
+
+	// The changelog is ordered by revision
+	start := sort.Search(len(m.changelog), func(i int) bool {
+		return m.changelog[i].Revision > after
+	})
+	changes := make([]RevisionChanges, len(m.changelog)-start)
+	copy(changes, m.changelog[start:])
+
+	return changes, m.notify, nil
+}
+
+// ExpiredTuples returns the tuples live at the head revision that have expired at the given time
+func (m *MemoryDatastore) ExpiredTuples(now time.Time) ([]Tuple, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []Tuple
+	for t := range m.expiring {
+		if t.ExpiredAt(now) {
+			result = append(result, *t)
+		}
+	}
+	sortByCreation(result)
+	return result, nil
+}
+
+// GarbageCollect drops the history of every revision older than the newest revision
+// committed at or before the given time
+func (m *MemoryDatastore) GarbageCollect(before time.Time) (GCResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The changelog is ordered by revision, and so by commit time
+	n := 0
+	for n < len(m.changelog) && !m.changelog[n].Timestamp.After(before) {
+		n++
+	}
+	if n == 0 {
+		return GCResult{MinRevision: m.minRevision}, nil
+	}
+	minRevision := m.changelog[n-1].Revision
+
+	// Versions deleted at or before the new minimum are not visible at any readable revision
+	collected := 0
+	for collected < len(m.deleted) && m.deleted[collected].DeletedAt <= minRevision {
+		m.remove(m.deleted[collected])
+		collected++
+	}
+	m.deleted = append([]*Tuple(nil), m.deleted[collected:]...)
+
+	// Entries up to the new minimum are only needed by watchers resuming before it
+	m.changelog = append([]RevisionChanges(nil), m.changelog[n:]...)
+	m.minRevision = minRevision
+
+	return GCResult{
+		MinRevision:       minRevision,
+		CollectedVersions: collected,
+		CollectedChanges:  n,
+	}, nil
+}
+
+// Close releases any resources held by the datastore
+func (m *MemoryDatastore) Close() error {
+	return nil
+}
+
+// memoryReader reads tuples from a MemoryDatastore
+type memoryReader struct {
+	datastore *MemoryDatastore
+	revision  Revision
+}
+
+// Revision returns the revision observed by the reader
+func (r *memoryReader) Revision() Revision {
+	return r.revision
+}
+
+// QueryTuples returns all unexpired tuples matching the filter that are live at the reader's revision
+func (r *memoryReader) QueryTuples(filter Filter) ([]Tuple, error) {
+	r.datastore.mu.RLock()
+	defer r.datastore.mu.RUnlock()
+
+	// History needed by this reader may have been collected since it was created
+	if r.revision < r.datastore.minRevision {
+		return nil, fmt.Errorf("%w: %d < %d", ErrSnapshotExpired, r.revision, r.datastore.minRevision)
+	}
+
+	now := time.Now()
+	var result []Tuple
+	for _, set := range r.datastore.candidates(filter) {
+		for t := range set {
+			if t.VisibleAt(r.revision) && !t.ExpiredAt(now) && filter.Matches(*t) {
+				result = append(result, *t)
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// walHeaderSize is the size of a record header: payload length and CRC32 checksum
+const walHeaderSize = 8
+
+// walMaxRecordSize bounds the payload length accepted when reading the log
+const walMaxRecordSize = 64 << 20
+
+// crcTable is the CRC32 table used to checksum log records
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is returned when the log ends in an incomplete or corrupt record
+var errTornRecord = errors.New("torn write-ahead log record")
+
+// ErrCorruptLog is returned when a corrupt record of the write-ahead log is followed
+// by more data, so that it cannot be the tail of an interrupted append
+var ErrCorruptLog = errors.New("corrupt write-ahead log")
+
+// walRecord is a single committed write in the write-ahead log
+type walRecord struct {
+	Revision  Revision  `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	Updates   []Update  `json:"updates"`
+}
+
+// writeAheadLog appends records to a file and fsyncs them before returning
+type writeAheadLog struct {
+	file *os.File
+	// Set when a failed append could not be rolled back; no further appends are accepted
+	broken error
+}
+
+// openWriteAheadLog opens the log at path, creating it if necessary
+func openWriteAheadLog(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file}, nil
+}
+
+// append writes a record to the end of the log and syncs it to disk
+func (w *writeAheadLog) append(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[walHeaderSize:], payload)
+
+	if w.broken != nil {
+		return w.broken
+	}
+
+	offset, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.file.Write(buf)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// Roll back the partial record so later records are not written after it
+		if truncErr := w.file.Truncate(offset); truncErr != nil {
+			w.broken = fmt.Errorf("write-ahead log is unusable after failed append: %w", truncErr)
+		} else if _, seekErr := w.file.Seek(offset, io.SeekStart); seekErr != nil {
+			w.broken = fmt.Errorf("write-ahead log is unusable after failed append: %w", seekErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// replay reads every complete record from the start of the log. If the log ends in
+// a torn record, the file is truncated to the end of the last complete record so
+// that new records are appended after valid data. A corrupt record anywhere else
+// fails the replay with ErrCorruptLog and leaves the file untouched.
+func (w *writeAheadLog) replay(apply func(walRecord) error) error {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		record, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			if err := w.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if errors.Is(err, ErrCorruptLog) {
+			return fmt.Errorf("%w at offset %d", err, offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := apply(record); err != nil {
+			return err
+		}
+		offset += size
+	}
+
+	_, err := w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readRecord reads the next record and returns it with its size on disk. A record
+// that runs into the end of the log is torn; a corrupt record followed by more
+// data is not.
+func readRecord(reader *bufio.Reader) (walRecord, int64, error) {
+	var record walRecord
+
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return record, 0, io.EOF
+	}
+	if err != nil {
+		if n > 0 {
+			return record, 0, errTornRecord
+		}
+		return record, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > walMaxRecordSize {
+		// A length beyond the end of the log may be the garbage header of a torn append
+		skipped, err := io.CopyN(io.Discard, reader, int64(length))
+		if err != nil && err != io.EOF {
+			return record, 0, err
+		}
+		if skipped < int64(length) {
+			return record, 0, fmt.Errorf("%w: record length %d exceeds limit", errTornRecord, length)
+		}
+		return record, 0, fmt.Errorf("%w: record length %d exceeds limit", ErrCorruptLog, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return record, 0, errTornRecord
+		}
+		return record, 0, err
+	}
+
+	var invalid error
+	if crc32.Checksum(payload, crcTable) != checksum {
+		invalid = errors.New("checksum mismatch")
+	} else if err := json.Unmarshal(payload, &record); err != nil {
+		invalid = err
+	}
+	if invalid != nil {
+		// Only the final record can have been torn by a crash
+		if _, err := reader.Peek(1); err == io.EOF {
+			return record, 0, fmt.Errorf("%w: %v", errTornRecord, invalid)
+		} else if err != nil {
+			return record, 0, err
+		}
+		return record, 0, fmt.Errorf("%w: %v", ErrCorruptLog, invalid)
+	}
+
+	return record, int64(walHeaderSize) + int64(length), nil
+}
+
+// reset discards every record in the log
+func (w *writeAheadLog) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// close closes the underlying file
+func (w *writeAheadLog) close() error {
+	return w.file.Close()
+}
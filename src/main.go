@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"syscall"
 
 	"github.com/kanywst/zanzibar/src/api"
+	"github.com/kanywst/zanzibar/src/datastore"
 	"github.com/kanywst/zanzibar/src/policy"
 	"github.com/kanywst/zanzibar/src/schema"
 )
@@ -16,6 +18,19 @@ func main() {
 	// Parse command line flags
 	port := flag.Int("port", 8080, "Port to listen on")
 	initSample := flag.Bool("sample", true, "Initialize with sample data")
+	datastoreKind := flag.String("datastore", "memory", "Datastore backend to use (memory or file)")
+	dataDir := flag.String("data-dir", "./data", "Directory for the file datastore")
+	snapshotEvery := flag.Int("snapshot-every", datastore.DefaultSnapshotEvery, "Number of writes between file datastore snapshots")
+	zookieKey := flag.String("zookie-key", "", "Secret used to sign zookies (random if empty)")
+	maxDepth := flag.Int("max-depth", policy.DefaultMaxDepth, "Maximum nesting of relation evaluations in a single check")
+	maxConcurrency := flag.Int("max-concurrency", policy.DefaultMaxConcurrency, "Maximum number of branches evaluated concurrently across all checks")
+	retentionWindow := flag.Duration("retention-window", policy.DefaultRetentionWindow, "Period for which revision history is kept readable")
+	gcInterval := flag.Duration("gc-interval", policy.DefaultGCInterval, "Interval between garbage collection passes")
+	expirySweepInterval := flag.Duration("expiry-sweep-interval", policy.DefaultExpirySweepInterval, "Interval between sweeps of expired relationships")
+	disableLeopard := flag.Bool("disable-leopard", false, "Evaluate nested group memberships by recursion instead of the Leopard index")
+	checkCacheSize := flag.Int("check-cache-size", policy.DefaultCheckCacheSize, "Maximum number of relation evaluations kept by the check cache")
+	disableCheckCache := flag.Bool("disable-check-cache", false, "Evaluate every check without the check cache")
+	quantizationWindow := flag.Duration("quantization-window", 0, "Period within which reads without a fresher zookie share a revision (0 reads at the head revision)")
 	flag.Parse()
 
 	// Initialize schema
@@ -28,16 +43,56 @@ func main() {
 		log.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
 	}
 
+	// Initialize datastore
+	var ds datastore.Datastore
+	switch *datastoreKind {
+	case "memory":
+		log.Println("Initializing in-memory datastore...")
+		ds = datastore.NewMemoryDatastore()
+	case "file":
+		log.Printf("Initializing file datastore in %s...", *dataDir)
+		fileDatastore, err := datastore.NewFileDatastore(*dataDir, datastore.FileOptions{SnapshotEvery: *snapshotEvery})
+		if err != nil {
+			log.Fatalf("Failed to open file datastore: %v", err)
+		}
+		ds = fileDatastore
+	default:
+		log.Fatalf("Unknown datastore: %s", *datastoreKind)
+	}
+
 	// Initialize policy store
 	log.Println("Initializing policy store...")
-	policyStore := policy.NewStore(schemaStore)
+	options := policy.StoreOptions{
+		Datastore:           ds,
+		MaxDepth:            *maxDepth,
+		MaxConcurrency:      *maxConcurrency,
+		RetentionWindow:     *retentionWindow,
+		DisableLeopardIndex: *disableLeopard,
+		CheckCacheSize:      *checkCacheSize,
+		DisableCheckCache:   *disableCheckCache,
+		QuantizationWindow:  *quantizationWindow,
+	}
+	if *zookieKey != "" {
+		options.ZookieKey = []byte(*zookieKey)
+	} else {
+		log.Println("No zookie key configured; zookies will not be accepted after a restart")
+	}
+	policyStore := policy.NewStoreWithOptions(schemaStore, options)
 
-	// Initialize with sample data if requested
+	// Initialize with sample data if requested and the datastore is empty
 	if *initSample {
 		log.Println("Initializing with sample data...")
-		policyStore.InitializeWithSampleData()
+		if err := policyStore.InitializeWithSampleData(); err != nil {
+			log.Fatalf("Failed to initialize sample data: %v", err)
+		}
 	}
 
+	// Purge expired relationships and old history in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go policyStore.RunExpirySweeper(ctx, *expirySweepInterval)
+	go policyStore.RunGarbageCollector(ctx, *gcInterval)
+
 	// Create API server
 	log.Println("Creating API server...")
 	server := api.NewServer(policyStore, schemaStore)
@@ -48,6 +103,11 @@ func main() {
 	go func() {
 		<-sigChan
 		log.Println("Shutting down...")
+		cancel()
+		if err := ds.Close(); err != nil {
+			log.Printf("Failed to close datastore: %v", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}()
 
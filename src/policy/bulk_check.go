@@ -0,0 +1,130 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// MaxBulkCheckItems is the largest number of checks accepted in one bulk check
+const MaxBulkCheckItems = 1000
+
+// BulkCheckItem is one check of a bulk check
+type BulkCheckItem struct {
+	Subject  string
+	Resource string
+	Action   string
+	// Values of caveat parameters for this check only, taking precedence over the
+	// batch's Context
+	Context map[string]any
+}
+
+// BulkCheckRequest describes a batch of permission checks evaluated together
+type BulkCheckRequest struct {
+	Items       []BulkCheckItem
+	Consistency Consistency
+	// Relationships assumed to hold for every check of the batch, on top of the stored ones
+	ContextualRelationships []Relationship
+	// Values of caveat parameters not bound by the relationships, for every check of the batch
+	Context map[string]any
+}
+
+// BulkCheckItemResult is the outcome of one check of a bulk check. Err is set
+// instead of Allowed and Reason when the check could not be evaluated.
+type BulkCheckItemResult struct {
+	Allowed        bool
+	Permissionship Permissionship
+	// Caveat parameters that must be supplied to decide a conditional check
+	MissingContext []string
+	Reason         string
+	Err            error
+}
+
+// BulkCheckResult is the outcome of a bulk check, with one result per item in request order
+type BulkCheckResult struct {
+	Results []BulkCheckItemResult
+	// Revision every check was evaluated at
+	Revision    datastore.Revision
+	ZookieToken string
+	// Work done to answer all checks
+	Stats EvalStats
+}
+
+// BulkCheck evaluates a batch of checks at one revision, sharing memoized
+// subproblems between them. A check that fails, for example on an unknown
+// resource type, reports its error in its own result without failing the batch.
+// The batch fails as a whole only if the revision cannot be resolved or ctx is done.
+func (s *Store) BulkCheck(ctx context.Context, req BulkCheckRequest) (*BulkCheckResult, error) {
+	if len(req.Items) == 0 {
+		return nil, fmt.Errorf("no checks to evaluate")
+	}
+	if len(req.Items) > MaxBulkCheckItems {
+		return nil, fmt.Errorf("too many checks: %d > %d", len(req.Items), MaxBulkCheckItems)
+	}
+
+	revision, err := s.ResolveRevision(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+	reader, err = s.withContextualRelationships(reader, req.ContextualRelationships)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checks share memoized subproblems, except those with values of their own, whose
+	// caveated results may differ from the other checks'
+	ec := s.newEvalContext(ctx, reader, req.Context)
+	contexts := make([]*EvalContext, len(req.Items))
+	for i, item := range req.Items {
+		contexts[i] = ec
+		if len(item.Context) > 0 {
+			contexts[i] = s.newEvalContext(ctx, reader, mergeCaveatContext(req.Context, item.Context))
+		}
+	}
+
+	results := make([]BulkCheckItemResult, len(req.Items))
+	s.evaluator.forEach(len(req.Items), func(i int) {
+		item := req.Items[i]
+		result, reason, err := s.check(contexts[i], item.Subject, item.Resource, item.Action)
+		results[i] = BulkCheckItemResult{
+			Allowed:        result.allowed(),
+			Permissionship: result.permissionship,
+			MissingContext: result.missing,
+			Reason:         reason,
+			Err:            err,
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := ec.Stats()
+	for _, itemContext := range contexts {
+		if itemContext != ec {
+			stats = stats.add(itemContext.Stats())
+		}
+	}
+	return &BulkCheckResult{
+		Results:     results,
+		Revision:    revision,
+		ZookieToken: s.zookieForRevision(revision),
+		Stats:       stats,
+	}, nil
+}
+
+// mergeCaveatContext returns the values of both contexts, preferring those of override
+func mergeCaveatContext(base, override map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(override))
+	for name, value := range base {
+		merged[name] = value
+	}
+	for name, value := range override {
+		merged[name] = value
+	}
+	return merged
+}
@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// DefaultCheckCacheSize is the default number of relation evaluations kept by the check cache
+const DefaultCheckCacheSize = 10000
+
+// CacheStats reports the activity of the check cache
+type CacheStats struct {
+	Enabled bool `json:"enabled"`
+	// Window within which minimize_latency reads share a revision
+	QuantizationWindow string `json:"quantization_window"`
+	Size               int    `json:"size"`
+	Capacity           int    `json:"capacity"`
+	Hits               int64  `json:"hits"`
+	Misses             int64  `json:"misses"`
+	Evictions          int64  `json:"evictions"`
+	// Hits divided by lookups, or zero before the first lookup
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// cacheKey identifies a relation evaluation at a revision
+type cacheKey struct {
+	frame    evalFrame
+	revision datastore.Revision
+}
+
+// cacheEntry is a cached result, stored in the recency list
+type cacheEntry struct {
+	key    cacheKey
+	result checkResult
+}
+
+// checkCache is a size-bounded cache of relation evaluations shared by the checks of
+// a store. A result evaluated at a revision never changes, so entries need no
+// invalidation on writes; results that depend on the time are kept until they may
+// change. The least recently used entry is evicted when the cache is full.
+type checkCache struct {
+	capacity int
+	entries  map[cacheKey]*list.Element
+	// Entries from the most to the least recently used
+	recency *list.List
+	stats   CacheStats
+	mu      sync.Mutex
+}
+
+// newCheckCache creates a cache holding up to capacity results. A non-positive
+// capacity uses DefaultCheckCacheSize.
+func newCheckCache(capacity int) *checkCache {
+	if capacity <= 0 {
+		capacity = DefaultCheckCacheSize
+	}
+	return &checkCache{
+		capacity: capacity,
+		entries:  make(map[cacheKey]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+// get returns the cached result of an evaluation, if it is still valid at now
+func (c *checkCache) get(key cacheKey, now time.Time) (checkResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok {
+		entry := element.Value.(*cacheEntry)
+		if entry.result.validUntil.IsZero() || now.Before(entry.result.validUntil) {
+			c.recency.MoveToFront(element)
+			c.stats.Hits++
+			return entry.result, true
+		}
+		c.remove(element)
+	}
+	c.stats.Misses++
+	return noPermission, false
+}
+
+// put records the result of an evaluation, evicting the least recently used
+// entry if the cache is full. Results that are no longer valid at now are not kept.
+func (c *checkCache) put(key cacheKey, result checkResult, now time.Time) {
+	if !result.validUntil.IsZero() && !now.Before(result.validUntil) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).result = result
+		c.recency.MoveToFront(element)
+		return
+	}
+	if c.recency.Len() >= c.capacity {
+		c.remove(c.recency.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.recency.PushFront(&cacheEntry{key: key, result: result})
+}
+
+// remove drops an entry
+func (c *checkCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*cacheEntry).key)
+	c.recency.Remove(element)
+}
+
+// snapshot returns a copy of the statistics
+func (c *checkCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Enabled = true
+	stats.Size = c.recency.Len()
+	stats.Capacity = c.capacity
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// CacheStats returns the statistics of the check cache
+func (s *Store) CacheStats() CacheStats {
+	var stats CacheStats
+	if s.cache != nil {
+		stats = s.cache.snapshot()
+	}
+	stats.QuantizationWindow = s.quantization.String()
+	return stats
+}
+
+// newEvalContext creates an evaluation context for checks of the store reading from
+// the given snapshot. The checks share the store's cache, unless they assume
+// contextual relationships or supply caveat context: their results do not depend
+// on the revision alone.
+func (s *Store) newEvalContext(ctx context.Context, reader datastore.Reader, caveatContext map[string]any) *EvalContext {
+	ec := NewEvalContext(ctx, reader, s.maxDepth)
+	ec.caveatContext = caveatContext
+	if _, contextual := reader.(*contextualReader); !contextual && len(caveatContext) == 0 {
+		ec.cache = s.cache
+	}
+	return ec
+}
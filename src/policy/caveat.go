@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// CaveatNowParameter is the caveat parameter that defaults to the time of the check
+const CaveatNowParameter = "now"
+
+// ErrInvalidCaveatContext is returned when a value of the request context cannot be
+// converted to the type of the caveat parameter it is given for
+var ErrInvalidCaveatContext = errors.New("invalid caveat context")
+
+// caveatResult evaluates the caveat of a tuple. Values bound by the relationship
+// take precedence over the values in the request context. A caveat whose
+// parameters are not all given yields a conditional result listing the missing ones.
+// The result is valid until the tuple expires, or only for now if the caveat was
+// evaluated at the time of the check.
+func (s *Store) caveatResult(requestContext map[string]any, t datastore.Tuple) (checkResult, error) {
+	if t.Caveat == nil {
+		return hasPermission.until(t.ExpiresAt), nil
+	}
+	c, err := s.schema.GetCaveat(t.Caveat.Name)
+	if err != nil {
+		return noPermission, err
+	}
+
+	values := make(map[string]any, len(c.Parameters))
+	fromRequest := make(map[string]any)
+	for name := range c.Parameters {
+		if value, ok := t.Caveat.Context[name]; ok {
+			values[name] = value
+		} else if value, ok := requestContext[name]; ok {
+			values[name] = value
+			fromRequest[name] = value
+		}
+	}
+	if err := c.ValidateContext(fromRequest); err != nil {
+		return noPermission, fmt.Errorf("%w: %v", ErrInvalidCaveatContext, err)
+	}
+	validUntil := t.ExpiresAt
+	if _, ok := values[CaveatNowParameter]; !ok && c.Parameters[CaveatNowParameter] == schema.CaveatTypeTimestamp {
+		now := time.Now()
+		values[CaveatNowParameter] = now
+		validUntil = now
+	}
+
+	holds, err := c.Evaluate(values)
+	var missing *schema.MissingCaveatParametersError
+	if errors.As(err, &missing) {
+		return conditional(missing.Parameters).until(validUntil), nil
+	}
+	if err != nil {
+		return noPermission, err
+	}
+	return resultOf(holds).until(validUntil), nil
+}
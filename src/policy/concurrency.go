@@ -0,0 +1,129 @@
+package policy
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// DefaultMaxConcurrency is the default number of branches evaluated concurrently across all checks
+var DefaultMaxConcurrency = 4 * runtime.GOMAXPROCS(0)
+
+// branchResult is the outcome of one concurrently evaluated branch
+type branchResult struct {
+	index  int
+	result checkResult
+	err    error
+}
+
+// race evaluates n branches concurrently and combines their results: as a union
+// when want is HasPermission, and as an intersection when want is NoPermission.
+// It returns the index of the first branch that yields want, which decides the
+// combined result, or -1 if none does. Once a branch yields want, the remaining
+// branches are cancelled. Errors are only returned if no branch yields want.
+//
+// Branches run on the evaluator's bounded worker pool. When the pool is full, a
+// branch is evaluated on the calling goroutine instead, so nested fan-out can never
+// deadlock waiting for workers held by its ancestors. Explained checks evaluate
+// their branches in order on the calling goroutine, so that the trace is stable.
+func (e *Evaluator) race(ec *EvalContext, n int, want Permissionship, branch func(ec *EvalContext, i int) (checkResult, error)) (int, checkResult, error) {
+	if err := ec.ctx.Err(); err != nil {
+		return -1, noPermission, err
+	}
+	if n == 1 {
+		result, err := branch(ec, 0)
+		if err != nil {
+			return -1, noPermission, err
+		}
+		if result.permissionship == want {
+			return 0, result, nil
+		}
+		return -1, result, nil
+	}
+
+	ctx, cancel := context.WithCancel(ec.ctx)
+	defer cancel()
+	child := ec.withContext(ctx)
+
+	// Buffered so that branches finishing after a short-circuit never block
+	results := make(chan branchResult, n)
+	pending := 0
+	var firstErr error
+	combined := noPermission
+	if want == NoPermission {
+		combined = hasPermission
+	}
+
+	decide := func(r branchResult) bool {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			return false
+		}
+		if want == HasPermission {
+			combined = combined.union(r.result)
+		} else {
+			combined = combined.intersect(r.result)
+		}
+		return r.result.permissionship == want
+	}
+
+	for i := 0; i < n; i++ {
+		if ec.trace == nil {
+			select {
+			case e.workers <- struct{}{}:
+				pending++
+				go func(i int) {
+					defer func() { <-e.workers }()
+					result, err := branch(child, i)
+					results <- branchResult{index: i, result: result, err: err}
+				}(i)
+				continue
+			default:
+			}
+		}
+
+		result, err := branch(child, i)
+		if decide(branchResult{index: i, result: result, err: err}) {
+			return i, result, nil
+		}
+	}
+
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if decide(r) {
+				return r.index, r.result, nil
+			}
+		case <-ec.ctx.Done():
+			return -1, noPermission, ec.ctx.Err()
+		}
+	}
+
+	if firstErr != nil {
+		return -1, noPermission, firstErr
+	}
+	return -1, combined, nil
+}
+
+// forEach evaluates n independent items, concurrently on the evaluator's worker
+// pool where workers are free and on the calling goroutine otherwise, and waits
+// for all of them.
+func (e *Evaluator) forEach(n int, item func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		select {
+		case e.workers <- struct{}{}:
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-e.workers }()
+				item(i)
+			}(i)
+		default:
+			item(i)
+		}
+	}
+	wg.Wait()
+}
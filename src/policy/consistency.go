@@ -0,0 +1,115 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// ConsistencyMode defines how fresh the data used to answer a read must be
+type ConsistencyMode string
+
+const (
+	// MinimizeLatency reads at whatever revision is cheapest to serve
+	MinimizeLatency ConsistencyMode = "minimize_latency"
+	// AtLeastAsFresh reads at a revision no older than the zookie's revision
+	AtLeastAsFresh ConsistencyMode = "at_least_as_fresh"
+	// AtExactSnapshot reads at exactly the zookie's revision
+	AtExactSnapshot ConsistencyMode = "at_exact_snapshot"
+)
+
+// ErrInvalidConsistency is returned for consistency requirements that cannot be interpreted
+var ErrInvalidConsistency = errors.New("invalid consistency")
+
+// Consistency selects the revision a read is evaluated at
+type Consistency struct {
+	Mode   ConsistencyMode `json:"mode,omitempty"`
+	Zookie string          `json:"zookie,omitempty"`
+}
+
+// ResolveRevision returns the revision a read with the given consistency is evaluated at.
+// An empty mode is treated as minimize_latency.
+func (s *Store) ResolveRevision(consistency Consistency) (datastore.Revision, error) {
+	switch consistency.Mode {
+	case "", MinimizeLatency:
+		if consistency.Zookie != "" {
+			return 0, fmt.Errorf("%w: zookie is not used with %s", ErrInvalidConsistency, MinimizeLatency)
+		}
+		return s.quantizedRevision()
+
+	case AtLeastAsFresh:
+		zookie, err := s.decodeZookie(consistency.Zookie)
+		if err != nil {
+			return 0, err
+		}
+		head, err := s.datastore.HeadRevision()
+		if err != nil {
+			return 0, err
+		}
+		if zookie.Revision > head {
+			return 0, fmt.Errorf("%w: %d > %d", datastore.ErrFutureRevision, zookie.Revision, head)
+		}
+		// The shared revision of the window serves the read only if it is fresh enough
+		revision, err := s.quantizedRevision()
+		if err != nil {
+			return 0, err
+		}
+		if revision >= zookie.Revision {
+			return revision, nil
+		}
+		return head, nil
+
+	case AtExactSnapshot:
+		zookie, err := s.decodeZookie(consistency.Zookie)
+		if err != nil {
+			return 0, err
+		}
+		return zookie.Revision, nil
+
+	default:
+		return 0, fmt.Errorf("%w: unknown mode %s", ErrInvalidConsistency, consistency.Mode)
+	}
+}
+
+// quantizedHead holds the revision shared by the reads of a quantization window
+type quantizedHead struct {
+	revision datastore.Revision
+	// Start of the window the revision was chosen in
+	window time.Time
+	mu     sync.Mutex
+}
+
+// quantizedRevision returns the revision for reads that accept any recent revision.
+// Within a quantization window, it is the head revision as of the first such read of
+// the window, so it lags the head by less than the window. Without a window it is the head.
+func (s *Store) quantizedRevision() (datastore.Revision, error) {
+	if s.quantization <= 0 {
+		return s.datastore.HeadRevision()
+	}
+	window := time.Now().Truncate(s.quantization)
+
+	s.quantized.mu.Lock()
+	defer s.quantized.mu.Unlock()
+
+	if s.quantized.window.Equal(window) {
+		return s.quantized.revision, nil
+	}
+	head, err := s.datastore.HeadRevision()
+	if err != nil {
+		return 0, err
+	}
+	s.quantized.revision = head
+	s.quantized.window = window
+	return head, nil
+}
+
+// decodeZookie verifies a zookie required by a consistency mode
+func (s *Store) decodeZookie(token string) (*Zookie, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: zookie is required", ErrInvalidZookie)
+	}
+	return s.zookies.Decode(token)
+}
@@ -0,0 +1,63 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// ErrInvalidContextualRelationship is returned for contextual relationships the schema does not allow
+var ErrInvalidContextualRelationship = errors.New("invalid contextual relationship")
+
+// contextualReader overlays request-scoped tuples on a snapshot reader. The
+// contextual tuples are visible to queries through the reader only and are never written.
+type contextualReader struct {
+	datastore.Reader
+	tuples []datastore.Tuple
+}
+
+// QueryTuples returns the stored tuples matching the filter, followed by the matching
+// contextual tuples that are not also stored
+func (r *contextualReader) QueryTuples(filter datastore.Filter) ([]datastore.Tuple, error) {
+	tuples, err := r.Reader.QueryTuples(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var stored map[string]bool
+	for _, t := range r.tuples {
+		if !filter.Matches(t) || t.ExpiredAt(now) {
+			continue
+		}
+		if stored == nil {
+			stored = make(map[string]bool, len(tuples))
+			for _, s := range tuples {
+				stored[s.Key()] = true
+			}
+		}
+		if !stored[t.Key()] {
+			tuples = append(tuples, t)
+		}
+	}
+	return tuples, nil
+}
+
+// withContextualRelationships validates the contextual relationships of a request
+// against the schema and overlays them on the reader
+func (s *Store) withContextualRelationships(reader datastore.Reader, relationships []Relationship) (datastore.Reader, error) {
+	if len(relationships) == 0 {
+		return reader, nil
+	}
+
+	tuples := make([]datastore.Tuple, len(relationships))
+	for i, r := range relationships {
+		if err := s.validateRelationship(r.Resource, r.Relation, r.Subject, r.Caveat); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidContextualRelationship, err)
+		}
+		tuples[i] = datastore.Tuple{Resource: r.Resource, Relation: r.Relation, Subject: r.Subject, ExpiresAt: r.ExpiresAt, Caveat: r.Caveat}
+	}
+	return &contextualReader{Reader: reader, tuples: tuples}, nil
+}
@@ -0,0 +1,233 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// DefaultMaxDepth is the default limit on nested relation evaluations in a single check
+const DefaultMaxDepth = 50
+
+// evalFrame identifies a relation evaluation in progress
+type evalFrame struct {
+	object   string
+	relation string
+	subject  string
+}
+
+// String formats the frame as object#relation@subject
+func (f evalFrame) String() string {
+	return f.object + "#" + f.relation + "@" + f.subject
+}
+
+// evalStep is a frame on the evaluation path
+type evalStep struct {
+	frame evalFrame
+	// Set when the frame was entered by following a stored subject set
+	viaSubjectSet bool
+}
+
+// EvalContext carries the state of a single evaluation through the recursion: the
+// request context, the snapshot it reads from and the frames currently being evaluated
+type EvalContext struct {
+	ctx      context.Context
+	reader   datastore.Reader
+	maxDepth int
+	// Frames from the outermost evaluation to the current one
+	path []evalStep
+	// Set while entering the members of a stored subject set
+	viaSubjectSet bool
+	// Results shared by every branch of the request
+	memo *memo
+	// Node that nested evaluations are recorded under, when the check is explained
+	trace *TraceNode
+	// Values that caveats of the tuples read are evaluated against
+	caveatContext map[string]any
+	// Results shared with other requests at the same revision, or nil to bypass
+	cache *checkCache
+}
+
+// NewEvalContext creates an evaluation context reading from the given snapshot.
+// Evaluation stops when ctx is done. A non-positive maxDepth uses DefaultMaxDepth.
+func NewEvalContext(ctx context.Context, reader datastore.Reader, maxDepth int) *EvalContext {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	return &EvalContext{ctx: ctx, reader: reader, maxDepth: maxDepth, memo: newMemo()}
+}
+
+// Stats returns the evaluation counters of the request
+func (c *EvalContext) Stats() EvalStats {
+	return c.memo.stats()
+}
+
+// withContext returns a copy of the evaluation context that stops when ctx is done
+func (c *EvalContext) withContext(ctx context.Context) *EvalContext {
+	child := *c
+	child.ctx = ctx
+	return &child
+}
+
+// enter returns a context for evaluating a nested frame. It fails if the frame is
+// already being evaluated further up the path, or if the path is too deep. Groups
+// may contain each other, so a repeated frame whose cycle follows a stored subject
+// set fails with a cycleCut instead of a CycleDetectedError.
+func (c *EvalContext) enter(object, relation, subject string) (*EvalContext, error) {
+	step := evalStep{frame: evalFrame{object: object, relation: relation, subject: subject}, viaSubjectSet: c.viaSubjectSet}
+	for i, s := range c.path {
+		if s.frame != step.frame {
+			continue
+		}
+		viaSubjectSet := step.viaSubjectSet
+		for _, later := range c.path[i+1:] {
+			viaSubjectSet = viaSubjectSet || later.viaSubjectSet
+		}
+		if viaSubjectSet {
+			return nil, &cycleCut{depth: i}
+		}
+		return nil, &CycleDetectedError{Path: formatPath(append(c.path, step))}
+	}
+	if len(c.path) >= c.maxDepth {
+		return nil, &MaxDepthExceededError{MaxDepth: c.maxDepth, Path: formatPath(append(c.path, step))}
+	}
+
+	// Copy the path so that sibling branches never share frames
+	path := make([]evalStep, len(c.path), len(c.path)+1)
+	copy(path, c.path)
+	child := *c
+	child.path = append(path, step)
+	child.viaSubjectSet = false
+	return &child, nil
+}
+
+// followSubjectSet returns a context for entering the members of a stored subject set
+func (c *EvalContext) followSubjectSet() *EvalContext {
+	child := *c
+	child.viaSubjectSet = true
+	return &child
+}
+
+// formatPath formats frames for error messages
+func formatPath(path []evalStep) []string {
+	formatted := make([]string, len(path))
+	for i, s := range path {
+		formatted[i] = s.frame.String()
+	}
+	return formatted
+}
+
+// cycleCut is returned by enter when a frame is re-entered through stored subject
+// sets. The repeated evaluation contributes nothing, and results that depend on it
+// are provisional until the frame at depth completes.
+type cycleCut struct {
+	// Index of the repeated frame on the path
+	depth int
+}
+
+func (e *cycleCut) Error() string {
+	return fmt.Sprintf("cycle through subject sets at depth %d", e.depth)
+}
+
+// MaxDepthExceededError is returned when a check nests more relation evaluations than allowed
+type MaxDepthExceededError struct {
+	MaxDepth int
+	// Evaluation path, outermost frame first
+	Path []string
+}
+
+func (e *MaxDepthExceededError) Error() string {
+	return fmt.Sprintf("max depth %d exceeded: %s", e.MaxDepth, strings.Join(e.Path, " -> "))
+}
+
+// CycleDetectedError is returned when a check re-enters an evaluation that is already in progress
+type CycleDetectedError struct {
+	// Evaluation path, outermost frame first, ending with the repeated frame
+	Path []string
+}
+
+func (e *CycleDetectedError) Error() string {
+	return fmt.Sprintf("cycle detected: %s", strings.Join(e.Path, " -> "))
+}
+
+// EvalStats counts the work done by a single request
+type EvalStats struct {
+	// Relation evaluations that were computed
+	Dispatches int `json:"dispatch_count"`
+	// Relation evaluations answered from the memo
+	MemoHits int `json:"memo_hit_count"`
+	// Relation evaluations answered from the check cache
+	CacheHits int `json:"cache_hit_count"`
+}
+
+// add returns the sum of two sets of counters
+func (s EvalStats) add(other EvalStats) EvalStats {
+	return EvalStats{
+		Dispatches: s.Dispatches + other.Dispatches,
+		MemoHits:   s.MemoHits + other.MemoHits,
+		CacheHits:  s.CacheHits + other.CacheHits,
+	}
+}
+
+// memo is a request-scoped table of completed relation evaluations, so that
+// subproblems shared by several branches are computed once. Only results of
+// evaluations that finished without error are recorded.
+type memo struct {
+	results map[evalFrame]checkResult
+	counts  EvalStats
+	mu      sync.Mutex
+}
+
+// newMemo creates an empty memo
+func newMemo() *memo {
+	return &memo{
+		results: make(map[evalFrame]checkResult),
+	}
+}
+
+// lookup returns the recorded result of an evaluation, counting a hit
+func (m *memo) lookup(frame evalFrame) (checkResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result, ok := m.results[frame]
+	if ok {
+		m.counts.MemoHits++
+	}
+	return result, ok
+}
+
+// countDispatch counts an evaluation that is computed
+func (m *memo) countDispatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts.Dispatches++
+}
+
+// countCacheHit counts an evaluation answered from the check cache
+func (m *memo) countCacheHit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts.CacheHits++
+}
+
+// store records the result of a completed evaluation
+func (m *memo) store(frame evalFrame, result checkResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.results[frame] = result
+}
+
+// stats returns a copy of the counters
+func (m *memo) stats() EvalStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counts
+}
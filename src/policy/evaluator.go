@@ -1,179 +1,331 @@
 package policy
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/kanywst/zanzibar/src/datastore"
 	"github.com/kanywst/zanzibar/src/schema"
 )
 
 // Evaluator handles the evaluation of userset rewrite rules
 type Evaluator struct {
 	store *Store
+	// Bounded pool of workers for concurrent branch evaluation
+	workers chan struct{}
 }
 
-// NewEvaluator creates a new evaluator
-func NewEvaluator(store *Store) *Evaluator {
+// NewEvaluator creates a new evaluator that evaluates up to maxConcurrency
+// branches concurrently. A non-positive maxConcurrency uses DefaultMaxConcurrency.
+func NewEvaluator(store *Store, maxConcurrency int) *Evaluator {
+	if maxConcurrency <= 0 {
+		maxConcurrency = DefaultMaxConcurrency
+	}
 	return &Evaluator{
-		store: store,
+		store:   store,
+		workers: make(chan struct{}, maxConcurrency),
 	}
 }
 
 // EvaluateUserset evaluates a userset rewrite rule for a given object and relation
-func (e *Evaluator) EvaluateUserset(objectID, relation, subject string) (bool, error) {
+func (e *Evaluator) EvaluateUserset(ec *EvalContext, objectID, relation, subject string) (bool, error) {
+	result, err := e.evaluateUsersetResult(ec, objectID, relation, subject)
+	return result.allowed(), err
+}
+
+// evaluateUsersetResult evaluates a relation on an object, recording it in the trace
+func (e *Evaluator) evaluateUsersetResult(ec *EvalContext, objectID, relation, subject string) (checkResult, error) {
+	ec, node := ec.traceStart(TraceNodeRelation, objectID, relation)
+	result, err := e.evaluateUserset(ec, objectID, relation, subject)
+	node.finish(result, err)
+	return result, err
+}
+
+// evaluateUserset evaluates a relation, reusing the result of an earlier evaluation in the request
+func (e *Evaluator) evaluateUserset(ec *EvalContext, objectID, relation, subject string) (checkResult, error) {
+	if err := ec.ctx.Err(); err != nil {
+		return noPermission, err
+	}
+
+	// Shared subproblems are evaluated once per request
+	frame := evalFrame{object: objectID, relation: relation, subject: subject}
+	if result, ok := ec.memo.lookup(frame); ok {
+		ec.trace.markCached()
+		return result, nil
+	}
+
+	// Requests at the same revision share results through the cache
+	key := cacheKey{frame: frame, revision: ec.reader.Revision()}
+	if ec.cache != nil {
+		if result, ok := ec.cache.get(key, time.Now()); ok {
+			ec.memo.countCacheHit()
+			ec.memo.store(frame, result)
+			ec.trace.markCached()
+			return result, nil
+		}
+	}
+	ec.memo.countDispatch()
+
+	result, err := e.evaluateRelation(ec, objectID, relation, subject)
+	if err != nil {
+		return noPermission, err
+	}
+	// A cycle cut at this frame is resolved once the frame completes; results
+	// depending on a cut further up the path are not recorded
+	if result.cutAt > len(ec.path) {
+		result.cutAt = 0
+	}
+	if result.cutAt != 0 {
+		return result, nil
+	}
+	ec.memo.store(frame, result)
+	if ec.cache != nil {
+		ec.cache.put(key, result, time.Now())
+	}
+	return result, nil
+}
+
+// evaluateRelation evaluates a relation on an object, entering a new frame
+func (e *Evaluator) evaluateRelation(ec *EvalContext, objectID, relation, subject string) (checkResult, error) {
+	ec, err := ec.enter(objectID, relation, subject)
+	var cut *cycleCut
+	if errors.As(err, &cut) {
+		// Members of groups that contain each other are found from the outermost one
+		return checkResult{permissionship: NoPermission, cutAt: cut.depth + 1}, nil
+	}
+	if err != nil {
+		return noPermission, err
+	}
+
 	// Parse resource to get type
 	resourceParts := strings.SplitN(objectID, ":", 2)
 	if len(resourceParts) != 2 {
-		return false, fmt.Errorf("invalid resource format: %s", objectID)
+		return noPermission, fmt.Errorf("invalid resource format: %s", objectID)
 	}
 	resourceType := resourceParts[0]
 
 	// Get the definition for the resource type
 	def, err := e.store.schema.GetDefinition(resourceType)
 	if err != nil {
-		return false, err
+		return noPermission, err
 	}
 
 	// Get the relation definition
 	rel, exists := def.Relations[relation]
 	if !exists {
-		return false, fmt.Errorf("relation %s not defined for resource type %s", relation, resourceType)
+		return noPermission, fmt.Errorf("relation %s not defined for resource type %s", relation, resourceType)
+	}
+
+	// Nested memberships are answered by the Leopard index where it can
+	if e.store.leopard != nil && isMembershipRelation(resourceType, relation, rel) {
+		member, ok, err := e.store.leopard.isMember(ec.reader, objectID, relation, subject)
+		if err != nil {
+			return noPermission, err
+		}
+		if ok {
+			_, node := ec.traceStart(TraceNodeLeopard, objectID, relation)
+			node.finish(resultOf(member), nil)
+			return resultOf(member), nil
+		}
 	}
 
 	// If there's no userset rewrite rule, fall back to direct relation check
 	if rel.UsersetRewrite == nil {
-		// Check direct relation
-		for _, r := range e.store.relationships {
-			if r.Resource == objectID && r.Relation == relation && r.Subject == subject {
-				return true, nil
-			}
+		ec, node := ec.traceStart(string(schema.UsersetRewriteThis), objectID, relation)
+		result, err := e.evaluateDirect(ec, objectID, relation, subject)
+		node.finish(result, err)
+		return result, err
+	}
+
+	// Evaluate the userset rewrite rule
+	return e.evaluateUsersetRewrite(ec, objectID, relation, rel.UsersetRewrite, subject)
+}
+
+// evaluateDirect checks the stored tuples for a relation, matching wildcards and following
+// subject sets. Tuples whose caveat does not hold are ignored; tuples whose caveat lacks
+// parameters make the result conditional.
+func (e *Evaluator) evaluateDirect(ec *EvalContext, objectID, relation, subject string) (checkResult, error) {
+	reader := ec.reader
+	result := noPermission
+
+	// Check direct relation
+	tuples, err := reader.QueryTuples(datastore.Filter{Resource: objectID, Relation: relation, Subject: subject})
+	if err != nil {
+		return noPermission, err
+	}
+	ec.trace.consult(tuples)
+	for _, t := range tuples {
+		caveat, err := e.store.caveatResult(ec.caveatContext, t)
+		if err != nil {
+			return noPermission, err
 		}
+		result = result.union(caveat)
+	}
+	if result.allowed() {
+		return result, nil
+	}
 
-		// Check group membership
-		if strings.HasPrefix(subject, "user:") {
-			groups := e.store.getGroupMemberships(subject, make(map[string]bool))
-			for groupID := range groups {
-				for _, r := range e.store.relationships {
-					if r.Resource == objectID && r.Relation == relation && r.Subject == groupID {
-						return true, nil
-					}
-				}
+	// Check wildcards (type:*) and subject sets (type:id#relation) granted the relation
+	tuples, err = reader.QueryTuples(datastore.Filter{Resource: objectID, Relation: relation, IndirectSubjects: true})
+	if err != nil {
+		return noPermission, err
+	}
+	ec.trace.consult(tuples)
+	wildcard := wildcardFor(subject)
+	type subjectSet struct {
+		object, relation string
+		caveat           checkResult
+	}
+	var sets []subjectSet
+	for _, t := range tuples {
+		object, setRelation, isSet := parseSubjectSet(t.Subject)
+		if !isSet && t.Subject != wildcard {
+			continue
+		}
+		caveat, err := e.store.caveatResult(ec.caveatContext, t)
+		if err != nil {
+			return noPermission, err
+		}
+		if caveat.permissionship == NoPermission {
+			// Kept only for how long the caveat stays unsatisfied
+			result = result.union(caveat)
+			continue
+		}
+		if !isSet {
+			result = result.union(caveat)
+			if result.allowed() {
+				return result, nil
 			}
+			continue
 		}
-
-		return false, nil
+		sets = append(sets, subjectSet{object: object, relation: setRelation, caveat: caveat})
+	}
+	if len(sets) == 0 {
+		return result, nil
 	}
 
-	// Evaluate the userset rewrite rule
-	return e.evaluateUsersetRewrite(objectID, rel.UsersetRewrite, subject)
+	// Members of a caveated subject set are granted only if the caveat holds
+	_, members, err := e.race(ec, len(sets), HasPermission, func(ec *EvalContext, i int) (checkResult, error) {
+		member, err := e.evaluateUsersetResult(ec.followSubjectSet(), sets[i].object, sets[i].relation, subject)
+		return sets[i].caveat.intersect(member), err
+	})
+	if err != nil {
+		return noPermission, err
+	}
+	return result.union(members), nil
 }
 
 // evaluateUsersetRewrite evaluates a userset rewrite rule
-func (e *Evaluator) evaluateUsersetRewrite(objectID string, rewrite *schema.UsersetRewrite, subject string) (bool, error) {
+func (e *Evaluator) evaluateUsersetRewrite(ec *EvalContext, objectID, relation string, rewrite *schema.UsersetRewrite, subject string) (checkResult, error) {
+	ec, node := ec.traceStart(string(rewrite.Type), objectID, relation)
+	result, err := e.evaluateRewrite(ec, objectID, relation, rewrite, subject)
+	node.finish(result, err)
+	return result, err
+}
+
+// evaluateRewrite evaluates a userset rewrite rule according to its type
+func (e *Evaluator) evaluateRewrite(ec *EvalContext, objectID, relation string, rewrite *schema.UsersetRewrite, subject string) (checkResult, error) {
 	switch rewrite.Type {
 	case schema.UsersetRewriteThis:
 		// Check direct relation (this)
-		for _, r := range e.store.relationships {
-			if r.Resource == objectID && r.Subject == subject {
-				return true, nil
-			}
-		}
-		return false, nil
+		return e.evaluateDirect(ec, objectID, relation, subject)
 
 	case schema.UsersetRewriteComputedUserset:
 		// Check computed userset (another relation on the same object)
 		if rewrite.ComputedUserset == nil {
-			return false, fmt.Errorf("computed_userset is nil")
+			return noPermission, fmt.Errorf("computed_userset is nil")
 		}
-		return e.EvaluateUserset(objectID, rewrite.ComputedUserset.Relation, subject)
+		return e.evaluateUsersetResult(ec, objectID, rewrite.ComputedUserset.Relation, subject)
 
 	case schema.UsersetRewriteTupleToUserset:
 		// Check tuple_to_userset (relation on another object)
 		if rewrite.TupleToUserset == nil {
-			return false, fmt.Errorf("tuple_to_userset is nil")
+			return noPermission, fmt.Errorf("tuple_to_userset is nil")
 		}
 
 		// Get the tupleset relation
 		tupleRelation := rewrite.TupleToUserset.Tupleset.Relation
 
 		// Find all objects that have the specified relation with this object
+		tuples, err := ec.reader.QueryTuples(datastore.Filter{Resource: objectID, Relation: tupleRelation})
+		if err != nil {
+			return noPermission, err
+		}
+		ec.trace.consult(tuples)
 		var relatedObjects []string
-		for _, r := range e.store.relationships {
-			if r.Resource == objectID && r.Relation == tupleRelation {
-				relatedObjects = append(relatedObjects, r.Subject)
+		var caveats []checkResult
+		unsatisfied := noPermission
+		for _, r := range tuples {
+			caveat, err := e.store.caveatResult(ec.caveatContext, r)
+			if err != nil {
+				return noPermission, err
+			}
+			if caveat.permissionship == NoPermission {
+				unsatisfied = unsatisfied.union(caveat)
+				continue
 			}
+			relatedObjects = append(relatedObjects, r.Subject)
+			caveats = append(caveats, caveat)
+		}
+		if len(relatedObjects) == 0 {
+			return unsatisfied, nil
 		}
 
 		// Check if the subject has the computed relation with any of the related objects
 		computedRelation := rewrite.TupleToUserset.ComputedUserset.Relation
-		for _, relatedObj := range relatedObjects {
-			allowed, err := e.EvaluateUserset(relatedObj, computedRelation, subject)
-			if err != nil {
-				return false, err
-			}
-			if allowed {
-				return true, nil
-			}
-		}
-		return false, nil
+		_, result, err := e.race(ec, len(relatedObjects), HasPermission, func(ec *EvalContext, i int) (checkResult, error) {
+			related, err := e.evaluateUsersetResult(ec, relatedObjects[i], computedRelation, subject)
+			return caveats[i].intersect(related), err
+		})
+		return unsatisfied.union(result), err
 
 	case schema.UsersetRewriteUnion:
 		// Check union (any of the child rules match)
 		if rewrite.Children == nil || len(rewrite.Children) == 0 {
-			return false, fmt.Errorf("union has no children")
+			return noPermission, fmt.Errorf("union has no children")
 		}
 
-		for _, child := range rewrite.Children {
-			allowed, err := e.evaluateUsersetRewrite(objectID, child, subject)
-			if err != nil {
-				return false, err
-			}
-			if allowed {
-				return true, nil
-			}
-		}
-		return false, nil
+		_, result, err := e.race(ec, len(rewrite.Children), HasPermission, func(ec *EvalContext, i int) (checkResult, error) {
+			return e.evaluateUsersetRewrite(ec, objectID, relation, rewrite.Children[i], subject)
+		})
+		return result, err
 
 	case schema.UsersetRewriteIntersection:
 		// Check intersection (all of the child rules match)
 		if rewrite.Children == nil || len(rewrite.Children) == 0 {
-			return false, fmt.Errorf("intersection has no children")
+			return noPermission, fmt.Errorf("intersection has no children")
 		}
 
-		for _, child := range rewrite.Children {
-			allowed, err := e.evaluateUsersetRewrite(objectID, child, subject)
-			if err != nil {
-				return false, err
-			}
-			if !allowed {
-				return false, nil
-			}
-		}
-		return true, nil
+		_, result, err := e.race(ec, len(rewrite.Children), NoPermission, func(ec *EvalContext, i int) (checkResult, error) {
+			return e.evaluateUsersetRewrite(ec, objectID, relation, rewrite.Children[i], subject)
+		})
+		return result, err
 
 	case schema.UsersetRewriteExclusion:
 		// Check exclusion (base - subtract)
 		if rewrite.Children == nil || len(rewrite.Children) != 2 {
-			return false, fmt.Errorf("exclusion must have exactly 2 children")
+			return noPermission, fmt.Errorf("exclusion must have exactly 2 children")
 		}
 
-		baseAllowed, err := e.evaluateUsersetRewrite(objectID, rewrite.Children[0], subject)
+		base, err := e.evaluateUsersetRewrite(ec, objectID, relation, rewrite.Children[0], subject)
 		if err != nil {
-			return false, err
+			return noPermission, err
 		}
 
-		if !baseAllowed {
-			return false, nil
+		if base.permissionship == NoPermission {
+			return base, nil
 		}
 
-		subtractAllowed, err := e.evaluateUsersetRewrite(objectID, rewrite.Children[1], subject)
+		subtract, err := e.evaluateUsersetRewrite(ec, objectID, relation, rewrite.Children[1], subject)
 		if err != nil {
-			return false, err
+			return noPermission, err
 		}
 
-		return baseAllowed && !subtractAllowed, nil
+		return base.exclude(subtract), nil
 
 	default:
-		return false, fmt.Errorf("unknown userset rewrite type: %s", rewrite.Type)
+		return noPermission, fmt.Errorf("unknown userset rewrite type: %s", rewrite.Type)
 	}
 }
@@ -0,0 +1,239 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// DefaultExpandDepth is the default number of nested usersets expanded by ExpandTree
+const DefaultExpandDepth = 10
+
+const (
+	// UsersetTreeLeaf lists subjects: users, wildcards and unexpanded subject sets
+	UsersetTreeLeaf = "leaf"
+	// UsersetTreeUnion holds the subjects of any of its children
+	UsersetTreeUnion = "union"
+	// UsersetTreeIntersection holds the subjects of all of its children
+	UsersetTreeIntersection = "intersection"
+	// UsersetTreeExclusion holds the subjects of its first child that are not in its second
+	UsersetTreeExclusion = "exclusion"
+)
+
+// UsersetTree is a node of an expanded userset. Object and Relation name the
+// userset the node belongs to; a leaf whose only subject is that userset
+// (object#relation) was not expanded further.
+type UsersetTree struct {
+	Type     string   `json:"type"`
+	Object   string   `json:"object"`
+	Relation string   `json:"relation"`
+	Subjects []string `json:"subjects,omitempty"`
+	// Caveat of the relationship the node was reached through; the node's subjects
+	// only hold when it is satisfied
+	Caveat   *datastore.ContextualizedCaveat `json:"caveat,omitempty"`
+	Children []*UsersetTree                  `json:"children,omitempty"`
+}
+
+// ExpandTreeRequest asks for the userset tree of a permission or relation on a resource
+type ExpandTreeRequest struct {
+	Resource string
+	// Permission or relation of the resource
+	Relation string
+	// Number of nested usersets to expand; non-positive uses DefaultExpandDepth
+	Depth       int
+	Consistency Consistency
+}
+
+// ExpandTree returns the userset tree of a permission or relation on a resource,
+// built from the relations' userset rewrites and the permission expressions.
+// Usersets deeper than the requested depth, and usersets that are already being
+// expanded further up the tree, are returned as leaves referencing the subject set.
+func (s *Store) ExpandTree(ctx context.Context, req ExpandTreeRequest) (*UsersetTree, string, error) {
+	depth := req.Depth
+	if depth <= 0 {
+		depth = DefaultExpandDepth
+	}
+
+	revision, err := s.ResolveRevision(req.Consistency)
+	if err != nil {
+		return nil, "", err
+	}
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, "", err
+	}
+
+	e := &treeExpander{ctx: ctx, reader: reader, schema: s.schema}
+	tree, err := e.expandUserset(userset{object: req.Resource, relation: req.Relation}, depth, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return tree, s.zookieForRevision(revision), nil
+}
+
+// treeExpander builds userset trees from one snapshot
+type treeExpander struct {
+	ctx    context.Context
+	reader datastore.Reader
+	schema *schema.Schema
+}
+
+// reference returns a leaf standing for an unexpanded userset
+func reference(u userset) *UsersetTree {
+	return &UsersetTree{Type: UsersetTreeLeaf, Object: u.object, Relation: u.relation, Subjects: []string{u.subject()}}
+}
+
+// expandUserset expands a permission or relation of an object. path holds the
+// usersets being expanded further up the tree.
+func (e *treeExpander) expandUserset(u userset, depth int, path []userset) (*UsersetTree, error) {
+	if err := e.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if depth <= 0 {
+		return reference(u), nil
+	}
+	for _, p := range path {
+		if p == u {
+			return reference(u), nil
+		}
+	}
+	path = append(path[:len(path):len(path)], u)
+
+	def, err := e.schema.GetDefinition(objectType(u.object))
+	if err != nil {
+		return nil, err
+	}
+
+	if perm, exists := def.Permissions[u.relation]; exists {
+		node := &UsersetTree{Type: UsersetTreeUnion, Object: u.object, Relation: u.relation}
+		for _, relation := range permissionRelations(perm) {
+			child, err := e.expandUserset(userset{object: u.object, relation: relation}, depth-1, path)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+		}
+		return node, nil
+	}
+
+	rel, exists := def.Relations[u.relation]
+	if !exists {
+		return nil, fmt.Errorf("relation %s not defined for resource type %s", u.relation, def.Type)
+	}
+	if rel.UsersetRewrite == nil {
+		return e.expandDirect(u, depth, path)
+	}
+	return e.expandRewrite(u, rel.UsersetRewrite, depth, path)
+}
+
+// expandDirect expands the stored tuples of a relation. Plain subjects are listed in
+// a leaf; subject sets are expanded as children. Each caveated subject gets a leaf of
+// its own, and each caveated subject set a child, that carries the caveat.
+func (e *treeExpander) expandDirect(u userset, depth int, path []userset) (*UsersetTree, error) {
+	tuples, err := e.reader.QueryTuples(datastore.Filter{Resource: u.object, Relation: u.relation})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tuples, func(i, j int) bool {
+		return tuples[i].Subject < tuples[j].Subject
+	})
+
+	leaf := &UsersetTree{Type: UsersetTreeLeaf, Object: u.object, Relation: u.relation, Subjects: []string{}}
+	var conditional, sets []datastore.Tuple
+	for _, t := range tuples {
+		switch _, _, isSet := parseSubjectSet(t.Subject); {
+		case isSet:
+			sets = append(sets, t)
+		case t.Caveat != nil:
+			conditional = append(conditional, t)
+		default:
+			leaf.Subjects = append(leaf.Subjects, t.Subject)
+		}
+	}
+	if len(conditional) == 0 && len(sets) == 0 {
+		return leaf, nil
+	}
+
+	node := &UsersetTree{Type: UsersetTreeUnion, Object: u.object, Relation: u.relation}
+	if len(leaf.Subjects) > 0 {
+		node.Children = append(node.Children, leaf)
+	}
+	for _, t := range conditional {
+		node.Children = append(node.Children, &UsersetTree{
+			Type:     UsersetTreeLeaf,
+			Object:   u.object,
+			Relation: u.relation,
+			Subjects: []string{t.Subject},
+			Caveat:   t.Caveat,
+		})
+	}
+	for _, t := range sets {
+		object, relation, _ := parseSubjectSet(t.Subject)
+		child, err := e.expandUserset(userset{object: object, relation: relation}, depth-1, path)
+		if err != nil {
+			return nil, err
+		}
+		child.Caveat = t.Caveat
+		node.Children = append(node.Children, child)
+	}
+	return node, nil
+}
+
+// expandRewrite expands a userset rewrite rule of a relation
+func (e *treeExpander) expandRewrite(u userset, rewrite *schema.UsersetRewrite, depth int, path []userset) (*UsersetTree, error) {
+	switch rewrite.Type {
+	case schema.UsersetRewriteThis:
+		return e.expandDirect(u, depth, path)
+
+	case schema.UsersetRewriteComputedUserset:
+		if rewrite.ComputedUserset == nil {
+			return nil, fmt.Errorf("computed_userset is nil")
+		}
+		return e.expandUserset(userset{object: u.object, relation: rewrite.ComputedUserset.Relation}, depth-1, path)
+
+	case schema.UsersetRewriteTupleToUserset:
+		if rewrite.TupleToUserset == nil {
+			return nil, fmt.Errorf("tuple_to_userset is nil")
+		}
+		tuples, err := e.reader.QueryTuples(datastore.Filter{Resource: u.object, Relation: rewrite.TupleToUserset.Tupleset.Relation})
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(tuples, func(i, j int) bool {
+			return tuples[i].Subject < tuples[j].Subject
+		})
+		node := &UsersetTree{Type: UsersetTreeUnion, Object: u.object, Relation: u.relation}
+		for _, t := range tuples {
+			child, err := e.expandUserset(userset{object: t.Subject, relation: rewrite.TupleToUserset.ComputedUserset.Relation}, depth-1, path)
+			if err != nil {
+				return nil, err
+			}
+			child.Caveat = t.Caveat
+			node.Children = append(node.Children, child)
+		}
+		return node, nil
+
+	case schema.UsersetRewriteUnion, schema.UsersetRewriteIntersection, schema.UsersetRewriteExclusion:
+		if len(rewrite.Children) == 0 {
+			return nil, fmt.Errorf("%s has no children", rewrite.Type)
+		}
+		if rewrite.Type == schema.UsersetRewriteExclusion && len(rewrite.Children) != 2 {
+			return nil, fmt.Errorf("exclusion must have exactly 2 children")
+		}
+		node := &UsersetTree{Type: string(rewrite.Type), Object: u.object, Relation: u.relation}
+		for _, child := range rewrite.Children {
+			subtree, err := e.expandRewrite(u, child, depth, path)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, subtree)
+		}
+		return node, nil
+
+	default:
+		return nil, fmt.Errorf("unknown userset rewrite type: %s", rewrite.Type)
+	}
+}
@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// DefaultExpirySweepInterval is the default interval between sweeps of expired relationships
+const DefaultExpirySweepInterval = time.Minute
+
+// validateExpiry rejects expiry times that have already passed
+func validateExpiry(expiresAt time.Time) error {
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return fmt.Errorf("expires_at is in the past: %s", expiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// SweepExpired deletes every expired relationship in a single write and returns the
+// number of relationships deleted. Reads already treat expired relationships as
+// absent; sweeping removes them from storage and records their deletion as ordinary
+// change events.
+func (s *Store) SweepExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired, err := s.datastore.ExpiredTuples(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	updates := make([]datastore.Update, len(expired))
+	for i, t := range expired {
+		updates[i] = datastore.Update{Operation: datastore.UpdateDelete, Tuple: t}
+	}
+	if _, err := s.datastore.Write(updates); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// RunExpirySweeper sweeps expired relationships every interval until ctx is done
+func (s *Store) RunExpirySweeper(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultExpirySweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.SweepExpired(); err != nil {
+				log.Printf("Failed to sweep expired relationships: %v", err)
+			}
+		}
+	}
+}
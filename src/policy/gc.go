@@ -0,0 +1,101 @@
+package policy
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+const (
+	// DefaultRetentionWindow is the default period for which history is kept readable
+	DefaultRetentionWindow = 24 * time.Hour
+	// DefaultGCInterval is the default interval between garbage collection passes
+	DefaultGCInterval = 5 * time.Minute
+)
+
+// GCStats reports garbage collection activity
+type GCStats struct {
+	RetentionWindow string    `json:"retention_window"`
+	Runs            int64     `json:"runs"`
+	Failures        int64     `json:"failures"`
+	LastRunAt       time.Time `json:"last_run_at,omitzero"`
+	LastDuration    string    `json:"last_duration,omitempty"`
+	LastError       string    `json:"last_error,omitempty"`
+	// Oldest revision that can be read; zookies for older revisions are rejected
+	MinRevision  datastore.Revision `json:"min_revision"`
+	HeadRevision datastore.Revision `json:"head_revision"`
+	// Removed by the last pass
+	LastCollectedVersions int `json:"last_collected_versions"`
+	LastCollectedChanges  int `json:"last_collected_changes"`
+	// Removed since the store was created
+	TotalCollectedVersions int64 `json:"total_collected_versions"`
+	TotalCollectedChanges  int64 `json:"total_collected_changes"`
+}
+
+// gcState holds the garbage collection statistics of a store
+type gcState struct {
+	stats GCStats
+	mu    sync.Mutex
+}
+
+// GarbageCollect drops the history that is older than the retention window. Reads
+// and watches at revisions that are no longer retained fail with ErrSnapshotExpired.
+func (s *Store) GarbageCollect() (datastore.GCResult, error) {
+	start := time.Now()
+	result, err := s.datastore.GarbageCollect(start.Add(-s.retention))
+
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+
+	stats := &s.gc.stats
+	stats.Runs++
+	stats.LastRunAt = start
+	stats.LastDuration = time.Since(start).String()
+	if err != nil {
+		stats.Failures++
+		stats.LastError = err.Error()
+		return result, err
+	}
+	stats.LastError = ""
+	stats.MinRevision = result.MinRevision
+	stats.LastCollectedVersions = result.CollectedVersions
+	stats.LastCollectedChanges = result.CollectedChanges
+	stats.TotalCollectedVersions += int64(result.CollectedVersions)
+	stats.TotalCollectedChanges += int64(result.CollectedChanges)
+	return result, nil
+}
+
+// GCStats returns the garbage collection statistics
+func (s *Store) GCStats() GCStats {
+	s.gc.mu.Lock()
+	stats := s.gc.stats
+	s.gc.mu.Unlock()
+
+	stats.RetentionWindow = s.retention.String()
+	stats.HeadRevision, _ = s.datastore.HeadRevision()
+	return stats
+}
+
+// RunGarbageCollector collects old history every interval until ctx is done
+func (s *Store) RunGarbageCollector(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultGCInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.GarbageCollect(); err != nil {
+				log.Printf("Failed to garbage collect history: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// LeopardIndex keeps the transitive closure of membership relations, as described
+// for the Leopard indexing system in the Zanzibar paper. A membership relation, such
+// as group#member, has no userset rewrite and admits only plain subjects and subject
+// sets of the same relation (group:x#member). For each such relation the index holds
+// the objects that directly include each plain subject and, for each object, every
+// object nested in it, so that membership is answered without recursion.
+//
+// The index is kept at a single revision and brought forward incrementally from the
+// datastore's changes. A query at an older revision, such as a quantized
+// minimize_latency read, is answered only if the relation has not changed since
+// that revision; queries at newer revisions bring the index forward. Queries
+// involving tuples that expire or carry a caveat are not answered by the index.
+type LeopardIndex struct {
+	datastore datastore.Datastore
+	// Revision the graphs reflect, or -1 before the first query
+	revision datastore.Revision
+	// Graphs of the membership relations queried so far, by type#relation
+	graphs map[string]*membershipGraph
+	mu     sync.RWMutex
+}
+
+// membershipGraph is the index of one membership relation
+type membershipGraph struct {
+	resourceType string
+	relation     string
+	// Oldest revision known to have the relation's tuples of the index's revision;
+	// the graph also answers reads at the revisions in between
+	unchangedSince datastore.Revision
+	// Plain subjects to the objects whose relation includes them directly
+	memberOf map[string]map[string]bool
+	// Objects to the objects included through object#relation subject sets, and back
+	children map[string]map[string]bool
+	parents  map[string]map[string]bool
+	// Objects to every object reachable through one or more subject sets
+	descendants map[string]map[string]bool
+	// Tuples that expire or carry a caveat, which are left out of the graph,
+	// and the number of them on each object
+	volatile        map[string]bool
+	volatileObjects map[string]int
+}
+
+// newLeopardIndex creates an empty index over the datastore
+func newLeopardIndex(ds datastore.Datastore) *LeopardIndex {
+	return &LeopardIndex{datastore: ds, revision: -1, graphs: make(map[string]*membershipGraph)}
+}
+
+// isMembershipRelation reports whether a relation can be answered by the index
+func isMembershipRelation(resourceType, relation string, rel schema.Relation) bool {
+	if rel.UsersetRewrite != nil {
+		return false
+	}
+	nested := false
+	for _, subject := range rel.Subjects {
+		switch {
+		case subject.Wildcard || subject.Caveat != "":
+			return false
+		case subject.Relation == "":
+		case subject.Type == resourceType && subject.Relation == relation:
+			nested = true
+		default:
+			return false
+		}
+	}
+	return nested
+}
+
+// isMember answers whether the subject is in the relation of the object, as read by
+// the reader. ok is false if the index cannot answer the query.
+func (x *LeopardIndex) isMember(reader datastore.Reader, object, relation, subject string) (member, ok bool, err error) {
+	if _, contextual := reader.(*contextualReader); contextual {
+		return false, false, nil
+	}
+	revision := reader.Revision()
+	key := objectType(object) + "#" + relation
+
+	x.mu.RLock()
+	graph := x.graphs[key]
+	if graph != nil && graph.unchangedSince <= revision && revision <= x.revision {
+		member, ok = graph.isMember(object, subject)
+		x.mu.RUnlock()
+		return member, ok, nil
+	}
+	x.mu.RUnlock()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.sync(revision); err != nil {
+		return false, false, err
+	}
+	graph = x.graphs[key]
+	if x.revision != revision {
+		// The index is newer; its graph holds the tuples of the revision only if
+		// the relation has not changed since
+		if graph == nil || graph.unchangedSince > revision {
+			return false, false, nil
+		}
+		member, ok = graph.isMember(object, subject)
+		return member, ok, nil
+	}
+	if graph == nil {
+		graph, err = buildMembershipGraph(reader, objectType(object), relation)
+		if err != nil {
+			return false, false, err
+		}
+		x.graphs[key] = graph
+	}
+	member, ok = graph.isMember(object, subject)
+	return member, ok, nil
+}
+
+// sync brings the graphs forward to the revision by applying the changes committed
+// since the index's revision. It leaves the index at a newer revision untouched. If
+// the changes are no longer retained, the graphs are dropped and rebuilt on demand.
+func (x *LeopardIndex) sync(revision datastore.Revision) error {
+	if x.revision >= revision {
+		return nil
+	}
+	if x.revision < 0 || len(x.graphs) == 0 {
+		x.graphs = make(map[string]*membershipGraph)
+		x.revision = revision
+		return nil
+	}
+
+	changes, _, err := x.datastore.Changes(x.revision)
+	if errors.Is(err, datastore.ErrSnapshotExpired) {
+		x.graphs = make(map[string]*membershipGraph)
+		x.revision = revision
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.Revision > revision {
+			break
+		}
+		for _, u := range c.Updates {
+			graph := x.graphs[u.Tuple.ResourceType()+"#"+u.Tuple.Relation]
+			if graph == nil {
+				continue
+			}
+			graph.unchangedSince = c.Revision
+			graph.remove(u.Tuple)
+			if u.Operation == datastore.UpdateTouch {
+				graph.add(u.Tuple)
+			}
+		}
+	}
+	x.revision = revision
+	return nil
+}
+
+// buildMembershipGraph builds the graph of a membership relation from a snapshot
+func buildMembershipGraph(reader datastore.Reader, resourceType, relation string) (*membershipGraph, error) {
+	tuples, err := reader.QueryTuples(datastore.Filter{ResourceType: resourceType, Relation: relation})
+	if err != nil {
+		return nil, err
+	}
+	g := &membershipGraph{
+		resourceType:    resourceType,
+		relation:        relation,
+		unchangedSince:  reader.Revision(),
+		memberOf:        make(map[string]map[string]bool),
+		children:        make(map[string]map[string]bool),
+		parents:         make(map[string]map[string]bool),
+		descendants:     make(map[string]map[string]bool),
+		volatile:        make(map[string]bool),
+		volatileObjects: make(map[string]int),
+	}
+	for _, t := range tuples {
+		g.add(t)
+	}
+	return g, nil
+}
+
+// nestedObject returns the object of a subject set of the graph's relation, or ""
+func (g *membershipGraph) nestedObject(subject string) string {
+	object, relation, isSet := parseSubjectSet(subject)
+	if !isSet || relation != g.relation || objectType(object) != g.resourceType {
+		return ""
+	}
+	return object
+}
+
+// isMember answers whether the subject is in the relation of the object. ok is false
+// if a volatile tuple may affect the answer, or the subject is not one the graph holds.
+func (g *membershipGraph) isMember(object, subject string) (member, ok bool) {
+	if g.volatileObjects[object] > 0 {
+		return false, false
+	}
+	for nested := range g.descendants[object] {
+		if g.volatileObjects[nested] > 0 {
+			return false, false
+		}
+	}
+
+	if _, _, isSet := parseSubjectSet(subject); isSet {
+		nested := g.nestedObject(subject)
+		if nested == "" {
+			return false, false
+		}
+		return g.descendants[object][nested], true
+	}
+
+	for direct := range g.memberOf[subject] {
+		if direct == object || g.descendants[object][direct] {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// add records a tuple of the relation
+func (g *membershipGraph) add(t datastore.Tuple) {
+	if !t.ExpiresAt.IsZero() || t.Caveat != nil {
+		if !g.volatile[t.Key()] {
+			g.volatile[t.Key()] = true
+			g.volatileObjects[t.Resource]++
+		}
+		return
+	}
+
+	nested := g.nestedObject(t.Subject)
+	if nested == "" {
+		addEdge(g.memberOf, t.Subject, t.Resource)
+		return
+	}
+	addEdge(g.children, t.Resource, nested)
+	addEdge(g.parents, nested, t.Resource)
+
+	// Everything nested in the new child is now nested in the parent and its ancestors
+	reached := map[string]bool{nested: true}
+	for d := range g.descendants[nested] {
+		reached[d] = true
+	}
+	for _, ancestor := range g.ancestors(t.Resource) {
+		for d := range reached {
+			addEdge(g.descendants, ancestor, d)
+		}
+	}
+}
+
+// remove forgets a tuple of the relation, if it is recorded
+func (g *membershipGraph) remove(t datastore.Tuple) {
+	if g.volatile[t.Key()] {
+		delete(g.volatile, t.Key())
+		if g.volatileObjects[t.Resource]--; g.volatileObjects[t.Resource] == 0 {
+			delete(g.volatileObjects, t.Resource)
+		}
+		return
+	}
+
+	nested := g.nestedObject(t.Subject)
+	if nested == "" {
+		removeEdge(g.memberOf, t.Subject, t.Resource)
+		return
+	}
+	if !g.children[t.Resource][nested] {
+		return
+	}
+	removeEdge(g.children, t.Resource, nested)
+	removeEdge(g.parents, nested, t.Resource)
+
+	// Recompute what remains nested in the parent and its ancestors
+	for _, ancestor := range g.ancestors(t.Resource) {
+		delete(g.descendants, ancestor)
+		for d := range g.reachable(ancestor) {
+			addEdge(g.descendants, ancestor, d)
+		}
+	}
+}
+
+// ancestors returns the object and every object it is nested in
+func (g *membershipGraph) ancestors(object string) []string {
+	seen := map[string]bool{object: true}
+	queue := []string{object}
+	for i := 0; i < len(queue); i++ {
+		for parent := range g.parents[queue[i]] {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return queue
+}
+
+// reachable returns the objects reachable from the object through one or more subject sets
+func (g *membershipGraph) reachable(object string) map[string]bool {
+	reached := make(map[string]bool)
+	queue := []string{object}
+	for i := 0; i < len(queue); i++ {
+		for child := range g.children[queue[i]] {
+			if !reached[child] {
+				reached[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return reached
+}
+
+// addEdge adds to to the set of from
+func addEdge(edges map[string]map[string]bool, from, to string) {
+	if edges[from] == nil {
+		edges[from] = make(map[string]bool)
+	}
+	edges[from][to] = true
+}
+
+// removeEdge removes to from the set of from
+func removeEdge(edges map[string]map[string]bool, from, to string) {
+	delete(edges[from], to)
+	if len(edges[from]) == 0 {
+		delete(edges, from)
+	}
+}
+
+// LeopardVerification reports the outcome of comparing the index with one rebuilt from scratch
+type LeopardVerification struct {
+	Revision datastore.Revision `json:"revision"`
+	// Membership relations held by the index, as type#relation
+	Relations  []string `json:"relations"`
+	Consistent bool     `json:"consistent"`
+	// Differences found, as relation: description
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// VerifyLeopardIndex brings the index to the head revision, rebuilds every graph it
+// holds from a snapshot at that revision, along with the expired tuples that have not
+// been swept yet, and reports any difference between the two.
+func (s *Store) VerifyLeopardIndex() (*LeopardVerification, error) {
+	if s.leopard == nil {
+		return nil, fmt.Errorf("leopard index is disabled")
+	}
+	reader, err := s.headReader()
+	if err != nil {
+		return nil, err
+	}
+
+	x := s.leopard
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.sync(reader.Revision()); err != nil {
+		return nil, err
+	}
+	if x.revision != reader.Revision() {
+		return nil, fmt.Errorf("leopard index is at revision %d, newer than %d", x.revision, reader.Revision())
+	}
+
+	// Snapshots leave out tuples that have expired, which the index keeps as
+	// volatile until the expiry sweeper deletes them
+	expired, err := x.datastore.ExpiredTuples(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LeopardVerification{Revision: x.revision, Relations: []string{}, Consistent: true}
+	for key, live := range x.graphs {
+		result.Relations = append(result.Relations, key)
+		rebuilt, err := buildMembershipGraph(reader, live.resourceType, live.relation)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range expired {
+			if t.CreatedAt <= x.revision && t.ResourceType() == live.resourceType && t.Relation == live.relation {
+				rebuilt.add(t)
+			}
+		}
+		for _, m := range live.diff(rebuilt) {
+			result.Mismatches = append(result.Mismatches, key+": "+m)
+		}
+	}
+	sort.Strings(result.Relations)
+	sort.Strings(result.Mismatches)
+	result.Consistent = len(result.Mismatches) == 0
+	return result, nil
+}
+
+// diff describes the differences between two graphs of the same relation
+func (g *membershipGraph) diff(other *membershipGraph) []string {
+	var mismatches []string
+	compareSets := func(name string, a, b map[string]bool) {
+		for _, key := range keysOfBoth(a, b) {
+			if a[key] != b[key] {
+				mismatches = append(mismatches, fmt.Sprintf("%s %s: index has %v, rebuilt has %v", name, key, a[key], b[key]))
+			}
+		}
+	}
+	compare := func(name string, a, b map[string]map[string]bool) {
+		from := make(map[string]bool, len(a)+len(b))
+		for key := range a {
+			from[key] = true
+		}
+		for key := range b {
+			from[key] = true
+		}
+		for key := range from {
+			compareSets(name+" "+key+" ->", a[key], b[key])
+		}
+	}
+	compare("member_of", g.memberOf, other.memberOf)
+	compare("children", g.children, other.children)
+	compare("descendants", g.descendants, other.descendants)
+	compareSets("volatile", g.volatile, other.volatile)
+	return mismatches
+}
+
+// keysOfBoth returns the keys of either set in order
+func keysOfBoth(a, b map[string]bool) []string {
+	keys := make(map[string]bool, len(a)+len(b))
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	return sortedKeys(keys)
+}
@@ -0,0 +1,283 @@
+package policy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// ErrInvalidCursor is returned for pagination cursors that cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// lookupCursor is the decoded form of a pagination cursor. It pins the snapshot of
+// the first page, so that every page of a lookup is read at the same revision.
+type lookupCursor struct {
+	Zookie string `json:"z"`
+	After  string `json:"a"`
+}
+
+// encodeLookupCursor returns the cursor resuming after the given result
+func encodeLookupCursor(zookie, after string) string {
+	data, _ := json.Marshal(lookupCursor{Zookie: zookie, After: after})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeLookupCursor parses a cursor returned by an earlier page
+func decodeLookupCursor(token string) (*lookupCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var cursor lookupCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Zookie == "" {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidCursor)
+	}
+	return &cursor, nil
+}
+
+// lookupRevision resolves the revision of a lookup page and the result to resume after.
+// A cursor overrides the consistency and reads at the revision of the first page.
+func (s *Store) lookupRevision(consistency Consistency, cursor string) (datastore.Revision, string, error) {
+	if cursor == "" {
+		revision, err := s.ResolveRevision(consistency)
+		return revision, "", err
+	}
+
+	c, err := decodeLookupCursor(cursor)
+	if err != nil {
+		return 0, "", err
+	}
+	revision, err := s.ResolveRevision(Consistency{Mode: AtExactSnapshot, Zookie: c.Zookie})
+	return revision, c.After, err
+}
+
+// LookupResourcesRequest asks for the resources of a type on which a subject has a permission
+type LookupResourcesRequest struct {
+	Subject      string
+	ResourceType string
+	Permission   string
+	Consistency  Consistency
+	// Maximum number of resources to return; non-positive returns every resource
+	Limit int
+	// Cursor returned by the previous page
+	Cursor string
+}
+
+// LookupResourcesResult is a page of resources, ordered by ID
+type LookupResourcesResult struct {
+	Resources []string `json:"resources"`
+	// Cursor for the next page, empty when there are no more resources
+	Cursor      string `json:"cursor,omitempty"`
+	ZookieToken string `json:"zookie_token"`
+}
+
+// LookupResources returns the resources of a type on which the subject has a
+// permission. The userset rewrites are walked in reverse from the subject, through
+// subject sets, computed usersets and tuple_to_userset relations, to find candidate
+// resources; each candidate is then checked, so that intersections and exclusions
+// are honoured.
+func (s *Store) LookupResources(ctx context.Context, req LookupResourcesRequest) (*LookupResourcesResult, error) {
+	def, err := s.schema.GetDefinition(req.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := def.Permissions[req.Permission]; !exists {
+		return nil, fmt.Errorf("permission %s not defined for resource type %s", req.Permission, req.ResourceType)
+	}
+
+	revision, after, err := s.lookupRevision(req.Consistency, req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := s.reachableResources(ctx, reader, req.Subject, req.ResourceType, req.Permission)
+	if err != nil {
+		return nil, err
+	}
+
+	zookie := s.zookieForRevision(revision)
+	result := &LookupResourcesResult{Resources: []string{}, ZookieToken: zookie}
+	ec := s.newEvalContext(ctx, reader, nil)
+	for _, resource := range candidates {
+		if resource <= after {
+			continue
+		}
+		checked, _, err := s.check(ec, req.Subject, resource, req.Permission)
+		if err != nil {
+			return nil, err
+		}
+		if !checked.allowed() {
+			continue
+		}
+		if req.Limit > 0 && len(result.Resources) == req.Limit {
+			result.Cursor = encodeLookupCursor(zookie, result.Resources[len(result.Resources)-1])
+			break
+		}
+		result.Resources = append(result.Resources, resource)
+	}
+	return result, nil
+}
+
+// userset is a subject or a subject set reached while walking rewrites in reverse
+type userset struct {
+	object   string
+	relation string
+}
+
+// subject formats the userset as a tuple subject
+func (u userset) subject() string {
+	if u.relation == "" {
+		return u.object
+	}
+	return u.object + "#" + u.relation
+}
+
+// arrow is a tuple_to_userset rule: relation on resourceType is computed from the
+// relations of the subjects of tupleset
+type arrow struct {
+	resourceType string
+	tupleset     string
+	relation     string
+}
+
+// reverseRewrites indexes the rewrite rules of a schema by the relation they read from
+type reverseRewrites struct {
+	// Relations and permissions of a type computed from another relation of the same object
+	computed map[string]map[string][]string
+	// tuple_to_userset rules by the relation computed on the tupleset's subjects
+	arrows map[string][]arrow
+}
+
+// newReverseRewrites indexes every rewrite rule and permission expression of the schema
+func newReverseRewrites(s *schema.Schema) *reverseRewrites {
+	r := &reverseRewrites{
+		computed: make(map[string]map[string][]string),
+		arrows:   make(map[string][]arrow),
+	}
+	for _, def := range s.ListDefinitions() {
+		for name, rel := range def.Relations {
+			r.addRewrite(def.Type, name, rel.UsersetRewrite)
+		}
+		for name, perm := range def.Permissions {
+			for _, relation := range permissionRelations(perm) {
+				r.addComputed(def.Type, relation, name)
+			}
+		}
+	}
+	return r
+}
+
+// addComputed records that relation on resourceType includes from on the same object
+func (r *reverseRewrites) addComputed(resourceType, from, relation string) {
+	if r.computed[resourceType] == nil {
+		r.computed[resourceType] = make(map[string][]string)
+	}
+	r.computed[resourceType][from] = append(r.computed[resourceType][from], relation)
+}
+
+// addRewrite records the computed usersets and tuple_to_userset rules of a rewrite.
+// Every branch is recorded, including the subtracted side of an exclusion: the walk
+// only finds candidates, which are checked afterwards.
+func (r *reverseRewrites) addRewrite(resourceType, relation string, rewrite *schema.UsersetRewrite) {
+	if rewrite == nil {
+		return
+	}
+	switch rewrite.Type {
+	case schema.UsersetRewriteComputedUserset:
+		if rewrite.ComputedUserset != nil {
+			r.addComputed(resourceType, rewrite.ComputedUserset.Relation, relation)
+		}
+	case schema.UsersetRewriteTupleToUserset:
+		if rewrite.TupleToUserset != nil {
+			computed := rewrite.TupleToUserset.ComputedUserset.Relation
+			r.arrows[computed] = append(r.arrows[computed], arrow{
+				resourceType: resourceType,
+				tupleset:     rewrite.TupleToUserset.Tupleset.Relation,
+				relation:     relation,
+			})
+		}
+	}
+	for _, child := range rewrite.Children {
+		r.addRewrite(resourceType, relation, child)
+	}
+}
+
+// reachableResources walks the rewrites in reverse from the subject and returns, in
+// order, every resource of the type whose permission may include the subject
+func (s *Store) reachableResources(ctx context.Context, reader datastore.Reader, subject, resourceType, permission string) ([]string, error) {
+	rewrites := newReverseRewrites(s.schema)
+
+	visited := make(map[userset]bool)
+	var queue []userset
+	candidates := make(map[string]bool)
+	reach := func(u userset) {
+		if visited[u] {
+			return
+		}
+		visited[u] = true
+		queue = append(queue, u)
+		if u.relation == permission && objectType(u.object) == resourceType {
+			candidates[u.object] = true
+		}
+	}
+
+	object, relation, _ := parseSubjectSet(subject)
+	reach(userset{object: object, relation: relation})
+	if wildcard := wildcardFor(subject); wildcard != "" {
+		reach(userset{object: wildcard})
+	}
+
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		u := queue[0]
+		queue = queue[1:]
+
+		// Relations granted to the userset directly
+		tuples, err := reader.QueryTuples(datastore.Filter{Subject: u.subject()})
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tuples {
+			reach(userset{object: t.Resource, relation: t.Relation})
+		}
+
+		if u.relation == "" {
+			continue
+		}
+
+		// Relations and permissions of the same object computed from this relation
+		for _, computed := range rewrites.computed[objectType(u.object)][u.relation] {
+			reach(userset{object: u.object, relation: computed})
+		}
+
+		// Relations of the objects pointing at this one through a tupleset
+		for _, a := range rewrites.arrows[u.relation] {
+			tuples, err := reader.QueryTuples(datastore.Filter{ResourceType: a.resourceType, Relation: a.tupleset, Subject: u.object})
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range tuples {
+				reach(userset{object: t.Resource, relation: a.relation})
+			}
+		}
+	}
+
+	resources := make([]string, 0, len(candidates))
+	for resource := range candidates {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	return resources, nil
+}
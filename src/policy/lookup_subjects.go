@@ -0,0 +1,401 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// LookupSubjectsRequest asks for the subjects of a type that have a permission on a resource
+type LookupSubjectsRequest struct {
+	Resource string
+	// Permission or relation of the resource
+	Permission  string
+	SubjectType string
+	Consistency Consistency
+	// Maximum number of subjects to return; non-positive returns every subject
+	Limit int
+	// Cursor returned by the previous page
+	Cursor string
+}
+
+// LookupSubjectsResult is a page of subjects, ordered by ID. A type:* wildcard sorts
+// before every concrete subject and stands for every subject of the type other
+// than the excluded ones.
+type LookupSubjectsResult struct {
+	Subjects []string `json:"subjects"`
+	// Subjects of the type that the wildcard does not include
+	ExcludedSubjects []string `json:"excluded_subjects,omitempty"`
+	// Cursor for the next page, empty when there are no more subjects
+	Cursor      string `json:"cursor,omitempty"`
+	ZookieToken string `json:"zookie_token"`
+}
+
+// LookupSubjects returns the subjects of a type that have a permission or relation on
+// a resource. Unlike Expand, it evaluates the full userset rewrites and permission
+// expression, including intersections and exclusions.
+func (s *Store) LookupSubjects(ctx context.Context, req LookupSubjectsRequest) (*LookupSubjectsResult, error) {
+	if req.SubjectType == "" {
+		return nil, fmt.Errorf("subject type is required")
+	}
+
+	revision, after, err := s.lookupRevision(req.Consistency, req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &subjectLookup{
+		store:       s,
+		subjectType: req.SubjectType,
+		wildcard:    req.SubjectType + ":" + WildcardID,
+		memo:        make(map[evalFrame]*subjectSet),
+	}
+	found, err := l.lookupPermission(NewEvalContext(ctx, reader, s.maxDepth), req.Resource, req.Permission)
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := found.sorted()
+	if found.wildcard {
+		subjects = append([]string{l.wildcard}, subjects...)
+	}
+
+	zookie := s.zookieForRevision(revision)
+	result := &LookupSubjectsResult{Subjects: []string{}, ZookieToken: zookie}
+	if found.wildcard {
+		result.ExcludedSubjects = sortedKeys(found.excluded)
+	}
+	for _, subject := range subjects {
+		if subject <= after {
+			continue
+		}
+		if req.Limit > 0 && len(result.Subjects) == req.Limit {
+			result.Cursor = encodeLookupCursor(zookie, result.Subjects[len(result.Subjects)-1])
+			break
+		}
+		result.Subjects = append(result.Subjects, subject)
+	}
+	return result, nil
+}
+
+// subjectSet is a set of subjects of one type. With wildcard set it holds every
+// subject of the type except the excluded ones; subjects never overlaps excluded.
+type subjectSet struct {
+	subjects map[string]bool
+	wildcard bool
+	excluded map[string]bool
+	// Path index of the shallowest frame in progress that a cycle through subject
+	// sets was cut at, plus one; zero if none. Such a set is provisional until that
+	// frame completes.
+	cutAt int
+}
+
+// newSubjectSet creates an empty set
+func newSubjectSet() *subjectSet {
+	return &subjectSet{subjects: make(map[string]bool), excluded: make(map[string]bool)}
+}
+
+// dependingOn returns the set, final only once both sets it was computed from are
+func (s *subjectSet) dependingOn(a, b *subjectSet) *subjectSet {
+	for _, cutAt := range []int{a.cutAt, b.cutAt} {
+		if cutAt != 0 && (s.cutAt == 0 || cutAt < s.cutAt) {
+			s.cutAt = cutAt
+		}
+	}
+	return s
+}
+
+// contains reports whether the subject is in the set
+func (s *subjectSet) contains(subject string) bool {
+	return s.subjects[subject] || (s.wildcard && !s.excluded[subject])
+}
+
+// union returns the subjects in either set
+func (s *subjectSet) union(other *subjectSet) *subjectSet {
+	result := newSubjectSet()
+	result.wildcard = s.wildcard || other.wildcard
+	for _, set := range []*subjectSet{s, other} {
+		for subject := range set.subjects {
+			result.subjects[subject] = true
+		}
+		for subject := range set.excluded {
+			if result.wildcard && !s.contains(subject) && !other.contains(subject) {
+				result.excluded[subject] = true
+			}
+		}
+	}
+	return result.dependingOn(s, other)
+}
+
+// intersect returns the subjects in both sets
+func (s *subjectSet) intersect(other *subjectSet) *subjectSet {
+	result := newSubjectSet()
+	result.wildcard = s.wildcard && other.wildcard
+	for _, set := range []*subjectSet{s, other} {
+		for subject := range set.subjects {
+			if s.contains(subject) && other.contains(subject) {
+				result.subjects[subject] = true
+			}
+		}
+		if result.wildcard {
+			for subject := range set.excluded {
+				result.excluded[subject] = true
+			}
+		}
+	}
+	return result.dependingOn(s, other)
+}
+
+// subtract returns the subjects in s that are not in other
+func (s *subjectSet) subtract(other *subjectSet) *subjectSet {
+	result := newSubjectSet()
+	result.wildcard = s.wildcard && !other.wildcard
+	for subject := range s.subjects {
+		if !other.contains(subject) {
+			result.subjects[subject] = true
+		}
+	}
+	if s.wildcard && other.wildcard {
+		// Only the subjects excluded from other's wildcard remain
+		for subject := range other.excluded {
+			if s.contains(subject) {
+				result.subjects[subject] = true
+			}
+		}
+	}
+	if result.wildcard {
+		for subject := range s.excluded {
+			result.excluded[subject] = true
+		}
+		for subject := range other.subjects {
+			result.excluded[subject] = true
+		}
+	}
+	return result.dependingOn(s, other)
+}
+
+// sorted returns the concrete subjects in order
+func (s *subjectSet) sorted() []string {
+	return sortedKeys(s.subjects)
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// subjectLookup computes the subjects of one type that have relations on objects.
+// Results are memoized for the duration of the lookup.
+type subjectLookup struct {
+	store       *Store
+	subjectType string
+	wildcard    string
+	memo        map[evalFrame]*subjectSet
+}
+
+// lookupPermission computes the subjects of a permission, or of a relation
+func (l *subjectLookup) lookupPermission(ec *EvalContext, object, permission string) (*subjectSet, error) {
+	def, err := l.store.schema.GetDefinition(objectType(object))
+	if err != nil {
+		return nil, err
+	}
+
+	perm, exists := def.Permissions[permission]
+	if !exists {
+		return l.lookupRelation(ec, object, permission)
+	}
+
+	result := newSubjectSet()
+	for _, relation := range permissionRelations(perm) {
+		subjects, err := l.lookupRelation(ec, object, relation)
+		if err != nil {
+			return nil, err
+		}
+		result = result.union(subjects)
+	}
+	return result, nil
+}
+
+// lookupRelation computes the subjects of a relation on an object
+func (l *subjectLookup) lookupRelation(ec *EvalContext, object, relation string) (*subjectSet, error) {
+	if err := ec.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	frame := evalFrame{object: object, relation: relation, subject: l.wildcard}
+	if subjects, ok := l.memo[frame]; ok {
+		return subjects, nil
+	}
+
+	ec, err := ec.enter(object, relation, l.wildcard)
+	var cut *cycleCut
+	if errors.As(err, &cut) {
+		// Members of groups that contain each other are found from the outermost one
+		subjects := newSubjectSet()
+		subjects.cutAt = cut.depth + 1
+		return subjects, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	def, err := l.store.schema.GetDefinition(objectType(object))
+	if err != nil {
+		return nil, err
+	}
+	rel, exists := def.Relations[relation]
+	if !exists {
+		return nil, fmt.Errorf("relation %s not defined for resource type %s", relation, def.Type)
+	}
+
+	var subjects *subjectSet
+	if rel.UsersetRewrite == nil {
+		subjects, err = l.lookupDirect(ec, object, relation)
+	} else {
+		subjects, err = l.lookupRewrite(ec, object, relation, rel.UsersetRewrite)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A cycle cut at this frame is resolved once the frame completes; sets
+	// depending on a cut further up the path are not memoized
+	if subjects.cutAt >= len(ec.path) {
+		subjects.cutAt = 0
+	}
+	if subjects.cutAt != 0 {
+		return subjects, nil
+	}
+	l.memo[frame] = subjects
+	return subjects, nil
+}
+
+// lookupDirect computes the subjects of the stored tuples of a relation, following subject
+// sets. Caveated tuples are only included if their caveat holds on the values bound by
+// the relationship alone.
+func (l *subjectLookup) lookupDirect(ec *EvalContext, object, relation string) (*subjectSet, error) {
+	tuples, err := ec.reader.QueryTuples(datastore.Filter{Resource: object, Relation: relation})
+	if err != nil {
+		return nil, err
+	}
+
+	result := newSubjectSet()
+	for _, t := range tuples {
+		caveat, err := l.store.caveatResult(nil, t)
+		if err != nil {
+			return nil, err
+		}
+		if !caveat.allowed() {
+			continue
+		}
+		setObject, setRelation, isSet := parseSubjectSet(t.Subject)
+		switch {
+		case isSet:
+			subjects, err := l.lookupRelation(ec.followSubjectSet(), setObject, setRelation)
+			if err != nil {
+				return nil, err
+			}
+			result = result.union(subjects)
+		case t.Subject == l.wildcard:
+			// The wildcard also includes the subjects other subject sets excluded
+			result.wildcard = true
+			result.excluded = make(map[string]bool)
+		case objectType(t.Subject) == l.subjectType:
+			result.subjects[t.Subject] = true
+		}
+	}
+	for subject := range result.subjects {
+		delete(result.excluded, subject)
+	}
+	return result, nil
+}
+
+// lookupRewrite computes the subjects of a userset rewrite rule
+func (l *subjectLookup) lookupRewrite(ec *EvalContext, object, relation string, rewrite *schema.UsersetRewrite) (*subjectSet, error) {
+	switch rewrite.Type {
+	case schema.UsersetRewriteThis:
+		return l.lookupDirect(ec, object, relation)
+
+	case schema.UsersetRewriteComputedUserset:
+		if rewrite.ComputedUserset == nil {
+			return nil, fmt.Errorf("computed_userset is nil")
+		}
+		return l.lookupRelation(ec, object, rewrite.ComputedUserset.Relation)
+
+	case schema.UsersetRewriteTupleToUserset:
+		if rewrite.TupleToUserset == nil {
+			return nil, fmt.Errorf("tuple_to_userset is nil")
+		}
+		tuples, err := ec.reader.QueryTuples(datastore.Filter{Resource: object, Relation: rewrite.TupleToUserset.Tupleset.Relation})
+		if err != nil {
+			return nil, err
+		}
+		result := newSubjectSet()
+		for _, t := range tuples {
+			caveat, err := l.store.caveatResult(nil, t)
+			if err != nil {
+				return nil, err
+			}
+			if !caveat.allowed() {
+				continue
+			}
+			subjects, err := l.lookupRelation(ec, t.Subject, rewrite.TupleToUserset.ComputedUserset.Relation)
+			if err != nil {
+				return nil, err
+			}
+			result = result.union(subjects)
+		}
+		return result, nil
+
+	case schema.UsersetRewriteUnion, schema.UsersetRewriteIntersection:
+		if len(rewrite.Children) == 0 {
+			return nil, fmt.Errorf("%s has no children", rewrite.Type)
+		}
+		result, err := l.lookupRewrite(ec, object, relation, rewrite.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range rewrite.Children[1:] {
+			subjects, err := l.lookupRewrite(ec, object, relation, child)
+			if err != nil {
+				return nil, err
+			}
+			if rewrite.Type == schema.UsersetRewriteUnion {
+				result = result.union(subjects)
+			} else {
+				result = result.intersect(subjects)
+			}
+		}
+		return result, nil
+
+	case schema.UsersetRewriteExclusion:
+		if len(rewrite.Children) != 2 {
+			return nil, fmt.Errorf("exclusion must have exactly 2 children")
+		}
+		base, err := l.lookupRewrite(ec, object, relation, rewrite.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		subtract, err := l.lookupRewrite(ec, object, relation, rewrite.Children[1])
+		if err != nil {
+			return nil, err
+		}
+		return base.subtract(subtract), nil
+
+	default:
+		return nil, fmt.Errorf("unknown userset rewrite type: %s", rewrite.Type)
+	}
+}
@@ -0,0 +1,144 @@
+package policy
+
+import "time"
+
+// Permissionship is the three-valued outcome of a check
+type Permissionship int
+
+const (
+	// NoPermission means the subject does not have the permission
+	NoPermission Permissionship = iota
+	// HasPermission means the subject has the permission
+	HasPermission
+	// ConditionalPermission means the outcome depends on caveat parameters that
+	// were not supplied in the context of the check
+	ConditionalPermission
+)
+
+// String returns the name of the permissionship
+func (p Permissionship) String() string {
+	switch p {
+	case HasPermission:
+		return "HAS_PERMISSION"
+	case ConditionalPermission:
+		return "CONDITIONAL_PERMISSION"
+	default:
+		return "NO_PERMISSION"
+	}
+}
+
+// checkResult is the outcome of an evaluation. A conditional result lists the
+// caveat parameters it depends on, in order.
+type checkResult struct {
+	permissionship Permissionship
+	missing        []string
+	// Time from which the result may change without a write, because a tuple it
+	// read expires or a caveat it evaluated depends on the time; zero if never
+	validUntil time.Time
+	// Path index of the shallowest frame in progress that a cycle through subject
+	// sets was cut at, plus one; zero if none. Such a result is provisional until
+	// that frame completes.
+	cutAt int
+}
+
+var (
+	noPermission  = checkResult{permissionship: NoPermission}
+	hasPermission = checkResult{permissionship: HasPermission}
+)
+
+// conditional returns a conditional result depending on the given parameters
+func conditional(missing []string) checkResult {
+	return checkResult{permissionship: ConditionalPermission, missing: mergeMissing(nil, missing)}
+}
+
+// resultOf converts a definite outcome to a result
+func resultOf(allowed bool) checkResult {
+	if allowed {
+		return hasPermission
+	}
+	return noPermission
+}
+
+// until returns the result, valid until t at the latest. A zero t leaves it unchanged.
+func (r checkResult) until(t time.Time) checkResult {
+	if !t.IsZero() && (r.validUntil.IsZero() || t.Before(r.validUntil)) {
+		r.validUntil = t
+	}
+	return r
+}
+
+// dependingOn returns the result, valid and final only as long as both results it
+// was combined from are
+func (r checkResult) dependingOn(a, b checkResult) checkResult {
+	r = r.until(a.validUntil).until(b.validUntil)
+	for _, cutAt := range []int{a.cutAt, b.cutAt} {
+		if cutAt != 0 && (r.cutAt == 0 || cutAt < r.cutAt) {
+			r.cutAt = cutAt
+		}
+	}
+	return r
+}
+
+// allowed reports whether the result grants the permission unconditionally
+func (r checkResult) allowed() bool {
+	return r.permissionship == HasPermission
+}
+
+// union combines the results of branches of which any must grant the permission
+func (r checkResult) union(other checkResult) checkResult {
+	var result checkResult
+	switch {
+	case r.permissionship == HasPermission || other.permissionship == HasPermission:
+		result = hasPermission
+	case r.permissionship == NoPermission:
+		result = other
+	case other.permissionship == NoPermission:
+		result = r
+	default:
+		result = conditional(mergeMissing(r.missing, other.missing))
+	}
+	return result.dependingOn(r, other)
+}
+
+// intersect combines the results of branches that must all grant the permission
+func (r checkResult) intersect(other checkResult) checkResult {
+	var result checkResult
+	switch {
+	case r.permissionship == NoPermission || other.permissionship == NoPermission:
+		result = noPermission
+	case r.permissionship == HasPermission:
+		result = other
+	case other.permissionship == HasPermission:
+		result = r
+	default:
+		result = conditional(mergeMissing(r.missing, other.missing))
+	}
+	return result.dependingOn(r, other)
+}
+
+// exclude returns the result of r with the permission of other subtracted
+func (r checkResult) exclude(other checkResult) checkResult {
+	var result checkResult
+	switch {
+	case r.permissionship == NoPermission || other.permissionship == HasPermission:
+		result = noPermission
+	case other.permissionship == NoPermission:
+		result = r
+	default:
+		// Granted unless the subtracted caveats hold
+		result = conditional(mergeMissing(r.missing, other.missing))
+	}
+	return result.dependingOn(r, other)
+}
+
+// mergeMissing returns the sorted union of two lists of names
+func mergeMissing(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, name := range a {
+		seen[name] = true
+	}
+	for _, name := range b {
+		seen[name] = true
+	}
+	return sortedKeys(seen)
+}
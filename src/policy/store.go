@@ -1,11 +1,14 @@
 package policy
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/kanywst/zanzibar/src/datastore"
 	"github.com/kanywst/zanzibar/src/schema"
 )
 
@@ -14,6 +17,10 @@ type Relationship struct {
 	Resource string `json:"resource"`
 	Relation string `json:"relation"`
 	Subject  string `json:"subject"`
+	// Time from which the relationship is treated as absent, or zero if it never expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Caveat the relationship is conditioned on, or nil if it always applies
+	Caveat *datastore.ContextualizedCaveat `json:"caveat,omitempty"`
 	// Metadata for consistency
 	ZookieToken string    `json:"zookie_token,omitempty"`
 	UpdatedAt   time.Time `json:"updated_at"`
@@ -21,335 +28,661 @@ type Relationship struct {
 
 // Store represents the policy store
 type Store struct {
-	relationships []Relationship
-	schema        *schema.Schema
-	evaluator     *Evaluator
-	mu            sync.RWMutex
-	// For consistency tracking
-	changeNumber int64
+	datastore datastore.Datastore
+	schema    *schema.Schema
+	evaluator *Evaluator
+	// Index of nested memberships, or nil when disabled
+	leopard *LeopardIndex
+	// Results of relation evaluations shared by checks, or nil when disabled
+	cache *checkCache
+	// Window within which minimize_latency reads share a revision
+	quantization time.Duration
+	quantized    quantizedHead
+	zookies      *ZookieCodec
+	// Limit on nested relation evaluations in a single check
+	maxDepth int
+	// Period for which history is kept readable
+	retention time.Duration
+	gc        gcState
+	// Serializes writes so that existence checks and updates are atomic
+	mu sync.Mutex
 }
 
-// NewStore creates a new policy store
+// StoreOptions configures a policy store
+type StoreOptions struct {
+	// Datastore holds the relation tuples. Nil uses a new in-memory datastore.
+	Datastore datastore.Datastore
+	// ZookieKey signs the zookies issued by the store. Nil uses a random key,
+	// so zookies are not accepted after a restart.
+	ZookieKey []byte
+	// MaxDepth limits nested relation evaluations in a single check.
+	// Zero uses DefaultMaxDepth.
+	MaxDepth int
+	// MaxConcurrency bounds the branches evaluated concurrently across all
+	// checks. Zero uses DefaultMaxConcurrency.
+	MaxConcurrency int
+	// RetentionWindow is the period for which history is kept readable by
+	// garbage collection. Zero uses DefaultRetentionWindow.
+	RetentionWindow time.Duration
+	// DisableLeopardIndex evaluates nested memberships by recursion instead
+	// of answering them from the Leopard index
+	DisableLeopardIndex bool
+	// CheckCacheSize bounds the relation evaluations kept by the check cache.
+	// Zero uses DefaultCheckCacheSize.
+	CheckCacheSize int
+	// DisableCheckCache evaluates every check without the check cache
+	DisableCheckCache bool
+	// QuantizationWindow is the period within which minimize_latency reads, and
+	// at_least_as_fresh reads whose zookie allows it, are evaluated at the same
+	// revision, so that they share cached results. Reads may then miss writes made
+	// within the window, and the Leopard index answers them only while the
+	// membership relations are unchanged since the shared revision. Zero reads at
+	// the head revision; the window is capped at the retention window.
+	QuantizationWindow time.Duration
+}
+
+// NewStore creates a new policy store backed by an in-memory datastore
 func NewStore(schema *schema.Schema) *Store {
+	return NewStoreWithOptions(schema, StoreOptions{})
+}
+
+// NewStoreWithDatastore creates a new policy store backed by the given datastore
+func NewStoreWithDatastore(schema *schema.Schema, ds datastore.Datastore) *Store {
+	return NewStoreWithOptions(schema, StoreOptions{Datastore: ds})
+}
+
+// NewStoreWithOptions creates a new policy store with the given options
+func NewStoreWithOptions(schema *schema.Schema, options StoreOptions) *Store {
 	store := &Store{
-		relationships: make([]Relationship, 0),
-		schema:        schema,
-		changeNumber:  1,
+		datastore:    options.Datastore,
+		schema:       schema,
+		maxDepth:     options.MaxDepth,
+		retention:    options.RetentionWindow,
+		quantization: options.QuantizationWindow,
+	}
+	if store.datastore == nil {
+		store.datastore = datastore.NewMemoryDatastore()
+	}
+	if store.retention <= 0 {
+		store.retention = DefaultRetentionWindow
+	}
+	if store.quantization > store.retention {
+		store.quantization = store.retention
+	}
+	if options.ZookieKey != nil {
+		store.zookies = NewZookieCodec(options.ZookieKey)
+	} else {
+		store.zookies = NewRandomZookieCodec()
+	}
+	if !options.DisableLeopardIndex {
+		store.leopard = newLeopardIndex(store.datastore)
+	}
+	if !options.DisableCheckCache {
+		store.cache = newCheckCache(options.CheckCacheSize)
 	}
-	store.evaluator = NewEvaluator(store)
+	store.evaluator = NewEvaluator(store, options.MaxConcurrency)
 	return store
 }
 
 // AddRelationship adds a new relationship
 func (s *Store) AddRelationship(resource, relation, subject string) (string, error) {
+	return s.AddExpiringRelationship(resource, relation, subject, time.Time{})
+}
+
+// AddExpiringRelationship adds a relationship that is treated as absent from expiresAt
+// on. A zero expiresAt never expires. Adding an existing relationship with a different
+// expiry replaces its expiry.
+func (s *Store) AddExpiringRelationship(resource, relation, subject string, expiresAt time.Time) (string, error) {
+	return s.TouchRelationship(Relationship{Resource: resource, Relation: relation, Subject: subject, ExpiresAt: expiresAt})
+}
+
+// TouchRelationship adds a relationship with its expiry and caveat. A relationship
+// that already exists with a different expiry or caveat is replaced.
+func (s *Store) TouchRelationship(r Relationship) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateRelationship(r.Resource, r.Relation, r.Subject, r.Caveat); err != nil {
+		return "", err
+	}
+	if err := validateExpiry(r.ExpiresAt); err != nil {
+		return "", err
+	}
+	t := datastore.Tuple{Resource: r.Resource, Relation: r.Relation, Subject: r.Subject, ExpiresAt: r.ExpiresAt, Caveat: r.Caveat}
+
+	// Check if relationship already exists
+	existing, err := s.findTuple(r.Resource, r.Relation, r.Subject)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil && existing.SameMetadata(t) {
+		return s.zookies.Encode(existing.CreatedAt, existing.UpdatedAt), nil
+	}
+
+	// Add relationship
+	revision, err := s.datastore.Write([]datastore.Update{{
+		Operation: datastore.UpdateTouch,
+		Tuple:     t,
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	// Create zookie token for consistency
+	return s.zookieForRevision(revision), nil
+}
+
+// RemoveRelationship removes a relationship and returns the zookie of the deletion
+func (s *Store) RemoveRelationship(resource, relation, subject string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	existing, err := s.findTuple(resource, relation, subject)
+	if err != nil {
+		return "", err
+	}
+	if existing == nil {
+		return "", fmt.Errorf("relationship not found")
+	}
+
+	revision, err := s.datastore.Write([]datastore.Update{{
+		Operation: datastore.UpdateDelete,
+		Tuple:     *existing,
+	}})
+	if err != nil {
+		return "", err
+	}
+	return s.zookieForRevision(revision), nil
+}
+
+// validateRelationship checks the format of a relationship and validates it, with
+// its caveat, against the schema
+func (s *Store) validateRelationship(resource, relation, subject string, caveat *datastore.ContextualizedCaveat) error {
 	// Parse resource and subject to get types
 	resourceParts := strings.SplitN(resource, ":", 2)
 	if len(resourceParts) != 2 {
-		return "", fmt.Errorf("invalid resource format: %s", resource)
+		return fmt.Errorf("invalid resource format: %s", resource)
 	}
 	resourceType := resourceParts[0]
 
-	subjectParts := strings.SplitN(subject, ":", 2)
-	if len(subjectParts) != 2 {
-		return "", fmt.Errorf("invalid subject format: %s", subject)
+	if resourceParts[1] == WildcardID {
+		return fmt.Errorf("wildcard not allowed as resource: %s", resource)
 	}
-	subjectType := subjectParts[0]
 
-	// Validate against schema
-	if err := s.schema.ValidateRelationship(resourceType, relation, subjectType); err != nil {
-		return "", err
+	subjectObject, subjectRelation, isSet := parseSubjectSet(subject)
+	subjectParts := strings.SplitN(subjectObject, ":", 2)
+	if len(subjectParts) != 2 || subjectParts[1] == "" || (isSet && subjectRelation == "") {
+		return fmt.Errorf("invalid subject format: %s", subject)
+	}
+	wildcard := subjectParts[1] == WildcardID
+	if wildcard && isSet {
+		return fmt.Errorf("wildcard subject cannot have a relation: %s", subject)
 	}
 
-	// Check if relationship already exists
-	for _, r := range s.relationships {
-		if r.Resource == resource && r.Relation == relation && r.Subject == subject {
-			return r.ZookieToken, nil
+	allowed := schema.Subject{
+		Type:     subjectParts[0],
+		Relation: subjectRelation,
+		Wildcard: wildcard,
+	}
+	if caveat != nil {
+		c, err := s.schema.GetCaveat(caveat.Name)
+		if err != nil {
+			return err
 		}
+		if err := c.ValidateContext(caveat.Context); err != nil {
+			return err
+		}
+		allowed.Caveat = caveat.Name
 	}
 
-	// Create zookie token for consistency
-	zookieToken := fmt.Sprintf("zk_%d", s.changeNumber)
-	s.changeNumber++
+	// Validate against schema
+	return s.schema.ValidateRelationship(resourceType, relation, allowed)
+}
 
-	// Add relationship
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    resource,
-		Relation:    relation,
-		Subject:     subject,
-		ZookieToken: zookieToken,
-		UpdatedAt:   time.Now(),
-	})
+// WildcardID is the object ID of a wildcard subject (type:*), which matches
+// every subject of its type
+const WildcardID = "*"
 
-	return zookieToken, nil
+// wildcardFor returns the wildcard that matches a plain type:id subject, or ""
+// for subject sets and malformed subjects
+func wildcardFor(subject string) string {
+	if strings.Contains(subject, "#") {
+		return ""
+	}
+	subjectType, _, ok := strings.Cut(subject, ":")
+	if !ok {
+		return ""
+	}
+	return subjectType + ":" + WildcardID
 }
 
-// RemoveRelationship removes a relationship
-func (s *Store) RemoveRelationship(resource, relation, subject string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// permissionRelations returns the relations of a permission expression
+// of the form "relation1 | relation2 | relation3"
+func permissionRelations(perm schema.Permission) []string {
+	parts := strings.Split(perm.Expression, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
 
-	for i, r := range s.relationships {
-		if r.Resource == resource && r.Relation == relation && r.Subject == subject {
-			// Remove by swapping with the last element and truncating
-			s.relationships[i] = s.relationships[len(s.relationships)-1]
-			s.relationships = s.relationships[:len(s.relationships)-1]
-			s.changeNumber++
-			return nil
-		}
+// objectType returns the type part of a type:id object reference
+func objectType(object string) string {
+	objectType, _, _ := strings.Cut(object, ":")
+	return objectType
+}
+
+// parseSubjectSet splits a subject of the form type:id#relation into its object
+// and relation. isSet is false for a plain type:id subject.
+func parseSubjectSet(subject string) (object, relation string, isSet bool) {
+	return strings.Cut(subject, "#")
+}
+
+// findTuple returns the stored tuple with the given identity at head, or nil
+func (s *Store) findTuple(resource, relation, subject string) (*datastore.Tuple, error) {
+	reader, err := s.headReader()
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Errorf("relationship not found")
+	tuples, err := reader.QueryTuples(datastore.Filter{Resource: resource, Relation: relation, Subject: subject})
+	if err != nil {
+		return nil, err
+	}
+	if len(tuples) == 0 {
+		return nil, nil
+	}
+	return &tuples[0], nil
+}
+
+// headReader returns a reader for the latest revision of the datastore
+func (s *Store) headReader() (datastore.Reader, error) {
+	revision, err := s.datastore.HeadRevision()
+	if err != nil {
+		return nil, err
+	}
+	return s.datastore.SnapshotReader(revision)
+}
+
+// HeadRevision returns the latest revision of the datastore
+func (s *Store) HeadRevision() (datastore.Revision, error) {
+	return s.datastore.HeadRevision()
 }
 
 // Check checks if a subject has a permission on a resource
 func (s *Store) Check(subject, resource, action string) (bool, string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	reader, err := s.headReader()
+	if err != nil {
+		return false, "", err
+	}
+	result, reason, err := s.check(s.newEvalContext(context.Background(), reader, nil), subject, resource, action)
+	return result.allowed(), reason, err
+}
+
+// CheckAtRevision checks if a subject had a permission on a resource at the given revision
+func (s *Store) CheckAtRevision(subject, resource, action string, revision datastore.Revision) (bool, string, error) {
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return false, "", err
+	}
+	result, reason, err := s.check(s.newEvalContext(context.Background(), reader, nil), subject, resource, action)
+	return result.allowed(), reason, err
+}
+
+// CheckRequest describes a permission check
+type CheckRequest struct {
+	Subject     string
+	Resource    string
+	Action      string
+	Consistency Consistency
+	// Relationships assumed to hold for this check only, on top of the stored ones
+	ContextualRelationships []Relationship
+	// Values of caveat parameters not bound by the relationships
+	Context map[string]any
+	// Record the evaluation tree in CheckResult.Trace, bypassing the check cache
+	Explain bool
+}
+
+// CheckResult is the outcome of a permission check. Allowed is only set when the
+// subject has the permission unconditionally.
+type CheckResult struct {
+	Allowed        bool
+	Permissionship Permissionship
+	// Caveat parameters that must be supplied to decide a conditional check
+	MissingContext []string
+	Reason         string
+	// Revision the check was evaluated at
+	Revision    datastore.Revision
+	ZookieToken string
+	// Work done to answer the check
+	Stats EvalStats
+	// Evaluation tree, set when the check was explained
+	Trace *TraceNode
+}
+
+// CheckPermission checks a permission at the revision selected by the request's
+// consistency. Evaluation stops with ctx's error once ctx is done.
+func (s *Store) CheckPermission(ctx context.Context, req CheckRequest) (*CheckResult, error) {
+	revision, err := s.ResolveRevision(req.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+	reader, err = s.withContextualRelationships(reader, req.ContextualRelationships)
+	if err != nil {
+		return nil, err
+	}
+
+	ec := s.newEvalContext(ctx, reader, req.Context)
+	var trace *TraceNode
+	if req.Explain {
+		// The whole tree is evaluated rather than answered from the cache
+		ec.cache = nil
+		ec, trace = ec.traceRoot(TraceNodePermission, req.Resource, req.Action)
+	}
+	result, reason, err := s.check(ec, req.Subject, req.Resource, req.Action)
+	trace.finish(result, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CheckResult{
+		Allowed:        result.allowed(),
+		Permissionship: result.permissionship,
+		MissingContext: result.missing,
+		Reason:         reason,
+		Revision:       revision,
+		ZookieToken:    s.zookieForRevision(revision),
+		Stats:          ec.Stats(),
+		Trace:          trace,
+	}, nil
+}
 
+// check evaluates a permission within the given evaluation context
+func (s *Store) check(ec *EvalContext, subject, resource, action string) (checkResult, string, error) {
 	// Parse resource to get type
 	resourceParts := strings.SplitN(resource, ":", 2)
 	if len(resourceParts) != 2 {
-		return false, "", fmt.Errorf("invalid resource format: %s", resource)
+		return noPermission, "", fmt.Errorf("invalid resource format: %s", resource)
 	}
 	resourceType := resourceParts[0]
 
 	// Get the definition for the resource type
 	def, err := s.schema.GetDefinition(resourceType)
 	if err != nil {
-		return false, "", err
+		return noPermission, "", err
 	}
 
 	// Get the permission definition
 	perm, exists := def.Permissions[action]
 	if !exists {
-		return false, "", fmt.Errorf("permission %s not defined for resource type %s", action, resourceType)
+		return noPermission, "", fmt.Errorf("permission %s not defined for resource type %s", action, resourceType)
 	}
 
-	// Parse the permission expression
-	// Format: "relation1 | relation2 | relation3"
-	expr := perm.Expression
-	parts := strings.Split(expr, "|")
-
-	// Check each relation in the permission expression
-	for _, part := range parts {
-		relation := strings.TrimSpace(part)
+	parts := permissionRelations(perm)
 
+	// Check the relations in the permission expression concurrently
+	i, result, err := s.evaluator.race(ec, len(parts), HasPermission, func(ec *EvalContext, i int) (checkResult, error) {
 		// Evaluate the relation using the userset rewrite rules
-		allowed, err := s.evaluator.EvaluateUserset(resource, relation, subject)
-		if err != nil {
-			return false, "", err
-		}
+		return s.evaluator.evaluateUsersetResult(ec, resource, parts[i], subject)
+	})
+	if err != nil {
+		return noPermission, "", err
+	}
 
-		if allowed {
-			reason := fmt.Sprintf("Subject has required relation: %s", relation)
-			return true, reason, nil
-		}
+	switch {
+	case i >= 0:
+		return result, fmt.Sprintf("Subject has required relation: %s", parts[i]), nil
+	case result.permissionship == ConditionalPermission:
+		return result, fmt.Sprintf("Permission depends on missing context: %s", strings.Join(result.missing, ", ")), nil
+	default:
+		return result, fmt.Sprintf("Subject lacks required relation(s) for action: %s", action), nil
+	}
+}
+
+// Expand returns all subjects that have a specific relation with a resource. Only
+// stored tuples and subject sets are followed; LookupSubjects also evaluates the
+// userset rewrites and permission expressions. Subjects reached through caveated
+// relationships are included; ExpandWithConsistency reports the caveats they depend on.
+func (s *Store) Expand(resource, relation string) ([]string, error) {
+	reader, err := s.headReader()
+	if err != nil {
+		return nil, err
 	}
+	subjects, _, err := s.expand(reader, resource, relation)
+	return subjects, err
+}
 
-	reason := fmt.Sprintf("Subject lacks required relation(s) for action: %s", action)
-	return false, reason, nil
+// ExpandAtRevision returns all subjects that had a specific relation with a resource at the given revision
+func (s *Store) ExpandAtRevision(resource, relation string, revision datastore.Revision) ([]string, error) {
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+	subjects, _, err := s.expand(reader, resource, relation)
+	return subjects, err
 }
 
-// getRelations returns all relations a subject has with a resource
-func (s *Store) getRelations(subject, resource string) []string {
-	var relations []string
+// ExpandWithConsistency returns the subjects of a relation at the revision selected by
+// the consistency, along with the zookie of that revision. Subjects that are only
+// reached through caveated relationships are conditional: they are mapped to the
+// names of the caveats on those relationships.
+func (s *Store) ExpandWithConsistency(resource, relation string, consistency Consistency) ([]string, map[string][]string, string, error) {
+	revision, err := s.ResolveRevision(consistency)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, nil, "", err
+	}
 
-	// Direct relations
-	for _, r := range s.relationships {
-		if r.Resource == resource && r.Subject == subject {
-			relations = append(relations, r.Relation)
-		}
+	subjects, conditional, err := s.expand(reader, resource, relation)
+	if err != nil {
+		return nil, nil, "", err
 	}
+	return subjects, conditional, s.zookieForRevision(revision), nil
+}
 
-	// Get all groups the subject is a member of (directly or indirectly)
-	groups := s.getGroupMemberships(subject, make(map[string]bool))
+// expand collects the subjects of a relation using the given snapshot reader.
+// Subject sets are listed along with the subjects they expand to, and wildcards
+// are listed as type:* rather than enumerated. Conditional subjects are also
+// returned with the caveats they depend on.
+func (s *Store) expand(reader datastore.Reader, resource, relation string) ([]string, map[string][]string, error) {
+	subjects := make(map[string]map[string]bool)
+	if err := s.expandSubjects(reader, resource, relation, nil, subjects, make(map[string]bool)); err != nil {
+		return nil, nil, err
+	}
 
-	// Check if any of these groups have relations with the resource
-	for groupID := range groups {
-		for _, gr := range s.relationships {
-			if gr.Resource == resource && gr.Subject == groupID {
-				relations = append(relations, gr.Relation)
-			}
+	result := make([]string, 0, len(subjects))
+	conditional := make(map[string][]string)
+	for subject, caveats := range subjects {
+		result = append(result, subject)
+		if caveats != nil {
+			conditional[subject] = sortedKeys(caveats)
 		}
 	}
-
-	return relations
+	return result, conditional, nil
 }
 
-// getGroupMemberships recursively finds all groups a subject is a member of
-func (s *Store) getGroupMemberships(subject string, visited map[string]bool) map[string]bool {
-	groups := make(map[string]bool)
+// expandSubjects recursively collects the subjects of a relation, following subject
+// sets. caveats names the caveats of the relationships followed to reach the
+// relation. result maps each subject to the caveats of the paths it was reached
+// through, or to nil once it is reached through a path without caveats.
+func (s *Store) expandSubjects(reader datastore.Reader, resource, relation string, caveats []string, result map[string]map[string]bool, visited map[string]bool) error {
+	// A relation reached under other caveats is expanded again, so that its subjects
+	// are not left conditional when they also hold unconditionally
+	key := resource + "#" + relation + "|" + strings.Join(caveats, ",")
+	if visited[key] {
+		return nil // Prevent cycles
+	}
+	visited[key] = true
+
+	tuples, err := reader.QueryTuples(datastore.Filter{Resource: resource, Relation: relation})
+	if err != nil {
+		return err
+	}
 
-	// Find direct group memberships
-	for _, r := range s.relationships {
-		if strings.HasPrefix(r.Resource, "group:") && r.Relation == "member" && r.Subject == subject {
-			groupID := r.Resource
-			if !visited[groupID] {
-				groups[groupID] = true
-				visited[groupID] = true
+	for _, r := range tuples {
+		conditions := caveats
+		if r.Caveat != nil {
+			conditions = mergeMissing(caveats, []string{r.Caveat.Name})
+		}
+		addExpandedSubject(result, r.Subject, conditions)
 
-				// Recursively find groups that this group is a member of
-				nestedGroups := s.getGroupMemberships(groupID, visited)
-				for ng := range nestedGroups {
-					groups[ng] = true
-				}
+		// If the subject is a subject set, expand its members
+		if object, setRelation, isSet := parseSubjectSet(r.Subject); isSet {
+			if err := s.expandSubjects(reader, object, setRelation, conditions, result, visited); err != nil {
+				return err
 			}
 		}
 	}
 
-	return groups
+	return nil
 }
 
-// Expand returns all subjects that have a specific relation with a resource
-func (s *Store) Expand(resource, relation string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	directSubjects := make(map[string]bool)
-	expandedSubjects := make(map[string]bool)
-
-	// Find direct subjects
-	for _, r := range s.relationships {
-		if r.Resource == resource && r.Relation == relation {
-			directSubjects[r.Subject] = true
-
-			// If the subject is a group, expand its members
-			if strings.HasPrefix(r.Subject, "group:") {
-				s.expandGroupMembers(r.Subject, expandedSubjects, make(map[string]bool))
-			}
+// addExpandedSubject records a subject reached through relationships with the given caveats
+func addExpandedSubject(result map[string]map[string]bool, subject string, caveats []string) {
+	existing, seen := result[subject]
+	switch {
+	case len(caveats) == 0:
+		result[subject] = nil
+	case seen && existing == nil:
+		// Already reached unconditionally
+	default:
+		if existing == nil {
+			existing = make(map[string]bool)
+			result[subject] = existing
+		}
+		for _, name := range caveats {
+			existing[name] = true
 		}
 	}
+}
 
-	// Combine direct subjects and expanded group members
-	result := make([]string, 0, len(directSubjects)+len(expandedSubjects))
-	for subject := range directSubjects {
-		result = append(result, subject)
+// ListRelationships returns all relationships
+func (s *Store) ListRelationships() ([]Relationship, error) {
+	reader, err := s.headReader()
+	if err != nil {
+		return nil, err
 	}
-	for subject := range expandedSubjects {
-		result = append(result, subject)
+	return s.listRelationships(reader)
+}
+
+// ListRelationshipsAtRevision returns all relationships that existed at the given revision
+func (s *Store) ListRelationshipsAtRevision(revision datastore.Revision) ([]Relationship, error) {
+	reader, err := s.datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+	return s.listRelationships(reader)
+}
+
+// ListRelationshipsWithConsistency returns all relationships at the revision selected by
+// the consistency, along with the zookie of that revision
+func (s *Store) ListRelationshipsWithConsistency(consistency Consistency) ([]Relationship, string, error) {
+	revision, err := s.ResolveRevision(consistency)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return result
+	relationships, err := s.ListRelationshipsAtRevision(revision)
+	if err != nil {
+		return nil, "", err
+	}
+	return relationships, s.zookieForRevision(revision), nil
 }
 
-// expandGroupMembers recursively finds all members of a group
-func (s *Store) expandGroupMembers(groupID string, result map[string]bool, visited map[string]bool) {
-	if visited[groupID] {
-		return // Prevent cycles
+// listRelationships lists the relationships visible to the given snapshot reader
+func (s *Store) listRelationships(reader datastore.Reader) ([]Relationship, error) {
+	tuples, err := reader.QueryTuples(datastore.Filter{})
+	if err != nil {
+		return nil, err
 	}
-	visited[groupID] = true
 
-	for _, r := range s.relationships {
-		if r.Resource == groupID && r.Relation == "member" {
-			result[r.Subject] = true
+	sort.Slice(tuples, func(i, j int) bool {
+		return tuples[i].Key() < tuples[j].Key()
+	})
 
-			// If the member is also a group, recursively expand it
-			if strings.HasPrefix(r.Subject, "group:") {
-				s.expandGroupMembers(r.Subject, result, visited)
-			}
-		}
+	relationships := make([]Relationship, 0, len(tuples))
+	for _, t := range tuples {
+		relationships = append(relationships, s.relationshipFromTuple(t))
 	}
-}
 
-// ListRelationships returns all relationships
-func (s *Store) ListRelationships() []Relationship {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return relationships, nil
+}
 
-	// Create a copy to avoid race conditions
-	relationships := make([]Relationship, len(s.relationships))
-	copy(relationships, s.relationships)
+// relationshipFromTuple converts a stored tuple to its API representation
+func (s *Store) relationshipFromTuple(t datastore.Tuple) Relationship {
+	return Relationship{
+		Resource:    t.Resource,
+		Relation:    t.Relation,
+		Subject:     t.Subject,
+		ExpiresAt:   t.ExpiresAt,
+		Caveat:      t.Caveat,
+		ZookieToken: s.zookies.Encode(t.CreatedAt, t.UpdatedAt),
+		UpdatedAt:   t.UpdatedAt,
+	}
+}
 
-	return relationships
+// zookieForRevision issues a zookie for a revision evaluated now
+func (s *Store) zookieForRevision(revision datastore.Revision) string {
+	return s.zookies.Encode(revision, time.Now())
 }
 
 // GetChangeNumber returns the current change number
 func (s *Store) GetChangeNumber() int64 {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	revision, err := s.datastore.HeadRevision()
+	if err != nil {
+		return 0
+	}
 
-	return s.changeNumber
+	return int64(revision)
 }
 
-// InitializeWithSampleData adds sample relationships for testing
-func (s *Store) InitializeWithSampleData() {
+// InitializeWithSampleData adds sample relationships for testing. A store that
+// already holds relationships, such as one recovered from a file datastore's log,
+// is left untouched.
+func (s *Store) InitializeWithSampleData() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Clear existing relationships
-	s.relationships = make([]Relationship, 0)
-
-	// Add sample relationships
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "document:report",
-		Relation:    "owner",
-		Subject:     "user:alice",
-		ZookieToken: "zk_1",
-		UpdatedAt:   time.Now(),
-	})
-
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "document:report",
-		Relation:    "editor",
-		Subject:     "user:bob",
-		ZookieToken: "zk_2",
-		UpdatedAt:   time.Now(),
-	})
-
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "document:report",
-		Relation:    "viewer",
-		Subject:     "group:engineering",
-		ZookieToken: "zk_3",
-		UpdatedAt:   time.Now(),
-	})
-
-	// Direct group membership
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "group:engineering",
-		Relation:    "member",
-		Subject:     "user:charlie",
-		ZookieToken: "zk_4",
-		UpdatedAt:   time.Now(),
-	})
-
-	// Nested group example
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "group:frontend",
-		Relation:    "member",
-		Subject:     "user:dave",
-		ZookieToken: "zk_5",
-		UpdatedAt:   time.Now(),
-	})
-
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "group:engineering",
-		Relation:    "member",
-		Subject:     "group:frontend",
-		ZookieToken: "zk_6",
-		UpdatedAt:   time.Now(),
-	})
+	reader, err := s.headReader()
+	if err != nil {
+		return err
+	}
+	existing, err := reader.QueryTuples(datastore.Filter{})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
 
-	// Parent-child relationship for document inheritance
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "document:report",
-		Relation:    "parent",
-		Subject:     "folder:projects",
-		ZookieToken: "zk_7",
-		UpdatedAt:   time.Now(),
-	})
+	samples := []datastore.Tuple{
+		{Resource: "document:report", Relation: "owner", Subject: "user:alice"},
+		{Resource: "document:report", Relation: "editor", Subject: "user:bob"},
+		{Resource: "document:report", Relation: "viewer", Subject: "group:engineering#member"},
+		// Direct group membership
+		{Resource: "group:engineering", Relation: "member", Subject: "user:charlie"},
+		// Nested group example
+		{Resource: "group:frontend", Relation: "member", Subject: "user:dave"},
+		{Resource: "group:engineering", Relation: "member", Subject: "group:frontend#member"},
+		// Parent-child relationship for document inheritance
+		{Resource: "document:report", Relation: "parent", Subject: "folder:projects"},
+		// Viewer relationship for the parent folder
+		{Resource: "folder:projects", Relation: "viewer", Subject: "user:eve"},
+	}
 
-	// Viewer relationship for the parent folder
-	s.relationships = append(s.relationships, Relationship{
-		Resource:    "folder:projects",
-		Relation:    "viewer",
-		Subject:     "user:eve",
-		ZookieToken: "zk_8",
-		UpdatedAt:   time.Now(),
-	})
+	// Write each sample separately so that every tuple gets its own revision
+	for _, t := range samples {
+		if _, err := s.datastore.Write([]datastore.Update{{Operation: datastore.UpdateTouch, Tuple: t}}); err != nil {
+			return err
+		}
+	}
 
-	s.changeNumber = 9
+	return nil
 }
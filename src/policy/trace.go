@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+const (
+	// TraceNodePermission is the root of an explained check: a permission expression
+	TraceNodePermission = "permission"
+	// TraceNodeRelation is the evaluation of a relation on an object
+	TraceNodeRelation = "relation"
+	// TraceNodeLeopard is a membership answered by the Leopard index
+	TraceNodeLeopard = "leopard"
+)
+
+// TraceNode is one step of an explained check. Relation nodes hold the rewrite
+// node evaluated for the relation; rewrite nodes have the type of their rule
+// (this, computed_userset, tuple_to_userset, union, intersection or exclusion).
+type TraceNode struct {
+	Type     string `json:"type"`
+	Object   string `json:"object"`
+	Relation string `json:"relation"`
+	// Tuples read by this step, as object#relation@subject
+	Tuples []string `json:"tuples,omitempty"`
+	Result bool     `json:"result"`
+	// Caveat parameters a conditional result depends on; empty for definite results
+	MissingContext []string `json:"missing_context,omitempty"`
+	// Set when the result was taken from an earlier evaluation in the same check
+	// or, for checks at the same revision, from the check cache
+	Cached   bool         `json:"cached,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Duration string       `json:"duration"`
+	Children []*TraceNode `json:"children,omitempty"`
+
+	started time.Time
+}
+
+// traceRoot returns a context that records its evaluations under a new root node
+func (c *EvalContext) traceRoot(nodeType, object, relation string) (*EvalContext, *TraceNode) {
+	node := &TraceNode{Type: nodeType, Object: object, Relation: relation, started: time.Now()}
+	child := *c
+	child.trace = node
+	return &child, node
+}
+
+// traceStart adds a node under the context's current node and returns a context
+// that records its evaluations beneath it. Without tracing it returns c and nil.
+func (c *EvalContext) traceStart(nodeType, object, relation string) (*EvalContext, *TraceNode) {
+	if c.trace == nil {
+		return c, nil
+	}
+	parent := c.trace
+	child, node := c.traceRoot(nodeType, object, relation)
+	parent.Children = append(parent.Children, node)
+	return child, node
+}
+
+// consult records the tuples read by the node
+func (n *TraceNode) consult(tuples []datastore.Tuple) {
+	if n == nil {
+		return
+	}
+	for _, t := range tuples {
+		n.Tuples = append(n.Tuples, t.Key())
+	}
+}
+
+// markCached records that the node's result came from the memo or the check cache
+func (n *TraceNode) markCached() {
+	if n == nil {
+		return
+	}
+	n.Cached = true
+}
+
+// finish records the outcome of the node and the time spent on it
+func (n *TraceNode) finish(result checkResult, err error) {
+	if n == nil {
+		return
+	}
+	n.Result = result.allowed()
+	n.MissingContext = result.missing
+	if err != nil {
+		n.Error = err.Error()
+	}
+	n.Duration = time.Since(n.started).String()
+}
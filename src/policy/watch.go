@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"context"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// WatchEventType defines the kind of event sent to watchers
+type WatchEventType string
+
+const (
+	// WatchEventAdd is sent when a relationship is written
+	WatchEventAdd WatchEventType = "add"
+	// WatchEventDelete is sent when a relationship is deleted
+	WatchEventDelete WatchEventType = "delete"
+	// WatchEventHeartbeat is sent while nothing changes, carrying the current revision
+	WatchEventHeartbeat WatchEventType = "heartbeat"
+	// WatchEventError is sent before the stream ends because of an error
+	WatchEventError WatchEventType = "error"
+)
+
+// DefaultWatchHeartbeat is the default interval between heartbeat events
+const DefaultWatchHeartbeat = 10 * time.Second
+
+// WatchFilter restricts the relationships reported by a watch. Empty fields match anything.
+type WatchFilter struct {
+	ResourceType string
+	Relation     string
+}
+
+// matches reports whether the tuple passes the filter
+func (f WatchFilter) matches(t datastore.Tuple) bool {
+	if f.ResourceType != "" && t.ResourceType() != f.ResourceType {
+		return false
+	}
+	if f.Relation != "" && t.Relation != f.Relation {
+		return false
+	}
+	return true
+}
+
+// WatchEvent is a single event in a watch stream
+type WatchEvent struct {
+	Type         WatchEventType `json:"type"`
+	Revision     int64          `json:"revision"`
+	ZookieToken  string         `json:"zookie_token"`
+	Timestamp    time.Time      `json:"timestamp"`
+	Relationship *Relationship  `json:"relationship,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// Watch streams relationship changes committed after the given zookie, in revision
+// order. An empty zookie starts at the current head. A heartbeat event carrying the
+// current revision is sent whenever no event was sent for the heartbeat interval. The
+// returned channel is closed when ctx is done or after an error event.
+func (s *Store) Watch(ctx context.Context, afterZookie string, filter WatchFilter, heartbeat time.Duration) (<-chan WatchEvent, error) {
+	if heartbeat <= 0 {
+		heartbeat = DefaultWatchHeartbeat
+	}
+
+	var after datastore.Revision
+	var err error
+	if afterZookie == "" {
+		after, err = s.datastore.HeadRevision()
+	} else {
+		var zookie *Zookie
+		zookie, err = s.zookies.Decode(afterZookie)
+		if zookie != nil {
+			after = zookie.Revision
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail early if the starting revision cannot be served
+	if _, _, err := s.datastore.Changes(after); err != nil {
+		return nil, err
+	}
+
+	events := make(chan WatchEvent)
+	go s.watch(ctx, after, filter, heartbeat, events)
+	return events, nil
+}
+
+// watch sends events until ctx is done or an error occurs
+func (s *Store) watch(ctx context.Context, after datastore.Revision, filter WatchFilter, heartbeat time.Duration, events chan<- WatchEvent) {
+	defer close(events)
+
+	send := func(event WatchEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	timer := time.NewTimer(heartbeat)
+	defer timer.Stop()
+
+	for {
+		changes, notify, err := s.datastore.Changes(after)
+		if err != nil {
+			send(WatchEvent{Type: WatchEventError, Revision: int64(after), Error: err.Error()})
+			return
+		}
+
+		sent := false
+		for _, change := range changes {
+			for _, u := range change.Updates {
+				if !filter.matches(u.Tuple) {
+					continue
+				}
+
+				eventType := WatchEventAdd
+				if u.Operation == datastore.UpdateDelete {
+					eventType = WatchEventDelete
+				}
+				relationship := s.relationshipFromTuple(u.Tuple)
+				if !send(WatchEvent{
+					Type:         eventType,
+					Revision:     int64(change.Revision),
+					ZookieToken:  s.zookies.Encode(change.Revision, change.Timestamp),
+					Timestamp:    change.Timestamp,
+					Relationship: &relationship,
+				}) {
+					return
+				}
+				sent = true
+			}
+			after = change.Revision
+		}
+		if sent {
+			// Heartbeats are only needed while no events are sent; changes the
+			// filter drops do not count, so quiet watchers still hear from the stream
+			timer.Reset(heartbeat)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		case <-timer.C:
+			if !send(WatchEvent{
+				Type:        WatchEventHeartbeat,
+				Revision:    int64(after),
+				ZookieToken: s.zookieForRevision(after),
+				Timestamp:   time.Now(),
+			}) {
+				return
+			}
+			timer.Reset(heartbeat)
+		}
+	}
+}
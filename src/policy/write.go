@@ -0,0 +1,233 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+// WriteOperation defines the kind of change applied to a relationship in a batch write
+type WriteOperation string
+
+const (
+	// WriteCreate adds the relationship and fails the batch if it already exists
+	WriteCreate WriteOperation = "CREATE"
+	// WriteTouch adds the relationship, or leaves it in place if it already exists
+	WriteTouch WriteOperation = "TOUCH"
+	// WriteDelete removes the relationship if it exists
+	WriteDelete WriteOperation = "DELETE"
+)
+
+// PreconditionOperation defines what a precondition requires of the matching relationships
+type PreconditionOperation string
+
+const (
+	// PreconditionMustExist requires at least one relationship to match the filter
+	PreconditionMustExist PreconditionOperation = "MUST_EXIST"
+	// PreconditionMustNotExist requires no relationship to match the filter
+	PreconditionMustNotExist PreconditionOperation = "MUST_NOT_EXIST"
+)
+
+var (
+	// ErrRelationshipExists is returned when a CREATE targets an existing relationship
+	ErrRelationshipExists = errors.New("relationship already exists")
+	// ErrPreconditionFailed is returned when a write precondition does not hold
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// RelationshipUpdate is a single mutation in a batch write
+type RelationshipUpdate struct {
+	Operation    WriteOperation `json:"operation"`
+	Relationship Relationship   `json:"relationship"`
+}
+
+// RelationshipFilter selects relationships by their fields. Empty fields match anything.
+type RelationshipFilter struct {
+	ResourceType string `json:"resource_type,omitempty"`
+	Resource     string `json:"resource,omitempty"`
+	Relation     string `json:"relation,omitempty"`
+	Subject      string `json:"subject,omitempty"`
+	SubjectType  string `json:"subject_type,omitempty"`
+}
+
+// isEmpty reports whether the filter matches every relationship
+func (f RelationshipFilter) isEmpty() bool {
+	return f == RelationshipFilter{}
+}
+
+// datastoreFilter converts the filter to a datastore filter
+func (f RelationshipFilter) datastoreFilter() datastore.Filter {
+	return datastore.Filter{
+		ResourceType: f.ResourceType,
+		Resource:     f.Resource,
+		Relation:     f.Relation,
+		Subject:      f.Subject,
+		SubjectType:  f.SubjectType,
+	}
+}
+
+// Precondition must hold at the head revision for a batch write to be applied
+type Precondition struct {
+	Operation PreconditionOperation `json:"operation"`
+	Filter    RelationshipFilter    `json:"filter"`
+}
+
+// WriteRelationships applies all updates atomically at a single revision and returns
+// its zookie. Preconditions are checked against the head revision before anything is
+// written; if any of them fails, or any update is invalid, nothing is written.
+func (s *Store) WriteRelationships(updates []RelationshipUpdate, preconditions []Precondition) (string, error) {
+	if len(updates) == 0 {
+		return "", fmt.Errorf("no updates to write")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reader, err := s.headReader()
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range preconditions {
+		if err := checkPrecondition(reader, p); err != nil {
+			return "", err
+		}
+	}
+
+	seen := make(map[string]bool, len(updates))
+	batch := make([]datastore.Update, 0, len(updates))
+	for _, u := range updates {
+		r := u.Relationship
+		t := datastore.Tuple{Resource: r.Resource, Relation: r.Relation, Subject: r.Subject, ExpiresAt: r.ExpiresAt, Caveat: r.Caveat}
+
+		// Applying two updates to one relationship would make the result depend on their order
+		if seen[t.Key()] {
+			return "", fmt.Errorf("relationship updated more than once: %s", t.Key())
+		}
+		seen[t.Key()] = true
+
+		switch u.Operation {
+		case WriteCreate, WriteTouch:
+			if err := s.validateRelationship(r.Resource, r.Relation, r.Subject, r.Caveat); err != nil {
+				return "", err
+			}
+			if err := validateExpiry(r.ExpiresAt); err != nil {
+				return "", err
+			}
+			if u.Operation == WriteCreate {
+				existing, err := reader.QueryTuples(datastore.Filter{Resource: r.Resource, Relation: r.Relation, Subject: r.Subject})
+				if err != nil {
+					return "", err
+				}
+				if len(existing) > 0 {
+					return "", fmt.Errorf("%w: %s", ErrRelationshipExists, t.Key())
+				}
+			}
+			batch = append(batch, datastore.Update{Operation: datastore.UpdateTouch, Tuple: t})
+		case WriteDelete:
+			batch = append(batch, datastore.Update{Operation: datastore.UpdateDelete, Tuple: t})
+		default:
+			return "", fmt.Errorf("unknown write operation: %s", u.Operation)
+		}
+	}
+
+	revision, err := s.datastore.Write(batch)
+	if err != nil {
+		return "", err
+	}
+	return s.zookieForRevision(revision), nil
+}
+
+// checkPrecondition checks a precondition against the reader's revision
+func checkPrecondition(reader datastore.Reader, p Precondition) error {
+	if p.Filter.isEmpty() {
+		return fmt.Errorf("precondition filter must not be empty")
+	}
+
+	tuples, err := reader.QueryTuples(p.Filter.datastoreFilter())
+	if err != nil {
+		return err
+	}
+
+	switch p.Operation {
+	case PreconditionMustExist:
+		if len(tuples) == 0 {
+			return fmt.Errorf("%w: no relationship matches %+v", ErrPreconditionFailed, p.Filter)
+		}
+	case PreconditionMustNotExist:
+		if len(tuples) > 0 {
+			return fmt.Errorf("%w: %s exists", ErrPreconditionFailed, tuples[0].Key())
+		}
+	default:
+		return fmt.Errorf("unknown precondition operation: %s", p.Operation)
+	}
+	return nil
+}
+
+// DeleteRelationshipsResult reports the outcome of a filtered delete
+type DeleteRelationshipsResult struct {
+	DeletedCount int `json:"deleted_count"`
+	// Partial is set when the limit stopped the delete before every match was removed
+	Partial     bool   `json:"partial"`
+	ZookieToken string `json:"zookie_token"`
+}
+
+// DeleteRelationships deletes every relationship matching the filter at a single
+// revision. The resource type is required. A positive limit caps the number of
+// relationships deleted; the remaining matches are left in place and reported
+// as a partial delete.
+func (s *Store) DeleteRelationships(filter RelationshipFilter, limit int) (*DeleteRelationshipsResult, error) {
+	if filter.ResourceType == "" {
+		return nil, fmt.Errorf("resource type is required")
+	}
+	if filter.Resource != "" && !strings.HasPrefix(filter.Resource, filter.ResourceType+":") {
+		return nil, fmt.Errorf("resource %s is not of type %s", filter.Resource, filter.ResourceType)
+	}
+	if filter.Subject != "" && filter.SubjectType != "" {
+		return nil, fmt.Errorf("subject and subject type cannot both be set")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reader, err := s.headReader()
+	if err != nil {
+		return nil, err
+	}
+
+	tuples, err := reader.QueryTuples(filter.datastoreFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DeleteRelationshipsResult{}
+	if len(tuples) == 0 {
+		result.ZookieToken = s.zookieForRevision(reader.Revision())
+		return result, nil
+	}
+
+	// Delete in a stable order so that limited deletes make progress predictably
+	sort.Slice(tuples, func(i, j int) bool {
+		return tuples[i].Key() < tuples[j].Key()
+	})
+	if limit > 0 && len(tuples) > limit {
+		tuples = tuples[:limit]
+		result.Partial = true
+	}
+
+	updates := make([]datastore.Update, len(tuples))
+	for i, t := range tuples {
+		updates[i] = datastore.Update{Operation: datastore.UpdateDelete, Tuple: t}
+	}
+	revision, err := s.datastore.Write(updates)
+	if err != nil {
+		return nil, err
+	}
+
+	result.DeletedCount = len(tuples)
+	result.ZookieToken = s.zookieForRevision(revision)
+	return result, nil
+}
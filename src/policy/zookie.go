@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+const (
+	// zookieVersion is the current zookie encoding version
+	zookieVersion byte = 1
+	// zookieMACSize is the number of HMAC-SHA256 bytes kept in a zookie
+	zookieMACSize = 16
+	// zookiePayloadSize is the size of the signed part: version, revision and timestamp
+	zookiePayloadSize = 1 + 8 + 8
+)
+
+// ErrInvalidZookie is returned for zookies that are malformed or were not signed by this store
+var ErrInvalidZookie = errors.New("invalid zookie")
+
+// Zookie is a decoded consistency token
+type Zookie struct {
+	Revision datastore.Revision
+	// Time at which the revision was committed or evaluated
+	Timestamp time.Time
+}
+
+// ZookieCodec encodes and verifies opaque, HMAC-signed zookies
+type ZookieCodec struct {
+	key []byte
+}
+
+// NewZookieCodec creates a codec that signs zookies with the given key
+func NewZookieCodec(key []byte) *ZookieCodec {
+	return &ZookieCodec{key: append([]byte(nil), key...)}
+}
+
+// NewRandomZookieCodec creates a codec with a random key. Zookies it issues
+// are not accepted by other processes or after a restart.
+func NewRandomZookieCodec() *ZookieCodec {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate zookie key: %v", err))
+	}
+	return &ZookieCodec{key: key}
+}
+
+// Encode returns the zookie token for a revision
+func (c *ZookieCodec) Encode(revision datastore.Revision, timestamp time.Time) string {
+	buf := make([]byte, zookiePayloadSize, zookiePayloadSize+zookieMACSize)
+	buf[0] = zookieVersion
+	binary.BigEndian.PutUint64(buf[1:9], uint64(revision))
+	binary.BigEndian.PutUint64(buf[9:17], uint64(timestamp.UnixNano()))
+	buf = append(buf, c.sign(buf)...)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Decode verifies a zookie token and returns its contents
+func (c *ZookieCodec) Decode(token string) (*Zookie, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != zookiePayloadSize+zookieMACSize {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidZookie)
+	}
+	if buf[0] != zookieVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidZookie, buf[0])
+	}
+
+	payload, mac := buf[:zookiePayloadSize], buf[zookiePayloadSize:]
+	if !hmac.Equal(mac, c.sign(payload)) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidZookie)
+	}
+
+	revision := int64(binary.BigEndian.Uint64(payload[1:9]))
+	if revision < 0 {
+		return nil, fmt.Errorf("%w: negative revision", ErrInvalidZookie)
+	}
+
+	return &Zookie{
+		Revision:  datastore.Revision(revision),
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(payload[9:17]))),
+	}, nil
+}
+
+// sign returns the truncated HMAC of a zookie payload
+func (c *ZookieCodec) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:zookieMACSize]
+}
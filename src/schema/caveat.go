@@ -0,0 +1,236 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaveatParameterType defines the type of a caveat parameter
+type CaveatParameterType string
+
+const (
+	// CaveatTypeString is a string
+	CaveatTypeString CaveatParameterType = "string"
+	// CaveatTypeInt is an integer
+	CaveatTypeInt CaveatParameterType = "int"
+	// CaveatTypeDouble is a floating point number
+	CaveatTypeDouble CaveatParameterType = "double"
+	// CaveatTypeBool is a boolean
+	CaveatTypeBool CaveatParameterType = "bool"
+	// CaveatTypeTimestamp is a point in time, given as an RFC 3339 string
+	CaveatTypeTimestamp CaveatParameterType = "timestamp"
+	// CaveatTypeIPAddress is an IPv4 or IPv6 address
+	CaveatTypeIPAddress CaveatParameterType = "ipaddress"
+)
+
+// Caveat is a named condition that relationships can reference. The expression
+// is evaluated over the typed parameters, whose values come from the relationship
+// and from the context of the check.
+//
+// Expressions support the literals true, false, numbers and quoted strings,
+// parameters, comparisons (== != < <= > >=), && || ! and parentheses, and the
+// function ip_in_range(ip, cidr).
+type Caveat struct {
+	Name       string                         `json:"name"`
+	Parameters map[string]CaveatParameterType `json:"parameters"`
+	Expression string                         `json:"expression"`
+
+	compileOnce sync.Once
+	compiled    caveatExpr
+	compileErr  error
+}
+
+// MissingCaveatParametersError is returned when a caveat cannot be evaluated
+// because parameters it uses have no value
+type MissingCaveatParametersError struct {
+	Caveat     string
+	Parameters []string
+}
+
+func (e *MissingCaveatParametersError) Error() string {
+	return fmt.Sprintf("caveat %s is missing parameters: %s", e.Caveat, strings.Join(e.Parameters, ", "))
+}
+
+// AddCaveat adds a caveat definition to the schema after compiling its expression
+func (s *Schema) AddCaveat(c *Caveat) error {
+	if _, err := c.program(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Caveats == nil {
+		s.Caveats = make(map[string]*Caveat)
+	}
+	if _, exists := s.Caveats[c.Name]; exists {
+		return fmt.Errorf("caveat %s already exists", c.Name)
+	}
+	s.Caveats[c.Name] = c
+	return nil
+}
+
+// GetCaveat returns a caveat definition by name
+func (s *Schema) GetCaveat(name string) (*Caveat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, exists := s.Caveats[name]
+	if !exists {
+		return nil, fmt.Errorf("caveat %s not defined in schema", name)
+	}
+	return c, nil
+}
+
+// ValidateContext checks that every value is bound to a declared parameter of a matching type
+func (c *Caveat) ValidateContext(values map[string]any) error {
+	for name, value := range values {
+		typ, declared := c.Parameters[name]
+		if !declared {
+			return fmt.Errorf("caveat %s has no parameter %s", c.Name, name)
+		}
+		if _, err := convertCaveatValue(value, typ); err != nil {
+			return fmt.Errorf("caveat %s parameter %s: %w", c.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// Evaluate evaluates the caveat with the given parameter values. Values of
+// undeclared parameters are ignored. Parameters without a value only matter when
+// the result depends on them: && and || short-circuit, so a || b holds when a is
+// true whatever b is. Otherwise a *MissingCaveatParametersError lists the
+// parameters that block the decision.
+func (c *Caveat) Evaluate(values map[string]any) (bool, error) {
+	expr, err := c.program()
+	if err != nil {
+		return false, err
+	}
+
+	env := make(map[string]any, len(c.Parameters))
+	for name, typ := range c.Parameters {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		converted, err := convertCaveatValue(value, typ)
+		if err != nil {
+			return false, fmt.Errorf("caveat %s parameter %s: %w", c.Name, name, err)
+		}
+		env[name] = converted
+	}
+
+	result, err := expr.eval(env)
+	var missing *missingValuesError
+	if errors.As(err, &missing) {
+		return false, &MissingCaveatParametersError{Caveat: c.Name, Parameters: uniqueSorted(missing.names)}
+	}
+	if err != nil {
+		return false, fmt.Errorf("caveat %s: %w", c.Name, err)
+	}
+	allowed, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("caveat %s: expression is not boolean", c.Name)
+	}
+	return allowed, nil
+}
+
+// uniqueSorted returns the distinct names in sorted order
+func uniqueSorted(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	var unique []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// program compiles the expression once and returns it
+func (c *Caveat) program() (caveatExpr, error) {
+	c.compileOnce.Do(func() {
+		c.compiled, c.compileErr = compileCaveat(c)
+	})
+	return c.compiled, c.compileErr
+}
+
+// compileCaveat parses the expression and checks that it only uses declared parameters
+func compileCaveat(c *Caveat) (caveatExpr, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("caveat name is required")
+	}
+	for name, typ := range c.Parameters {
+		switch typ {
+		case CaveatTypeString, CaveatTypeInt, CaveatTypeDouble, CaveatTypeBool, CaveatTypeTimestamp, CaveatTypeIPAddress:
+		default:
+			return nil, fmt.Errorf("caveat %s parameter %s has unknown type %s", c.Name, name, typ)
+		}
+	}
+
+	expr, err := parseCaveatExpression(c.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("caveat %s: %w", c.Name, err)
+	}
+	for _, name := range expr.parameters(nil) {
+		if _, declared := c.Parameters[name]; !declared {
+			return nil, fmt.Errorf("caveat %s uses undeclared parameter %s", c.Name, name)
+		}
+	}
+	return expr, nil
+}
+
+// convertCaveatValue converts a value, typically decoded from JSON, to the
+// representation used during evaluation: float64 for numbers, time.Time for
+// timestamps and netip.Addr for IP addresses
+func convertCaveatValue(value any, typ CaveatParameterType) (any, error) {
+	switch typ {
+	case CaveatTypeString:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	case CaveatTypeInt, CaveatTypeDouble:
+		var f float64
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case int:
+			f = float64(v)
+		case int64:
+			f = float64(v)
+		default:
+			return nil, fmt.Errorf("expected %s, got %T", typ, value)
+		}
+		if typ == CaveatTypeInt && f != math.Trunc(f) {
+			return nil, fmt.Errorf("expected int, got %v", f)
+		}
+		return f, nil
+	case CaveatTypeBool:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case CaveatTypeTimestamp:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			return time.Parse(time.RFC3339, v)
+		}
+	case CaveatTypeIPAddress:
+		switch v := value.(type) {
+		case netip.Addr:
+			return v, nil
+		case string:
+			return netip.ParseAddr(v)
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %T", typ, value)
+}
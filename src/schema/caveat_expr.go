@@ -0,0 +1,513 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// caveatExpr is a node of a compiled caveat expression
+type caveatExpr interface {
+	// eval evaluates the node with the given parameter values
+	eval(env map[string]any) (any, error)
+	// parameters appends the names of the parameters used by the node
+	parameters(names []string) []string
+}
+
+type literalExpr struct{ value any }
+
+type paramExpr struct{ name string }
+
+type notExpr struct{ operand caveatExpr }
+
+type binaryExpr struct {
+	op          string
+	left, right caveatExpr
+}
+
+type callExpr struct {
+	name string
+	args []caveatExpr
+}
+
+// missingValuesError is returned by a node whose value depends on parameters that
+// have no value
+type missingValuesError struct {
+	names []string
+}
+
+func (e *missingValuesError) Error() string {
+	return fmt.Sprintf("parameters %s have no value", strings.Join(e.names, ", "))
+}
+
+// caveatFunctions are the functions available to caveat expressions
+var caveatFunctions = map[string]func(args []any) (any, error){
+	"ip_in_range": ipInRange,
+}
+
+func (e literalExpr) eval(map[string]any) (any, error) { return e.value, nil }
+
+func (e literalExpr) parameters(names []string) []string { return names }
+
+func (e paramExpr) eval(env map[string]any) (any, error) {
+	value, ok := env[e.name]
+	if !ok {
+		return nil, &missingValuesError{names: []string{e.name}}
+	}
+	return value, nil
+}
+
+func (e paramExpr) parameters(names []string) []string {
+	for _, name := range names {
+		if name == e.name {
+			return names
+		}
+	}
+	return append(names, e.name)
+}
+
+func (e notExpr) eval(env map[string]any) (any, error) {
+	value, err := e.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("operand of ! is not boolean")
+	}
+	return !b, nil
+}
+
+func (e notExpr) parameters(names []string) []string { return e.operand.parameters(names) }
+
+func (e binaryExpr) eval(env map[string]any) (any, error) {
+	if e.op != "&&" && e.op != "||" {
+		operands, err := evalOperands(env, []caveatExpr{e.left, e.right})
+		if err != nil {
+			return nil, err
+		}
+		return compareCaveatValues(e.op, operands[0], operands[1])
+	}
+
+	// && and || short-circuit: false && x and true || x are decided whatever x is,
+	// including when x depends on parameters that have no value
+	decisive := e.op == "||"
+	left, leftErr := e.evalBool(env, e.left)
+	if leftErr == nil && left == decisive {
+		return left, nil
+	}
+	var leftMissing *missingValuesError
+	if leftErr != nil && !errors.As(leftErr, &leftMissing) {
+		return nil, leftErr
+	}
+
+	right, rightErr := e.evalBool(env, e.right)
+	var rightMissing *missingValuesError
+	switch {
+	case rightErr == nil && right == decisive:
+		return right, nil
+	case rightErr != nil && !errors.As(rightErr, &rightMissing):
+		return nil, rightErr
+	case leftMissing != nil && rightMissing != nil:
+		return nil, &missingValuesError{names: append(append([]string{}, leftMissing.names...), rightMissing.names...)}
+	case leftMissing != nil:
+		return nil, leftMissing
+	case rightMissing != nil:
+		return nil, rightMissing
+	}
+	return right, nil
+}
+
+// evalBool evaluates an operand of && or ||
+func (e binaryExpr) evalBool(env map[string]any, operand caveatExpr) (bool, error) {
+	value, err := operand.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("operand of %s is not boolean", e.op)
+	}
+	return b, nil
+}
+
+func (e binaryExpr) parameters(names []string) []string {
+	return e.right.parameters(e.left.parameters(names))
+}
+
+func (e callExpr) eval(env map[string]any) (any, error) {
+	args, err := evalOperands(env, e.args)
+	if err != nil {
+		return nil, err
+	}
+	return caveatFunctions[e.name](args)
+}
+
+// evalOperands evaluates the operands of a node that needs all of their values. If
+// some depend on parameters that have no value, the parameters of all of them are
+// reported.
+func evalOperands(env map[string]any, operands []caveatExpr) ([]any, error) {
+	values := make([]any, len(operands))
+	var missing []string
+	for i, operand := range operands {
+		value, err := operand.eval(env)
+		var m *missingValuesError
+		switch {
+		case errors.As(err, &m):
+			missing = append(missing, m.names...)
+		case err != nil:
+			return nil, err
+		}
+		values[i] = value
+	}
+	if len(missing) > 0 {
+		return nil, &missingValuesError{names: missing}
+	}
+	return values, nil
+}
+
+func (e callExpr) parameters(names []string) []string {
+	for _, arg := range e.args {
+		names = arg.parameters(names)
+	}
+	return names
+}
+
+// compareCaveatValues applies a comparison operator to two values of the same type.
+// A string is compared with a timestamp or IP address by parsing it first.
+func compareCaveatValues(op string, left, right any) (bool, error) {
+	left, right, err := coerceCaveatOperands(left, right)
+	if err != nil {
+		return false, err
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r := right.(float64)
+		cmp = compareOrdered(l, r)
+	case string:
+		cmp = strings.Compare(l, right.(string))
+	case time.Time:
+		cmp = l.Compare(right.(time.Time))
+	case netip.Addr:
+		cmp = l.Compare(right.(netip.Addr))
+	case bool:
+		if op != "==" && op != "!=" {
+			return false, fmt.Errorf("operator %s is not defined for booleans", op)
+		}
+		if l != right.(bool) {
+			cmp = 1
+		}
+	default:
+		return false, fmt.Errorf("cannot compare values of type %T", left)
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	default:
+		return false, fmt.Errorf("unknown operator %s", op)
+	}
+}
+
+// coerceCaveatOperands brings two operands to the same type
+func coerceCaveatOperands(left, right any) (any, any, error) {
+	if s, ok := right.(string); ok {
+		switch left.(type) {
+		case time.Time:
+			t, err := time.Parse(time.RFC3339, s)
+			return left, t, err
+		case netip.Addr:
+			a, err := netip.ParseAddr(s)
+			return left, a, err
+		}
+	}
+	if _, ok := left.(string); ok {
+		switch right.(type) {
+		case time.Time, netip.Addr:
+			r, l, err := coerceCaveatOperands(right, left)
+			return l, r, err
+		}
+	}
+	if fmt.Sprintf("%T", left) != fmt.Sprintf("%T", right) {
+		return nil, nil, fmt.Errorf("cannot compare %T with %T", left, right)
+	}
+	return left, right, nil
+}
+
+// compareOrdered compares two numbers
+func compareOrdered(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ipInRange reports whether an IP address is within a CIDR range
+func ipInRange(args []any) (any, error) {
+	var addr netip.Addr
+	switch v := args[0].(type) {
+	case netip.Addr:
+		addr = v
+	case string:
+		parsed, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		addr = parsed
+	default:
+		return nil, fmt.Errorf("ip_in_range: expected an IP address, got %T", args[0])
+	}
+
+	cidr, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("ip_in_range: expected a CIDR string, got %T", args[1])
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return prefix.Contains(addr), nil
+}
+
+// parseCaveatExpression parses a caveat expression
+func parseCaveatExpression(expression string) (caveatExpr, error) {
+	tokens, err := tokenizeCaveat(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &caveatParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+type caveatTokenKind int
+
+const (
+	tokenIdent caveatTokenKind = iota
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type caveatToken struct {
+	kind caveatTokenKind
+	text string
+}
+
+// tokenizeCaveat splits an expression into tokens
+func tokenizeCaveat(expression string) ([]caveatToken, error) {
+	var tokens []caveatToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, caveatToken{kind: tokenIdent, text: string(runes[start:i])})
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, caveatToken{kind: tokenNumber, text: string(runes[start:i])})
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, caveatToken{kind: tokenString, text: string(runes[i+1 : end])})
+			i = end + 1
+		default:
+			op := string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			switch op {
+			case "&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ",":
+			default:
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+			tokens = append(tokens, caveatToken{kind: tokenOperator, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// caveatParser is a recursive descent parser over caveat tokens
+type caveatParser struct {
+	tokens []caveatToken
+	pos    int
+}
+
+// accept consumes the next token if it is the given operator
+func (p *caveatParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOperator && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *caveatParser) parseOr() (caveatExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *caveatParser) parseAnd() (caveatExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *caveatParser) parseUnary() (caveatExpr, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *caveatParser) parseComparison() (caveatExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return binaryExpr{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *caveatParser) parsePrimary() (caveatExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token.text)
+		}
+		return literalExpr{value: value}, nil
+
+	case tokenString:
+		return literalExpr{value: token.text}, nil
+
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return literalExpr{value: true}, nil
+		case "false":
+			return literalExpr{value: false}, nil
+		}
+		if !p.accept("(") {
+			return paramExpr{name: token.text}, nil
+		}
+
+		if _, ok := caveatFunctions[token.text]; !ok {
+			return nil, fmt.Errorf("unknown function %s", token.text)
+		}
+		call := callExpr{name: token.text}
+		if !p.accept(")") {
+			for {
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+				if p.accept(")") {
+					break
+				}
+				if !p.accept(",") {
+					return nil, fmt.Errorf("expected , or ) in call to %s", token.text)
+				}
+			}
+		}
+		if token.text == "ip_in_range" && len(call.args) != 2 {
+			return nil, fmt.Errorf("ip_in_range takes 2 arguments")
+		}
+		return call, nil
+
+	default:
+		if token.text == "(" {
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, fmt.Errorf("expected )")
+			}
+			return expr, nil
+		}
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+}
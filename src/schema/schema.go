@@ -3,6 +3,7 @@ package schema
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -20,10 +21,15 @@ type Relation struct {
 	UsersetRewrite *UsersetRewrite `json:"userset_rewrite,omitempty"`
 }
 
-// Subject defines a subject that can be in a relation
+// Subject defines a subject that can be in a relation. A Subject with a Relation
+// admits subject sets (type:id#relation); one with Wildcard admits the type:*
+// subject, which stands for every subject of the type. A Subject with a Caveat
+// admits relationships conditioned on the named caveat.
 type Subject struct {
 	Type     string `json:"type"`
 	Relation string `json:"relation,omitempty"`
+	Wildcard bool   `json:"wildcard,omitempty"`
+	Caveat   string `json:"caveat,omitempty"`
 }
 
 // Permission defines a permission expression
@@ -34,6 +40,7 @@ type Permission struct {
 // Schema represents the complete schema with all definitions
 type Schema struct {
 	Definitions map[string]*Definition `json:"definitions"`
+	Caveats     map[string]*Caveat     `json:"caveats,omitempty"`
 	mu          sync.RWMutex
 }
 
@@ -70,6 +77,21 @@ func (s *Schema) GetDefinition(typeName string) (*Definition, error) {
 	return def, nil
 }
 
+// ListDefinitions returns every definition, ordered by type
+func (s *Schema) ListDefinitions() []*Definition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	defs := make([]*Definition, 0, len(s.Definitions))
+	for _, def := range s.Definitions {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Type < defs[j].Type
+	})
+	return defs
+}
+
 // LoadDefaultSchema loads a default schema with common resource types
 func LoadDefaultSchema() *Schema {
 	schema := NewSchema()
@@ -98,6 +120,8 @@ func LoadDefaultSchema() *Schema {
 			"viewer": {
 				Subjects: []Subject{
 					{Type: "user"},
+					{Type: "user", Wildcard: true},         // Allow public documents shared with user:*
+					{Type: "user", Caveat: "ip_allowlist"}, // Allow access restricted to a network
 					{Type: "group", Relation: "member"},
 				},
 			},
@@ -163,18 +187,30 @@ func LoadDefaultSchema() *Schema {
 			"member": {
 				Subjects: []Subject{
 					{Type: "user"},
-					{Type: "group"}, // Allow groups to be members of other groups for nested groups
+					{Type: "group", Relation: "member"}, // Allow groups to be members of other groups for nested groups
 				},
 			},
 		},
 	}
 	schema.AddDefinition(groupDef)
 
+	// Caveat restricting a relationship to requests from a network
+	schema.AddCaveat(&Caveat{
+		Name: "ip_allowlist",
+		Parameters: map[string]CaveatParameterType{
+			"ip":   CaveatTypeIPAddress,
+			"cidr": CaveatTypeString,
+		},
+		Expression: "ip_in_range(ip, cidr)",
+	})
+
 	return schema
 }
 
-// ValidateRelationship validates if a relationship is allowed by the schema
-func (s *Schema) ValidateRelationship(resourceType, relation, subjectType string) error {
+// ValidateRelationship validates if a relationship is allowed by the schema.
+// The subject describes the kind of subject being written: a plain type, a
+// subject set when Relation is set, or the type wildcard.
+func (s *Schema) ValidateRelationship(resourceType, relation string, subject Subject) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -188,13 +224,22 @@ func (s *Schema) ValidateRelationship(resourceType, relation, subjectType string
 		return fmt.Errorf("relation %s not defined for resource type %s", relation, resourceType)
 	}
 
-	for _, subject := range rel.Subjects {
-		if subject.Type == subjectType {
+	for _, allowed := range rel.Subjects {
+		if allowed == subject {
 			return nil
 		}
 	}
 
-	return fmt.Errorf("subject type %s not allowed in relation %s for resource type %s", subjectType, relation, resourceType)
+	switch {
+	case subject.Caveat != "":
+		return fmt.Errorf("caveat %s not allowed for subject %s in relation %s for resource type %s", subject.Caveat, subject.Type, relation, resourceType)
+	case subject.Wildcard:
+		return fmt.Errorf("wildcard %s:* not allowed in relation %s for resource type %s", subject.Type, relation, resourceType)
+	case subject.Relation != "":
+		return fmt.Errorf("subject set %s#%s not allowed in relation %s for resource type %s", subject.Type, subject.Relation, relation, resourceType)
+	default:
+		return fmt.Errorf("subject type %s not allowed in relation %s for resource type %s", subject.Type, relation, resourceType)
+	}
 }
 
 // EvaluatePermission evaluates if a permission is granted based on relations
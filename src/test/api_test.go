@@ -0,0 +1,217 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/api"
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// attributeSchema has documents viewed by users from the office network, as given by
+// the principal's ip attribute
+func attributeSchema(t *testing.T) *schema.Schema {
+	t.Helper()
+
+	s := schema.NewSchema()
+	if err := s.AddCaveat(&schema.Caveat{
+		Name:       "from_office",
+		Parameters: map[string]schema.CaveatParameterType{"principal.ip": schema.CaveatTypeIPAddress},
+		Expression: `ip_in_range(principal.ip, "10.0.0.0/8")`,
+	}); err != nil {
+		t.Fatalf("AddCaveat failed: %v", err)
+	}
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"viewer": {Subjects: []schema.Subject{{Type: "user"}, {Type: "user", Caveat: "from_office"}}},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "viewer"}},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	return s
+}
+
+// newAPIServer serves the API over a store with the given schema
+func newAPIServer(t *testing.T, s *schema.Schema) (*httptest.Server, *policy.Store) {
+	t.Helper()
+
+	policyStore := policy.NewStore(s)
+	server := httptest.NewServer(api.NewServer(policyStore, s).Handler())
+	t.Cleanup(server.Close)
+	return server, policyStore
+}
+
+// postJSON posts a request body and decodes the response into out, returning the status code
+func postJSON(t *testing.T, url string, body, out any) int {
+	t.Helper()
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPIBulkAuthorizeAttributes(t *testing.T) {
+	server, policyStore := newAPIServer(t, attributeSchema(t))
+	if _, err := policyStore.TouchRelationship(policy.Relationship{
+		Resource: "document:plan",
+		Relation: "viewer",
+		Subject:  "user:alice",
+		Caveat:   &datastore.ContextualizedCaveat{Name: "from_office"},
+	}); err != nil {
+		t.Fatalf("TouchRelationship failed: %v", err)
+	}
+
+	principals := []api.Principal{
+		{ID: "user:alice", Attributes: map[string]any{"ip": "10.1.2.3"}},
+		{ID: "user:alice", Attributes: map[string]any{"ip": "192.168.0.1"}},
+		{ID: "user:alice"},
+	}
+	var bulk api.BulkAuthorizeRequest
+	for _, principal := range principals {
+		bulk.Items = append(bulk.Items, api.BulkCheckItem{Principal: principal, Resource: api.Resource{ID: "document:plan"}, Action: "view"})
+	}
+	var bulkResp api.BulkAuthorizeResponse
+	if status := postJSON(t, server.URL+"/v1/authorize/bulk", bulk, &bulkResp); status != http.StatusOK {
+		t.Fatalf("Expected 200 from the bulk endpoint, got %d", status)
+	}
+	if len(bulkResp.Results) != len(principals) {
+		t.Fatalf("Expected %d results, got %+v", len(principals), bulkResp.Results)
+	}
+
+	expected := []string{"ALLOW", "DENY", "CONDITIONAL"}
+	for i, principal := range principals {
+		var single api.AuthorizeResponse
+		req := api.AuthorizeRequest{Principal: principal, Resource: api.Resource{ID: "document:plan"}, Action: "view"}
+		if status := postJSON(t, server.URL+"/v1/authorize", req, &single); status != http.StatusOK {
+			t.Fatalf("Expected 200 from the single endpoint, got %d", status)
+		}
+		if single.Decision != expected[i] || bulkResp.Results[i].Decision != expected[i] {
+			t.Errorf("Item %d: expected %s from both endpoints, got %s and %s", i, expected[i], single.Decision, bulkResp.Results[i].Decision)
+		}
+	}
+}
+
+func TestAPIAuthorizeInvalidCaveatContext(t *testing.T) {
+	server, policyStore := newAPIServer(t, schema.LoadDefaultSchema())
+	if _, err := policyStore.TouchRelationship(policy.Relationship{
+		Resource: "document:plan",
+		Relation: "viewer",
+		Subject:  "user:alice",
+		Caveat:   &datastore.ContextualizedCaveat{Name: "ip_allowlist", Context: map[string]any{"cidr": "10.0.0.0/8"}},
+	}); err != nil {
+		t.Fatalf("TouchRelationship failed: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		context map[string]any
+		status  int
+	}{
+		{name: "Valid address", context: map[string]any{"ip": "10.1.2.3"}, status: http.StatusOK},
+		{name: "Malformed address", context: map[string]any{"ip": "garbage"}, status: http.StatusBadRequest},
+		{name: "Wrong type", context: map[string]any{"ip": 42}, status: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := api.AuthorizeRequest{
+				Principal: api.Principal{ID: "user:alice"},
+				Resource:  api.Resource{ID: "document:plan"},
+				Action:    "view",
+				Context:   tc.context,
+			}
+			if status := postJSON(t, server.URL+"/v1/authorize", req, nil); status != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestAPIRelationSubjectsMatchLookup(t *testing.T) {
+	s := schema.LoadDefaultSchema()
+	if err := s.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	server, policyStore := newAPIServer(t, s)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+	// document:report is also shared with every user
+	if _, err := policyStore.AddRelationship("document:report", "viewer", "user:*"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	testCases := []struct {
+		relation    string
+		subjectType string
+	}{
+		{relation: "view", subjectType: "user"},
+		{relation: "viewer", subjectType: "user"},
+		{relation: "owner", subjectType: "user"},
+		{relation: "viewer", subjectType: "group"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.relation+"/"+tc.subjectType, func(t *testing.T) {
+			var lookup policy.LookupSubjectsResult
+			body := api.LookupSubjectsRequest{Resource: "document:report", Permission: tc.relation, SubjectType: tc.subjectType}
+			if status := postJSON(t, server.URL+"/v1/lookup/subjects", body, &lookup); status != http.StatusOK {
+				t.Fatalf("Expected 200 from the lookup endpoint, got %d", status)
+			}
+
+			resp, err := http.Get(server.URL + "/v1/resources/document:report/relations/" + tc.relation + "/subjects?subject_type=" + tc.subjectType)
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			defer resp.Body.Close()
+			var subjects policy.LookupSubjectsResult
+			if err := json.NewDecoder(resp.Body).Decode(&subjects); err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !reflect.DeepEqual(subjects.Subjects, lookup.Subjects) || !reflect.DeepEqual(subjects.ExcludedSubjects, lookup.ExcludedSubjects) {
+				t.Errorf("Expected %+v from both endpoints, got %+v", lookup, subjects)
+			}
+		})
+	}
+
+	t.Run("Default subject type", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/v1/resources/document:report/relations/view/subjects")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var subjects policy.LookupSubjectsResult
+		if err := json.NewDecoder(resp.Body).Decode(&subjects); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		// user:eve views the report through its parent folder, which only rewrites evaluate
+		if len(subjects.Subjects) == 0 || subjects.Subjects[0] != "user:*" || !slices.Contains(subjects.Subjects, "user:eve") {
+			t.Errorf("Expected the wildcard and the folder's viewers, got %v", subjects.Subjects)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestBulkCheck(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+
+	testCases := []struct {
+		item    policy.BulkCheckItem
+		allowed bool
+		err     bool
+	}{
+		{item: policy.BulkCheckItem{Subject: "user:alice", Resource: "document:report", Action: "delete"}, allowed: true},
+		{item: policy.BulkCheckItem{Subject: "user:dave", Resource: "document:report", Action: "view"}, allowed: true},
+		{item: policy.BulkCheckItem{Subject: "user:eve", Resource: "document:report", Action: "edit"}, allowed: false},
+		{item: policy.BulkCheckItem{Subject: "user:alice", Resource: "report", Action: "view"}, err: true},
+		{item: policy.BulkCheckItem{Subject: "user:alice", Resource: "document:report", Action: "share"}, err: true},
+		{item: policy.BulkCheckItem{Subject: "user:eve", Resource: "document:report", Action: "view"}, allowed: true},
+	}
+
+	items := make([]policy.BulkCheckItem, len(testCases))
+	for i, tc := range testCases {
+		items[i] = tc.item
+	}
+	result, err := policyStore.BulkCheck(context.Background(), policy.BulkCheckRequest{Items: items})
+	if err != nil {
+		t.Fatalf("BulkCheck failed: %v", err)
+	}
+	if len(result.Results) != len(testCases) {
+		t.Fatalf("Expected %d results, got %d", len(testCases), len(result.Results))
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.item.Subject+"/"+tc.item.Resource+"/"+tc.item.Action, func(t *testing.T) {
+			got := result.Results[i]
+			if tc.err {
+				if got.Err == nil {
+					t.Errorf("Expected an error, got %+v", got)
+				}
+				return
+			}
+			if got.Err != nil {
+				t.Fatalf("Unexpected error: %v", got.Err)
+			}
+			if got.Allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, got.Allowed)
+			}
+		})
+	}
+
+	t.Run("Too many items", func(t *testing.T) {
+		items := make([]policy.BulkCheckItem, policy.MaxBulkCheckItems+1)
+		if _, err := policyStore.BulkCheck(context.Background(), policy.BulkCheckRequest{Items: items}); err == nil {
+			t.Errorf("Expected an error for more than %d items", policy.MaxBulkCheckItems)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestCaveatedRelationships(t *testing.T) {
+	policyStore := policy.NewStore(schema.LoadDefaultSchema())
+
+	// user:alice may view document:plan from the office network only
+	if _, err := policyStore.TouchRelationship(policy.Relationship{
+		Resource: "document:plan",
+		Relation: "viewer",
+		Subject:  "user:alice",
+		Caveat: &datastore.ContextualizedCaveat{
+			Name:    "ip_allowlist",
+			Context: map[string]any{"cidr": "10.0.0.0/8"},
+		},
+	}); err != nil {
+		t.Fatalf("TouchRelationship failed: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		context map[string]any
+		allowed bool
+	}{
+		{name: "Address in range", context: map[string]any{"ip": "10.1.2.3"}, allowed: true},
+		{name: "Address out of range", context: map[string]any{"ip": "192.168.0.1"}, allowed: false},
+		{name: "Missing context", allowed: false},
+		{
+			name:    "Relationship value takes precedence",
+			context: map[string]any{"ip": "192.168.0.1", "cidr": "192.168.0.0/16"},
+			allowed: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+				Subject:  "user:alice",
+				Resource: "document:plan",
+				Action:   "view",
+				Context:  tc.context,
+			})
+			if err != nil {
+				t.Fatalf("CheckPermission failed: %v", err)
+			}
+			if result.Allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, result.Allowed)
+			}
+		})
+	}
+
+	t.Run("Listed with its caveat", func(t *testing.T) {
+		relationships, err := policyStore.ListRelationships()
+		if err != nil {
+			t.Fatalf("ListRelationships failed: %v", err)
+		}
+		if len(relationships) != 1 || relationships[0].Caveat == nil || relationships[0].Caveat.Name != "ip_allowlist" {
+			t.Errorf("Expected the relationship with its caveat, got %+v", relationships)
+		}
+	})
+}
+
+func TestCaveatExpiry(t *testing.T) {
+	s := schema.NewSchema()
+	if err := s.AddCaveat(&schema.Caveat{
+		Name:       "not_expired",
+		Parameters: map[string]schema.CaveatParameterType{"now": schema.CaveatTypeTimestamp, "expires": schema.CaveatTypeTimestamp},
+		Expression: "now < expires",
+	}); err != nil {
+		t.Fatalf("AddCaveat failed: %v", err)
+	}
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"viewer": {Subjects: []schema.Subject{{Type: "user", Caveat: "not_expired"}}},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "viewer"}},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	policyStore := policy.NewStore(s)
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	for _, r := range []policy.Relationship{
+		{Resource: "document:current", Relation: "viewer", Subject: "user:bob", Caveat: &datastore.ContextualizedCaveat{Name: "not_expired", Context: map[string]any{"expires": future}}},
+		{Resource: "document:lapsed", Relation: "viewer", Subject: "user:bob", Caveat: &datastore.ContextualizedCaveat{Name: "not_expired", Context: map[string]any{"expires": past}}},
+	} {
+		if _, err := policyStore.TouchRelationship(r); err != nil {
+			t.Fatalf("TouchRelationship failed: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		resource string
+		context  map[string]any
+		allowed  bool
+	}{
+		{name: "Before expiry", resource: "document:current", allowed: true},
+		{name: "After expiry", resource: "document:lapsed", allowed: false},
+		{name: "Time given by the request", resource: "document:current", context: map[string]any{"now": "2999-01-01T00:00:00Z"}, allowed: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+				Subject:  "user:bob",
+				Resource: tc.resource,
+				Action:   "view",
+				Context:  tc.context,
+			})
+			if err != nil {
+				t.Fatalf("CheckPermission failed: %v", err)
+			}
+			if result.Allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, result.Allowed)
+			}
+		})
+	}
+}
+
+func TestCaveatValidation(t *testing.T) {
+	policyStore := policy.NewStore(schema.LoadDefaultSchema())
+
+	testCases := []struct {
+		name         string
+		relationship policy.Relationship
+	}{
+		{
+			name:         "Unknown caveat",
+			relationship: policy.Relationship{Resource: "document:plan", Relation: "viewer", Subject: "user:alice", Caveat: &datastore.ContextualizedCaveat{Name: "office_hours"}},
+		},
+		{
+			name: "Undeclared parameter",
+			relationship: policy.Relationship{Resource: "document:plan", Relation: "viewer", Subject: "user:alice", Caveat: &datastore.ContextualizedCaveat{
+				Name:    "ip_allowlist",
+				Context: map[string]any{"port": 443.0},
+			}},
+		},
+		{
+			name: "Parameter of the wrong type",
+			relationship: policy.Relationship{Resource: "document:plan", Relation: "viewer", Subject: "user:alice", Caveat: &datastore.ContextualizedCaveat{
+				Name:    "ip_allowlist",
+				Context: map[string]any{"ip": "not an address"},
+			}},
+		},
+		{
+			name:         "Caveat not allowed by the relation",
+			relationship: policy.Relationship{Resource: "document:plan", Relation: "owner", Subject: "user:alice", Caveat: &datastore.ContextualizedCaveat{Name: "ip_allowlist"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := policyStore.TouchRelationship(tc.relationship); err == nil {
+				t.Error("Expected the relationship to be rejected")
+			}
+		})
+	}
+
+	t.Run("Invalid expression", func(t *testing.T) {
+		err := schema.NewSchema().AddCaveat(&schema.Caveat{
+			Name:       "broken",
+			Parameters: map[string]schema.CaveatParameterType{"a": schema.CaveatTypeInt},
+			Expression: "a < b",
+		})
+		if err == nil {
+			t.Error("Expected a caveat using an undeclared parameter to be rejected")
+		}
+	})
+}
+
+func TestCaveatPartialEvaluation(t *testing.T) {
+	parameters := map[string]schema.CaveatParameterType{
+		"a": schema.CaveatTypeBool,
+		"b": schema.CaveatTypeBool,
+		"c": schema.CaveatTypeInt,
+	}
+
+	testCases := []struct {
+		name       string
+		expression string
+		values     map[string]any
+		allowed    bool
+		// Parameters reported as missing, or nil if the caveat is decided
+		missing []string
+	}{
+		{name: "Or with a true operand", expression: "a || b", values: map[string]any{"a": true}, allowed: true},
+		{name: "Or with a true right operand", expression: "a || b", values: map[string]any{"b": true}, allowed: true},
+		{name: "Or with a false operand", expression: "a || b", values: map[string]any{"a": false}, missing: []string{"b"}},
+		{name: "And with a false operand", expression: "a && b", values: map[string]any{"a": false}, allowed: false},
+		{name: "And with a false right operand", expression: "a && b", values: map[string]any{"b": false}, allowed: false},
+		{name: "And with a true operand", expression: "a && b", values: map[string]any{"a": true}, missing: []string{"b"}},
+		{name: "No values", expression: "a && (b || c > 1)", missing: []string{"a", "b", "c"}},
+		{name: "Decided nested operand", expression: "a && (b || c > 1)", values: map[string]any{"a": true, "b": true}, allowed: true},
+		{name: "Comparison", expression: "!(c > 1) || b", values: map[string]any{"b": false}, missing: []string{"c"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			caveat := &schema.Caveat{Name: "flags", Parameters: parameters, Expression: tc.expression}
+			allowed, err := caveat.Evaluate(tc.values)
+			var missing *schema.MissingCaveatParametersError
+			if tc.missing != nil {
+				if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Parameters, tc.missing) {
+					t.Fatalf("Expected missing parameters %v, got %v", tc.missing, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Evaluate failed: %v", err)
+			}
+			if allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// sampleStore creates a store with the default schema and sample data
+func sampleStore(t *testing.T, options policy.StoreOptions) *policy.Store {
+	t.Helper()
+
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStoreWithOptions(schemaStore, options)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+	return policyStore
+}
+
+// checkWith checks whether a subject can view document:report with the given consistency
+func checkWith(t *testing.T, policyStore *policy.Store, subject string, consistency policy.Consistency) *policy.CheckResult {
+	t.Helper()
+
+	result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+		Subject:     subject,
+		Resource:    "document:report",
+		Action:      "view",
+		Consistency: consistency,
+	})
+	if err != nil {
+		t.Fatalf("CheckPermission failed: %v", err)
+	}
+	return result
+}
+
+func TestCheckCache(t *testing.T) {
+	policyStore := sampleStore(t, policy.StoreOptions{})
+
+	first := checkWith(t, policyStore, "user:zoe", policy.Consistency{})
+	if first.Stats.CacheHits != 0 || first.Stats.Dispatches == 0 {
+		t.Errorf("Expected the first check to be evaluated, got %+v", first.Stats)
+	}
+	second := checkWith(t, policyStore, "user:zoe", policy.Consistency{})
+	if second.Stats.Dispatches != 0 || second.Stats.CacheHits == 0 {
+		t.Errorf("Expected the second check to be answered from the cache, got %+v", second.Stats)
+	}
+	if second.Allowed {
+		t.Errorf("Expected user:zoe to be denied")
+	}
+
+	stats := policyStore.CacheStats()
+	if !stats.Enabled || stats.Hits != int64(second.Stats.CacheHits) || stats.HitRatio <= 0 || stats.HitRatio >= 1 {
+		t.Errorf("Expected hits of the second check in the statistics, got %+v", stats)
+	}
+
+	t.Run("Write", func(t *testing.T) {
+		// A write moves the head revision, whose results are not cached yet
+		if _, err := policyStore.AddRelationship("group:frontend", "member", "user:zoe"); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+		result := checkWith(t, policyStore, "user:zoe", policy.Consistency{})
+		if !result.Allowed {
+			t.Errorf("Expected user:zoe to be allowed after the write")
+		}
+		if result.Stats.Dispatches == 0 {
+			t.Errorf("Expected the check to be evaluated at the new revision, got %+v", result.Stats)
+		}
+	})
+
+	t.Run("Contextual relationships", func(t *testing.T) {
+		result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:                 "user:yuki",
+			Resource:                "document:report",
+			Action:                  "view",
+			ContextualRelationships: []policy.Relationship{{Resource: "group:frontend", Relation: "member", Subject: "user:yuki"}},
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		if !result.Allowed || result.Stats.CacheHits != 0 {
+			t.Errorf("Expected the contextual check to be evaluated, got %+v", result)
+		}
+		if checkWith(t, policyStore, "user:yuki", policy.Consistency{}).Allowed {
+			t.Errorf("Expected the contextual relationship not to be cached")
+		}
+	})
+
+	t.Run("Expiring relationship", func(t *testing.T) {
+		if _, err := policyStore.AddExpiringRelationship("document:report", "viewer", "user:kai", time.Now().Add(100*time.Millisecond)); err != nil {
+			t.Fatalf("AddExpiringRelationship failed: %v", err)
+		}
+		if !checkWith(t, policyStore, "user:kai", policy.Consistency{}).Allowed {
+			t.Errorf("Expected access before expiry")
+		}
+
+		time.Sleep(150 * time.Millisecond)
+
+		// The revision is unchanged, but the cached result expired with the relationship
+		if checkWith(t, policyStore, "user:kai", policy.Consistency{}).Allowed {
+			t.Errorf("Expected no access after expiry")
+		}
+	})
+}
+
+func TestCheckCacheEviction(t *testing.T) {
+	policyStore := sampleStore(t, policy.StoreOptions{CheckCacheSize: 4})
+
+	for _, subject := range []string{"user:alice", "user:bob", "user:charlie", "user:dave", "user:eve"} {
+		checkWith(t, policyStore, subject, policy.Consistency{})
+	}
+
+	stats := policyStore.CacheStats()
+	if stats.Size != 4 || stats.Capacity != 4 || stats.Evictions == 0 {
+		t.Errorf("Expected a full cache that evicted entries, got %+v", stats)
+	}
+}
+
+func TestCheckCacheQuantization(t *testing.T) {
+	policyStore := sampleStore(t, policy.StoreOptions{QuantizationWindow: time.Hour})
+
+	before := checkWith(t, policyStore, "user:zoe", policy.Consistency{})
+	written, err := policyStore.AddRelationship("group:frontend", "member", "user:zoe")
+	if err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		consistency policy.Consistency
+		stale       bool
+	}{
+		{name: "Minimize latency", consistency: policy.Consistency{}, stale: true},
+		{name: "At least as fresh as an older zookie", consistency: policy.Consistency{Mode: policy.AtLeastAsFresh, Zookie: before.ZookieToken}, stale: true},
+		{name: "At least as fresh as the write", consistency: policy.Consistency{Mode: policy.AtLeastAsFresh, Zookie: written}},
+		{name: "At the snapshot of the write", consistency: policy.Consistency{Mode: policy.AtExactSnapshot, Zookie: written}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := checkWith(t, policyStore, "user:zoe", tc.consistency)
+			if tc.stale {
+				// Reads within the window share the revision of the first one
+				if result.Revision != before.Revision || result.Allowed || result.Stats.CacheHits == 0 {
+					t.Errorf("Expected the cached result at revision %d, got %+v", before.Revision, result)
+				}
+				return
+			}
+			if result.Revision <= before.Revision || !result.Allowed {
+				t.Errorf("Expected the write to be observed, got %+v", result)
+			}
+		})
+	}
+}
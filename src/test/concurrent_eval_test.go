@@ -0,0 +1,93 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+)
+
+// slowDatastore delays reads of one resource and relation, to simulate a slow branch
+type slowDatastore struct {
+	datastore.Datastore
+	resource string
+	relation string
+	delay    time.Duration
+}
+
+func (d *slowDatastore) SnapshotReader(revision datastore.Revision) (datastore.Reader, error) {
+	reader, err := d.Datastore.SnapshotReader(revision)
+	if err != nil {
+		return nil, err
+	}
+	return &slowReader{Reader: reader, datastore: d}, nil
+}
+
+type slowReader struct {
+	datastore.Reader
+	datastore *slowDatastore
+}
+
+func (r *slowReader) QueryTuples(filter datastore.Filter) ([]datastore.Tuple, error) {
+	if filter.Resource == r.datastore.resource && filter.Relation == r.datastore.relation {
+		time.Sleep(r.datastore.delay)
+	}
+	return r.Reader.QueryTuples(filter)
+}
+
+func TestConcurrentEvaluation(t *testing.T) {
+	// Direct viewers of folder:child are slow to read; the parent branch is fast
+	ds := &slowDatastore{
+		Datastore: datastore.NewMemoryDatastore(),
+		resource:  "folder:child",
+		relation:  "viewer",
+		delay:     time.Second,
+	}
+	policyStore := policy.NewStoreWithOptions(folderSchema(t), policy.StoreOptions{Datastore: ds})
+
+	if _, err := policyStore.AddRelationship("folder:child", "parent", "folder:root"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.AddRelationship("folder:root", "viewer", "user:alice"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	t.Run("Union short-circuits on the fast branch", func(t *testing.T) {
+		start := time.Now()
+		result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:  "user:alice",
+			Resource: "folder:child",
+			Action:   "view",
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected access through the parent folder")
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected the check to finish without waiting for the slow branch, took %v", elapsed)
+		}
+	})
+
+	t.Run("Deadline stops the evaluation", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := policyStore.CheckPermission(ctx, policy.CheckRequest{
+			Subject:  "user:bob",
+			Resource: "folder:child",
+			Action:   "view",
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected the check to stop at the deadline, took %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// networkSchema has relations that admit users conditioned on the network of the request,
+// combined by a union, an intersection and an exclusion
+func networkSchema(t *testing.T) *schema.Schema {
+	t.Helper()
+
+	s := schema.NewSchema()
+	if err := s.AddCaveat(&schema.Caveat{
+		Name:       "on_network",
+		Parameters: map[string]schema.CaveatParameterType{"ip": schema.CaveatTypeIPAddress, "cidr": schema.CaveatTypeString},
+		Expression: "ip_in_range(ip, cidr)",
+	}); err != nil {
+		t.Fatalf("AddCaveat failed: %v", err)
+	}
+
+	subjects := []schema.Subject{{Type: "user"}, {Type: "user", Caveat: "on_network"}}
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"reader": {Subjects: subjects},
+				"vip":    {Subjects: subjects},
+				"banned": {Subjects: subjects},
+				"either": {UsersetRewrite: schema.NewUnionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("vip"),
+				)},
+				"both": {UsersetRewrite: schema.NewIntersectionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("vip"),
+				)},
+				"unbanned": {UsersetRewrite: schema.NewExclusionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("banned"),
+				)},
+			},
+			Permissions: map[string]schema.Permission{
+				"read":          {Expression: "reader"},
+				"read_either":   {Expression: "either"},
+				"read_both":     {Expression: "both"},
+				"read_unbanned": {Expression: "unbanned"},
+			},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	return s
+}
+
+func TestConditionalChecks(t *testing.T) {
+	policyStore := policy.NewStore(networkSchema(t))
+
+	office := &datastore.ContextualizedCaveat{Name: "on_network", Context: map[string]any{"cidr": "10.0.0.0/8"}}
+	relationships := []policy.Relationship{
+		{Resource: "document:a", Relation: "reader", Subject: "user:alice", Caveat: office},
+		{Resource: "document:a", Relation: "vip", Subject: "user:alice"},
+		{Resource: "document:b", Relation: "reader", Subject: "user:alice", Caveat: office},
+		{Resource: "document:c", Relation: "reader", Subject: "user:alice"},
+		{Resource: "document:c", Relation: "banned", Subject: "user:alice", Caveat: office},
+	}
+	for _, r := range relationships {
+		if _, err := policyStore.TouchRelationship(r); err != nil {
+			t.Fatalf("TouchRelationship failed: %v", err)
+		}
+	}
+
+	inOffice := map[string]any{"ip": "10.0.0.1"}
+	atHome := map[string]any{"ip": "192.168.0.1"}
+	testCases := []struct {
+		name           string
+		resource       string
+		action         string
+		context        map[string]any
+		permissionship policy.Permissionship
+	}{
+		{name: "Caveat without context", resource: "document:a", action: "read", permissionship: policy.ConditionalPermission},
+		{name: "Caveat with context satisfied", resource: "document:a", action: "read", context: inOffice, permissionship: policy.HasPermission},
+		{name: "Caveat with context unsatisfied", resource: "document:a", action: "read", context: atHome, permissionship: policy.NoPermission},
+		{name: "Union with a definite branch", resource: "document:a", action: "read_either", permissionship: policy.HasPermission},
+		{name: "Union of a conditional branch", resource: "document:b", action: "read_either", permissionship: policy.ConditionalPermission},
+		{name: "Intersection with a definite branch", resource: "document:a", action: "read_both", permissionship: policy.ConditionalPermission},
+		{name: "Intersection with a missing branch", resource: "document:b", action: "read_both", permissionship: policy.NoPermission},
+		{name: "Exclusion of a conditional branch", resource: "document:c", action: "read_unbanned", permissionship: policy.ConditionalPermission},
+		{name: "Exclusion of a satisfied branch", resource: "document:c", action: "read_unbanned", context: inOffice, permissionship: policy.NoPermission},
+		{name: "Exclusion of an unsatisfied branch", resource: "document:c", action: "read_unbanned", context: atHome, permissionship: policy.HasPermission},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+				Subject:  "user:alice",
+				Resource: tc.resource,
+				Action:   tc.action,
+				Context:  tc.context,
+			})
+			if err != nil {
+				t.Fatalf("CheckPermission failed: %v", err)
+			}
+			if result.Permissionship != tc.permissionship {
+				t.Errorf("Expected %v, got %v", tc.permissionship, result.Permissionship)
+			}
+			if result.Allowed != (tc.permissionship == policy.HasPermission) {
+				t.Errorf("Expected allowed=%v, got %v", tc.permissionship == policy.HasPermission, result.Allowed)
+			}
+
+			var missing []string
+			if tc.permissionship == policy.ConditionalPermission {
+				missing = []string{"ip"}
+			}
+			if !reflect.DeepEqual(result.MissingContext, missing) {
+				t.Errorf("Expected missing context %v, got %v", missing, result.MissingContext)
+			}
+		})
+	}
+
+	t.Run("Bulk check", func(t *testing.T) {
+		result, err := policyStore.BulkCheck(context.Background(), policy.BulkCheckRequest{
+			Items: []policy.BulkCheckItem{
+				{Subject: "user:alice", Resource: "document:a", Action: "read"},
+				{Subject: "user:alice", Resource: "document:a", Action: "read_either"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("BulkCheck failed: %v", err)
+		}
+		if got := result.Results[0]; got.Permissionship != policy.ConditionalPermission || !reflect.DeepEqual(got.MissingContext, []string{"ip"}) {
+			t.Errorf("Expected a conditional result missing ip, got %+v", got)
+		}
+		if got := result.Results[1]; got.Permissionship != policy.HasPermission {
+			t.Errorf("Expected permission, got %+v", got)
+		}
+	})
+}
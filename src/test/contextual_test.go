@@ -0,0 +1,99 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestContextualRelationships(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+	before, err := policyStore.ListRelationships()
+	if err != nil {
+		t.Fatalf("ListRelationships failed: %v", err)
+	}
+
+	oncall := []policy.Relationship{{Resource: "group:frontend", Relation: "member", Subject: "user:zoe"}}
+	check := func(t *testing.T, contextual []policy.Relationship) (*policy.CheckResult, error) {
+		t.Helper()
+		return policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:                 "user:zoe",
+			Resource:                "document:report",
+			Action:                  "view",
+			ContextualRelationships: contextual,
+		})
+	}
+
+	testCases := []struct {
+		name       string
+		contextual []policy.Relationship
+		allowed    bool
+		err        error
+	}{
+		{name: "Without contextual relationships", allowed: false},
+		{name: "Contextual group membership", contextual: oncall, allowed: true},
+		{
+			name:       "Contextual relationship already stored",
+			contextual: []policy.Relationship{{Resource: "group:frontend", Relation: "member", Subject: "user:dave"}},
+			allowed:    false,
+		},
+		{
+			name:       "Rejected by the schema",
+			contextual: []policy.Relationship{{Resource: "document:report", Relation: "owner", Subject: "group:frontend#member"}},
+			err:        policy.ErrInvalidContextualRelationship,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := check(t, tc.contextual)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("Expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckPermission failed: %v", err)
+			}
+			if result.Allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, result.Allowed)
+			}
+		})
+	}
+
+	t.Run("Bulk check", func(t *testing.T) {
+		result, err := policyStore.BulkCheck(context.Background(), policy.BulkCheckRequest{
+			Items: []policy.BulkCheckItem{
+				{Subject: "user:zoe", Resource: "document:report", Action: "view"},
+				{Subject: "user:zoe", Resource: "document:report", Action: "edit"},
+			},
+			ContextualRelationships: oncall,
+		})
+		if err != nil {
+			t.Fatalf("BulkCheck failed: %v", err)
+		}
+		if !result.Results[0].Allowed || result.Results[1].Allowed {
+			t.Errorf("Expected view but not edit, got %+v", result.Results)
+		}
+	})
+
+	t.Run("Never written", func(t *testing.T) {
+		after, err := policyStore.ListRelationships()
+		if err != nil {
+			t.Fatalf("ListRelationships failed: %v", err)
+		}
+		if len(after) != len(before) {
+			t.Errorf("Expected %d relationships, got %d", len(before), len(after))
+		}
+	})
+}
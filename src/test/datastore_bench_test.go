@@ -0,0 +1,309 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// sliceDatastore is a reference Datastore that keeps every tuple version in a slice
+// and answers every query with a linear scan. It is used as the baseline for the
+// indexed MemoryDatastore benchmarks.
+type sliceDatastore struct {
+	tuples []datastore.Tuple
+	// Position of the live version of each tuple, so that loading large graphs is not quadratic
+	live      map[string]int
+	changelog []datastore.RevisionChanges
+	notify    chan struct{}
+	revision  datastore.Revision
+	// Oldest readable revision after garbage collection
+	minRevision datastore.Revision
+	mu          sync.RWMutex
+}
+
+func (d *sliceDatastore) Write(updates []datastore.Update) (datastore.Revision, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, u := range updates {
+		if u.Operation != datastore.UpdateTouch && u.Operation != datastore.UpdateDelete {
+			return 0, fmt.Errorf("unknown update operation: %s", u.Operation)
+		}
+	}
+
+	if d.live == nil {
+		d.live = make(map[string]int)
+	}
+	if d.notify == nil {
+		d.notify = make(chan struct{})
+	}
+
+	d.revision++
+	now := time.Now()
+	changes := datastore.RevisionChanges{Revision: d.revision, Timestamp: now}
+	for _, u := range updates {
+		key := u.Tuple.Key()
+		index, exists := d.live[key]
+		if exists && u.Operation == datastore.UpdateTouch {
+			if current := d.tuples[index]; !current.SameMetadata(u.Tuple) || current.ExpiredAt(now) {
+				d.tuples[index].DeletedAt = d.revision
+				delete(d.live, key)
+				exists = false
+			}
+		}
+		switch {
+		case u.Operation == datastore.UpdateTouch && !exists:
+			t := u.Tuple
+			t.CreatedAt = d.revision
+			d.tuples = append(d.tuples, t)
+			d.live[key] = len(d.tuples) - 1
+			changes.Updates = append(changes.Updates, datastore.Update{Operation: u.Operation, Tuple: t})
+		case u.Operation == datastore.UpdateDelete && exists:
+			d.tuples[index].DeletedAt = d.revision
+			delete(d.live, key)
+			changes.Updates = append(changes.Updates, datastore.Update{Operation: u.Operation, Tuple: d.tuples[index]})
+		}
+	}
+	d.changelog = append(d.changelog, changes)
+	close(d.notify)
+	d.notify = make(chan struct{})
+	return d.revision, nil
+}
+
+func (d *sliceDatastore) HeadRevision() (datastore.Revision, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.revision, nil
+}
+
+func (d *sliceDatastore) SnapshotReader(revision datastore.Revision) (datastore.Reader, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if revision > d.revision {
+		return nil, datastore.ErrFutureRevision
+	}
+	if revision < d.minRevision {
+		return nil, datastore.ErrSnapshotExpired
+	}
+	return &sliceReader{datastore: d, revision: revision}, nil
+}
+
+func (d *sliceDatastore) Changes(after datastore.Revision) ([]datastore.RevisionChanges, <-chan struct{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if after > d.revision {
+		return nil, nil, datastore.ErrFutureRevision
+	}
+	if after < d.minRevision {
+		return nil, nil, datastore.ErrSnapshotExpired
+	}
+	if d.notify == nil {
+		d.notify = make(chan struct{})
+	}
+
+	var changes []datastore.RevisionChanges
+	for _, c := range d.changelog {
+		if c.Revision > after {
+			changes = append(changes, c)
+		}
+	}
+	return changes, d.notify, nil
+}
+
+func (d *sliceDatastore) ExpiredTuples(now time.Time) ([]datastore.Tuple, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var result []datastore.Tuple
+	for _, index := range d.live {
+		if d.tuples[index].ExpiredAt(now) {
+			result = append(result, d.tuples[index])
+		}
+	}
+	return result, nil
+}
+
+func (d *sliceDatastore) GarbageCollect(before time.Time) (datastore.GCResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for n < len(d.changelog) && !d.changelog[n].Timestamp.After(before) {
+		n++
+	}
+	if n == 0 {
+		return datastore.GCResult{MinRevision: d.minRevision}, nil
+	}
+	d.minRevision = d.changelog[n-1].Revision
+	d.changelog = d.changelog[n:]
+
+	var kept []datastore.Tuple
+	d.live = make(map[string]int)
+	for _, t := range d.tuples {
+		if t.DeletedAt != 0 && t.DeletedAt <= d.minRevision {
+			continue
+		}
+		kept = append(kept, t)
+		if t.DeletedAt == 0 {
+			d.live[t.Key()] = len(kept) - 1
+		}
+	}
+	collected := len(d.tuples) - len(kept)
+	d.tuples = kept
+
+	return datastore.GCResult{MinRevision: d.minRevision, CollectedVersions: collected, CollectedChanges: n}, nil
+}
+
+func (d *sliceDatastore) Close() error {
+	return nil
+}
+
+type sliceReader struct {
+	datastore *sliceDatastore
+	revision  datastore.Revision
+}
+
+func (r *sliceReader) Revision() datastore.Revision {
+	return r.revision
+}
+
+func (r *sliceReader) QueryTuples(filter datastore.Filter) ([]datastore.Tuple, error) {
+	r.datastore.mu.RLock()
+	defer r.datastore.mu.RUnlock()
+	if r.revision < r.datastore.minRevision {
+		return nil, datastore.ErrSnapshotExpired
+	}
+
+	now := time.Now()
+	var result []datastore.Tuple
+	for _, t := range r.datastore.tuples {
+		if t.VisibleAt(r.revision) && !t.ExpiredAt(now) && filter.Matches(t) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+func TestSliceDatastoreConformance(t *testing.T) {
+	runDatastoreConformance(t, func(t *testing.T) datastore.Datastore {
+		return &sliceDatastore{}
+	})
+}
+
+// syntheticGroupDepth is the nesting depth of the benchmark group chain
+const syntheticGroupDepth = 8
+
+// loadSyntheticGraph fills the datastore with roughly size tuples: a chain of nested
+// groups granting view access on one document, plus unrelated documents and folders.
+func loadSyntheticGraph(b *testing.B, ds datastore.Datastore, size int) {
+	b.Helper()
+
+	var updates []datastore.Update
+	add := func(resource, relation, subject string) {
+		updates = append(updates, datastore.Update{
+			Operation: datastore.UpdateTouch,
+			Tuple:     datastore.Tuple{Resource: resource, Relation: relation, Subject: subject},
+		})
+	}
+
+	// group:level0 <- group:level1#member <- ... <- user:target
+	for level := 0; level < syntheticGroupDepth-1; level++ {
+		add(fmt.Sprintf("group:level%d", level), "member", fmt.Sprintf("group:level%d#member", level+1))
+	}
+	add(fmt.Sprintf("group:level%d", syntheticGroupDepth-1), "member", "user:target")
+	add("document:target", "viewer", "group:level0#member")
+
+	for i := 0; len(updates) < size; i++ {
+		doc := fmt.Sprintf("document:doc%d", i)
+		add(doc, "owner", fmt.Sprintf("user:user%d", i))
+		add(doc, "parent", fmt.Sprintf("folder:folder%d", i%100))
+		add(fmt.Sprintf("group:team%d", i%500), "member", fmt.Sprintf("user:user%d", i))
+	}
+
+	const batchSize = 1000
+	for start := 0; start < len(updates); start += batchSize {
+		end := start + batchSize
+		if end > len(updates) {
+			end = len(updates)
+		}
+		if _, err := ds.Write(updates[start:end]); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+// benchmarkBackends lists the datastores compared by the benchmarks
+var benchmarkBackends = []struct {
+	name string
+	new  func() datastore.Datastore
+}{
+	{name: "scan", new: func() datastore.Datastore { return &sliceDatastore{} }},
+	{name: "indexed", new: func() datastore.Datastore { return datastore.NewMemoryDatastore() }},
+}
+
+// BenchmarkCheckNestedGroups checks access granted through the nested group chain
+func BenchmarkCheckNestedGroups(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		for _, backend := range benchmarkBackends {
+			b.Run(fmt.Sprintf("%s/tuples=%d", backend.name, size), func(b *testing.B) {
+				schemaStore := schema.LoadDefaultSchema()
+				if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+					b.Fatalf("Failed to update schema: %v", err)
+				}
+				ds := backend.new()
+				loadSyntheticGraph(b, ds, size)
+				// Evaluate every check against the datastore, without the check cache
+				// or the Leopard index answering it
+				store := policy.NewStoreWithOptions(schemaStore, policy.StoreOptions{
+					Datastore:           ds,
+					DisableCheckCache:   true,
+					DisableLeopardIndex: true,
+				})
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					allowed, _, err := store.Check("user:target", "document:target", "view")
+					if err != nil {
+						b.Fatalf("Check failed: %v", err)
+					}
+					if !allowed {
+						b.Fatalf("Expected user:target to view document:target")
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkQueryByResourceRelation measures the lookup used for direct relation checks
+func BenchmarkQueryByResourceRelation(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		for _, backend := range benchmarkBackends {
+			b.Run(fmt.Sprintf("%s/tuples=%d", backend.name, size), func(b *testing.B) {
+				ds := backend.new()
+				loadSyntheticGraph(b, ds, size)
+				head, err := ds.HeadRevision()
+				if err != nil {
+					b.Fatalf("HeadRevision failed: %v", err)
+				}
+				reader, err := ds.SnapshotReader(head)
+				if err != nil {
+					b.Fatalf("SnapshotReader failed: %v", err)
+				}
+				filter := datastore.Filter{Resource: "document:doc0", Relation: "owner"}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := reader.QueryTuples(filter); err != nil {
+						b.Fatalf("QueryTuples failed: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
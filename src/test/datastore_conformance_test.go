@@ -0,0 +1,386 @@
+package test
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+)
+
+func TestMemoryDatastoreConformance(t *testing.T) {
+	runDatastoreConformance(t, func(t *testing.T) datastore.Datastore {
+		return datastore.NewMemoryDatastore()
+	})
+}
+
+// runDatastoreConformance runs the behaviour every Datastore implementation must provide
+func runDatastoreConformance(t *testing.T, newDatastore func(t *testing.T) datastore.Datastore) {
+	t.Run("EmptyHeadRevision", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		revision, err := ds.HeadRevision()
+		if err != nil {
+			t.Fatalf("HeadRevision failed: %v", err)
+		}
+		if revision != 0 {
+			t.Errorf("Expected head revision 0, got %d", revision)
+		}
+
+		tuples := queryAtHead(t, ds, datastore.Filter{})
+		if len(tuples) != 0 {
+			t.Errorf("Expected no tuples, got %d", len(tuples))
+		}
+	})
+
+	t.Run("WriteAdvancesRevision", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		first := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+		second := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:b", "owner", "user:alice"))
+		if second <= first {
+			t.Errorf("Expected revision to increase, got %d then %d", first, second)
+		}
+
+		head, err := ds.HeadRevision()
+		if err != nil {
+			t.Fatalf("HeadRevision failed: %v", err)
+		}
+		if head != second {
+			t.Errorf("Expected head revision %d, got %d", second, head)
+		}
+	})
+
+	t.Run("TouchIsIdempotent", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		first := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+		writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+
+		tuples := queryAtHead(t, ds, datastore.Filter{})
+		if len(tuples) != 1 {
+			t.Fatalf("Expected 1 tuple, got %d", len(tuples))
+		}
+		if tuples[0].CreatedAt != first {
+			t.Errorf("Expected tuple to keep revision %d, got %d", first, tuples[0].CreatedAt)
+		}
+	})
+
+	t.Run("WriteIsAtomic", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		revision := writeTuples(t, ds, datastore.UpdateTouch,
+			tuple("document:a", "owner", "user:alice"),
+			tuple("document:a", "viewer", "user:bob"),
+		)
+
+		for _, tp := range queryAtHead(t, ds, datastore.Filter{}) {
+			if tp.CreatedAt != revision {
+				t.Errorf("Expected %s at revision %d, got %d", tp.Key(), revision, tp.CreatedAt)
+			}
+		}
+
+		_, err := ds.Write([]datastore.Update{
+			{Operation: datastore.UpdateTouch, Tuple: tuple("document:b", "owner", "user:alice")},
+			{Operation: "BOGUS", Tuple: tuple("document:c", "owner", "user:alice")},
+		})
+		if err == nil {
+			t.Fatalf("Expected write with unknown operation to fail")
+		}
+		if tuples := queryAtHead(t, ds, datastore.Filter{Resource: "document:b"}); len(tuples) != 0 {
+			t.Errorf("Expected failed write to leave no tuples, got %d", len(tuples))
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		writeTuples(t, ds, datastore.UpdateTouch,
+			tuple("document:a", "owner", "user:alice"),
+			tuple("document:a", "viewer", "user:bob"),
+		)
+		writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:alice"))
+		// Deleting a missing tuple is a no-op
+		writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:nobody"))
+
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{}), "document:a#viewer@user:bob")
+	})
+
+	t.Run("SnapshotReadsAtRevision", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		first := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+		second := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "viewer", "user:bob"))
+		third := writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:alice"))
+		fourth := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+
+		assertKeys(t, queryAt(t, ds, 0, datastore.Filter{}))
+		assertKeys(t, queryAt(t, ds, first, datastore.Filter{}), "document:a#owner@user:alice")
+		assertKeys(t, queryAt(t, ds, second, datastore.Filter{}), "document:a#owner@user:alice", "document:a#viewer@user:bob")
+		assertKeys(t, queryAt(t, ds, third, datastore.Filter{Resource: "document:a"}), "document:a#viewer@user:bob")
+		assertKeys(t, queryAt(t, ds, fourth, datastore.Filter{Subject: "user:alice"}), "document:a#owner@user:alice")
+
+		// The recreated tuple is a new version with its own creation revision
+		recreated := queryAt(t, ds, fourth, datastore.Filter{Resource: "document:a", Relation: "owner", Subject: "user:alice"})
+		if len(recreated) != 1 || recreated[0].CreatedAt != fourth {
+			t.Errorf("Expected one version created at %d, got %v", fourth, recreated)
+		}
+		original := queryAt(t, ds, second, datastore.Filter{Resource: "document:a", Relation: "owner", Subject: "user:alice"})
+		if len(original) != 1 || original[0].CreatedAt != first {
+			t.Errorf("Expected one version created at %d, got %v", first, original)
+		}
+	})
+
+	t.Run("SnapshotReaderRejectsFutureRevision", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		head := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+		if _, err := ds.SnapshotReader(head + 1); !errors.Is(err, datastore.ErrFutureRevision) {
+			t.Errorf("Expected ErrFutureRevision, got %v", err)
+		}
+	})
+
+	t.Run("ChangesAfterRevision", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		first := writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+		_, notify, err := ds.Changes(first)
+		if err != nil {
+			t.Fatalf("Changes failed: %v", err)
+		}
+
+		// Touching an existing tuple changes nothing
+		second := writeTuples(t, ds, datastore.UpdateTouch,
+			tuple("document:a", "owner", "user:alice"),
+			tuple("document:a", "viewer", "user:bob"),
+		)
+		third := writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:alice"))
+
+		select {
+		case <-notify:
+		default:
+			t.Errorf("Expected the notify channel to be closed after a write")
+		}
+
+		changes, _, err := ds.Changes(first)
+		if err != nil {
+			t.Fatalf("Changes failed: %v", err)
+		}
+		if len(changes) != 2 || changes[0].Revision != second || changes[1].Revision != third {
+			t.Fatalf("Expected changes at revisions %d and %d, got %v", second, third, changes)
+		}
+		if len(changes[0].Updates) != 1 || changes[0].Updates[0].Operation != datastore.UpdateTouch ||
+			changes[0].Updates[0].Tuple.Key() != "document:a#viewer@user:bob" {
+			t.Errorf("Unexpected changes at revision %d: %v", second, changes[0].Updates)
+		}
+		if len(changes[1].Updates) != 1 || changes[1].Updates[0].Operation != datastore.UpdateDelete ||
+			changes[1].Updates[0].Tuple.Key() != "document:a#owner@user:alice" {
+			t.Errorf("Unexpected changes at revision %d: %v", third, changes[1].Updates)
+		}
+
+		if _, _, err := ds.Changes(third + 1); !errors.Is(err, datastore.ErrFutureRevision) {
+			t.Errorf("Expected ErrFutureRevision, got %v", err)
+		}
+	})
+
+	t.Run("QueryFilters", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		writeTuples(t, ds, datastore.UpdateTouch,
+			tuple("document:a", "owner", "user:alice"),
+			tuple("document:a", "viewer", "user:bob"),
+			tuple("document:b", "viewer", "user:bob"),
+			tuple("folder:x", "viewer", "user:bob"),
+			tuple("group:eng", "member", "user:alice"),
+			tuple("document:c", "viewer", "user:carol"),
+			tuple("document:c", "viewer", "group:eng#member"),
+			tuple("document:c", "viewer", "user:*"),
+			tuple("document:c", "owner", "group:eng#member"),
+		)
+
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{Resource: "document:a"}),
+			"document:a#owner@user:alice", "document:a#viewer@user:bob")
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{Resource: "document:a", Relation: "viewer"}),
+			"document:a#viewer@user:bob")
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{Resource: "document:c", Relation: "viewer", IndirectSubjects: true}),
+			"document:c#viewer@group:eng#member", "document:c#viewer@user:*")
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{Subject: "user:bob"}),
+			"document:a#viewer@user:bob", "document:b#viewer@user:bob", "folder:x#viewer@user:bob")
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{ResourceType: "document", Relation: "viewer"}),
+			"document:a#viewer@user:bob", "document:b#viewer@user:bob",
+			"document:c#viewer@group:eng#member", "document:c#viewer@user:*", "document:c#viewer@user:carol")
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{ResourceType: "group", Relation: "member", Subject: "user:alice"}),
+			"group:eng#member@user:alice")
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{Resource: "document:zzz"}))
+	})
+
+	t.Run("ExpiringTuples", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		expiring := tuple("document:a", "viewer", "user:bob")
+		expiring.ExpiresAt = time.Now().Add(50 * time.Millisecond)
+		writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"), expiring)
+
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{}), "document:a#owner@user:alice", "document:a#viewer@user:bob")
+		expired, err := ds.ExpiredTuples(time.Now())
+		if err != nil {
+			t.Fatalf("ExpiredTuples failed: %v", err)
+		}
+		assertKeys(t, expired)
+
+		// Expired tuples are hidden from reads before they are deleted
+		time.Sleep(60 * time.Millisecond)
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{}), "document:a#owner@user:alice")
+		expired, err = ds.ExpiredTuples(time.Now())
+		if err != nil {
+			t.Fatalf("ExpiredTuples failed: %v", err)
+		}
+		assertKeys(t, expired, "document:a#viewer@user:bob")
+
+		// Touching an expired tuple writes a new version
+		renewed := tuple("document:a", "viewer", "user:bob")
+		renewed.ExpiresAt = time.Now().Add(time.Hour)
+		revision := writeTuples(t, ds, datastore.UpdateTouch, renewed)
+		tuples := queryAtHead(t, ds, datastore.Filter{Relation: "viewer"})
+		if len(tuples) != 1 || tuples[0].CreatedAt != revision || !tuples[0].ExpiresAt.Equal(renewed.ExpiresAt) {
+			t.Errorf("Expected renewed tuple at revision %d, got %+v", revision, tuples)
+		}
+		expired, err = ds.ExpiredTuples(time.Now())
+		if err != nil {
+			t.Fatalf("ExpiredTuples failed: %v", err)
+		}
+		assertKeys(t, expired)
+	})
+
+	t.Run("GarbageCollect", func(t *testing.T) {
+		ds := newDatastore(t)
+		defer ds.Close()
+
+		writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+		writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:alice"))
+		cutoff := time.Now()
+		time.Sleep(time.Millisecond)
+		writeTuples(t, ds, datastore.UpdateTouch, tuple("document:b", "owner", "user:alice"))
+
+		result, err := ds.GarbageCollect(cutoff)
+		if err != nil {
+			t.Fatalf("GarbageCollect failed: %v", err)
+		}
+		expected := datastore.GCResult{MinRevision: 2, CollectedVersions: 1, CollectedChanges: 2}
+		if result != expected {
+			t.Errorf("Expected %+v, got %+v", expected, result)
+		}
+
+		if _, err := ds.SnapshotReader(1); !errors.Is(err, datastore.ErrSnapshotExpired) {
+			t.Errorf("Expected ErrSnapshotExpired below the minimum revision, got %v", err)
+		}
+		if _, _, err := ds.Changes(1); !errors.Is(err, datastore.ErrSnapshotExpired) {
+			t.Errorf("Expected ErrSnapshotExpired for changes below the minimum revision, got %v", err)
+		}
+		assertKeys(t, queryAt(t, ds, 2, datastore.Filter{}))
+		assertKeys(t, queryAtHead(t, ds, datastore.Filter{}), "document:b#owner@user:alice")
+
+		changes, _, err := ds.Changes(2)
+		if err != nil {
+			t.Fatalf("Changes failed: %v", err)
+		}
+		if len(changes) != 1 || changes[0].Revision != 3 {
+			t.Errorf("Expected only revision 3 to be retained, got %+v", changes)
+		}
+
+		// Collecting again at the same cutoff finds nothing
+		result, err = ds.GarbageCollect(cutoff)
+		if err != nil {
+			t.Fatalf("GarbageCollect failed: %v", err)
+		}
+		if result.CollectedVersions != 0 || result.CollectedChanges != 0 || result.MinRevision != 2 {
+			t.Errorf("Expected nothing collected at minimum revision 2, got %+v", result)
+		}
+	})
+}
+
+// tuple builds a tuple from its identity fields
+func tuple(resource, relation, subject string) datastore.Tuple {
+	return datastore.Tuple{Resource: resource, Relation: relation, Subject: subject}
+}
+
+// writeTuples applies the same operation to every tuple in a single write
+func writeTuples(t *testing.T, ds datastore.Datastore, op datastore.UpdateOperation, tuples ...datastore.Tuple) datastore.Revision {
+	t.Helper()
+
+	updates := make([]datastore.Update, 0, len(tuples))
+	for _, tp := range tuples {
+		updates = append(updates, datastore.Update{Operation: op, Tuple: tp})
+	}
+
+	revision, err := ds.Write(updates)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	return revision
+}
+
+// queryAtHead queries the datastore at its head revision
+func queryAtHead(t *testing.T, ds datastore.Datastore, filter datastore.Filter) []datastore.Tuple {
+	t.Helper()
+
+	revision, err := ds.HeadRevision()
+	if err != nil {
+		t.Fatalf("HeadRevision failed: %v", err)
+	}
+
+	return queryAt(t, ds, revision, filter)
+}
+
+// queryAt queries the datastore at the given revision
+func queryAt(t *testing.T, ds datastore.Datastore, revision datastore.Revision, filter datastore.Filter) []datastore.Tuple {
+	t.Helper()
+
+	reader, err := ds.SnapshotReader(revision)
+	if err != nil {
+		t.Fatalf("SnapshotReader failed: %v", err)
+	}
+	if reader.Revision() != revision {
+		t.Errorf("Expected reader at revision %d, got %d", revision, reader.Revision())
+	}
+
+	tuples, err := reader.QueryTuples(filter)
+	if err != nil {
+		t.Fatalf("QueryTuples failed: %v", err)
+	}
+	return tuples
+}
+
+// assertKeys checks that the tuples have exactly the expected keys, in any order
+func assertKeys(t *testing.T, tuples []datastore.Tuple, expected ...string) {
+	t.Helper()
+
+	actual := make([]string, 0, len(tuples))
+	for _, tp := range tuples {
+		actual = append(actual, tp.Key())
+	}
+	sort.Strings(actual)
+	sort.Strings(expected)
+
+	if len(actual) != len(expected) {
+		t.Errorf("Expected tuples %v, got %v", expected, actual)
+		return
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected tuples %v, got %v", expected, actual)
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// folderSchema returns a schema where folder viewers inherit from the parent folder,
+// and where document editor and viewer are defined in terms of each other
+func folderSchema(t *testing.T) *schema.Schema {
+	t.Helper()
+
+	s := schema.NewSchema()
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "folder",
+			Relations: map[string]schema.Relation{
+				"parent": {Subjects: []schema.Subject{{Type: "folder"}}},
+				"viewer": {
+					Subjects: []schema.Subject{{Type: "user"}},
+					UsersetRewrite: schema.NewUnionRewrite(
+						schema.NewThisRewrite(),
+						schema.NewTupleToUsersetRewrite("parent", "viewer"),
+					),
+				},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "viewer"}},
+		},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"editor": {Subjects: []schema.Subject{{Type: "user"}}, UsersetRewrite: schema.NewComputedUsersetRewrite("viewer")},
+				"viewer": {Subjects: []schema.Subject{{Type: "user"}}, UsersetRewrite: schema.NewComputedUsersetRewrite("editor")},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "viewer"}},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	return s
+}
+
+func TestEvaluationLimits(t *testing.T) {
+	policyStore := policy.NewStoreWithOptions(folderSchema(t), policy.StoreOptions{MaxDepth: 5})
+
+	// folder:0 -> folder:1 -> ... -> folder:9, viewer on the last one
+	for i := 0; i < 9; i++ {
+		if _, err := policyStore.AddRelationship(fmt.Sprintf("folder:%d", i), "parent", fmt.Sprintf("folder:%d", i+1)); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+	if _, err := policyStore.AddRelationship("folder:9", "viewer", "user:alice"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	// folder:a and folder:b are each other's parent
+	if _, err := policyStore.AddRelationship("folder:a", "parent", "folder:b"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.AddRelationship("folder:b", "parent", "folder:a"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		resource string
+		check    func(err error) bool
+		allowed  bool
+	}{
+		{
+			name:     "Within max depth",
+			resource: "folder:6",
+			check:    func(err error) bool { return err == nil },
+			allowed:  true,
+		},
+		{
+			name:     "Parent chain deeper than max depth",
+			resource: "folder:0",
+			check: func(err error) bool {
+				var target *policy.MaxDepthExceededError
+				return errors.As(err, &target) && target.MaxDepth == 5
+			},
+		},
+		{
+			name:     "Cyclic parent relationships",
+			resource: "folder:a",
+			check: func(err error) bool {
+				var target *policy.CycleDetectedError
+				return errors.As(err, &target)
+			},
+		},
+		{
+			name:     "Cyclic computed usersets in the schema",
+			resource: "document:plan",
+			check: func(err error) bool {
+				var target *policy.CycleDetectedError
+				return errors.As(err, &target) && len(target.Path) == 3
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, _, err := policyStore.Check("user:alice", tc.resource, "view")
+			if !tc.check(err) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestExpandTree(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+
+	expand := func(t *testing.T, relation string, depth int) *policy.UsersetTree {
+		t.Helper()
+		tree, _, err := policyStore.ExpandTree(context.Background(), policy.ExpandTreeRequest{
+			Resource: "document:report",
+			Relation: relation,
+			Depth:    depth,
+		})
+		if err != nil {
+			t.Fatalf("ExpandTree failed: %v", err)
+		}
+		return tree
+	}
+
+	t.Run("Permission", func(t *testing.T) {
+		tree := expand(t, "view", 0)
+		if tree.Type != policy.UsersetTreeUnion || tree.Object != "document:report" || tree.Relation != "view" {
+			t.Fatalf("Unexpected root node %+v", tree)
+		}
+		var relations []string
+		for _, child := range tree.Children {
+			relations = append(relations, child.Relation)
+		}
+		if expected := []string{"owner", "editor", "viewer"}; !reflect.DeepEqual(relations, expected) {
+			t.Errorf("Expected children %v, got %v", expected, relations)
+		}
+		if owner := tree.Children[0]; owner.Type != policy.UsersetTreeLeaf || !reflect.DeepEqual(owner.Subjects, []string{"user:alice"}) {
+			t.Errorf("Expected the owner leaf to hold user:alice, got %+v", owner)
+		}
+
+		expected := []string{"user:alice", "user:bob", "user:charlie", "user:dave", "user:eve"}
+		if subjects := leafSubjects(tree); !reflect.DeepEqual(subjects, expected) {
+			t.Errorf("Expected leaves %v, got %v", expected, subjects)
+		}
+	})
+
+	t.Run("Relation with rewrite", func(t *testing.T) {
+		tree := expand(t, "viewer", 0)
+		if tree.Type != policy.UsersetTreeUnion || len(tree.Children) != 3 {
+			t.Fatalf("Expected viewer = this | editor | parent->viewer, got %+v", tree)
+		}
+		parent := tree.Children[2]
+		if len(parent.Children) != 1 || parent.Children[0].Object != "folder:projects" || parent.Children[0].Relation != "viewer" {
+			t.Errorf("Expected the parent folder's viewers, got %+v", parent)
+		}
+	})
+
+	t.Run("Depth", func(t *testing.T) {
+		tree := expand(t, "view", 1)
+		expected := []string{"document:report#editor", "document:report#owner", "document:report#viewer"}
+		if subjects := leafSubjects(tree); !reflect.DeepEqual(subjects, expected) {
+			t.Errorf("Expected references %v, got %v", expected, subjects)
+		}
+	})
+}
+
+func TestExpandTreeStopsAtCycles(t *testing.T) {
+	policyStore := policy.NewStore(folderSchema(t))
+	if _, err := policyStore.AddRelationship("document:a", "viewer", "user:alice"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	// editor and viewer are computed from each other
+	tree, _, err := policyStore.ExpandTree(context.Background(), policy.ExpandTreeRequest{Resource: "document:a", Relation: "viewer"})
+	if err != nil {
+		t.Fatalf("ExpandTree failed: %v", err)
+	}
+	if subjects := leafSubjects(tree); !reflect.DeepEqual(subjects, []string{"document:a#viewer"}) {
+		t.Errorf("Expected the cycle to end in a reference to document:a#viewer, got %v", subjects)
+	}
+}
+
+// leafSubjects returns the distinct subjects of every leaf of the tree, in order
+func leafSubjects(tree *policy.UsersetTree) []string {
+	seen := make(map[string]bool)
+	var walk func(node *policy.UsersetTree)
+	walk = func(node *policy.UsersetTree) {
+		for _, subject := range node.Subjects {
+			seen[subject] = true
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(tree)
+
+	subjects := make([]string, 0, len(seen))
+	for subject := range seen {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+func TestExpandCaveatedRelationships(t *testing.T) {
+	s := schema.NewSchema()
+	if err := s.AddCaveat(&schema.Caveat{
+		Name:       "on_network",
+		Parameters: map[string]schema.CaveatParameterType{"ip": schema.CaveatTypeIPAddress, "cidr": schema.CaveatTypeString},
+		Expression: "ip_in_range(ip, cidr)",
+	}); err != nil {
+		t.Fatalf("AddCaveat failed: %v", err)
+	}
+	members := []schema.Subject{
+		{Type: "user"},
+		{Type: "user", Caveat: "on_network"},
+		{Type: "group", Relation: "member"},
+		{Type: "group", Relation: "member", Caveat: "on_network"},
+	}
+	for _, def := range []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{Type: "group", Relations: map[string]schema.Relation{"member": {Subjects: members}}},
+		{Type: "document", Relations: map[string]schema.Relation{"viewer": {Subjects: members}}},
+	} {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	policyStore := policy.NewStore(s)
+
+	// group:eng views document:plan from the office network only, but its members
+	// are also reached unconditionally through group:ops
+	office := &datastore.ContextualizedCaveat{Name: "on_network", Context: map[string]any{"cidr": "10.0.0.0/8"}}
+	relationships := []policy.Relationship{
+		{Resource: "document:plan", Relation: "viewer", Subject: "user:alice", Caveat: office},
+		{Resource: "document:plan", Relation: "viewer", Subject: "user:bob"},
+		{Resource: "document:plan", Relation: "viewer", Subject: "group:eng#member", Caveat: office},
+		{Resource: "document:report", Relation: "viewer", Subject: "group:eng#member", Caveat: office},
+		{Resource: "document:report", Relation: "viewer", Subject: "group:ops#member"},
+		{Resource: "group:eng", Relation: "member", Subject: "user:carol"},
+		{Resource: "group:eng", Relation: "member", Subject: "user:dan", Caveat: office},
+		{Resource: "group:ops", Relation: "member", Subject: "group:eng#member"},
+	}
+	for _, r := range relationships {
+		if _, err := policyStore.TouchRelationship(r); err != nil {
+			t.Fatalf("TouchRelationship failed: %v", err)
+		}
+	}
+
+	t.Run("Tree", func(t *testing.T) {
+		tree, _, err := policyStore.ExpandTree(context.Background(), policy.ExpandTreeRequest{Resource: "document:plan", Relation: "viewer"})
+		if err != nil {
+			t.Fatalf("ExpandTree failed: %v", err)
+		}
+		if tree.Type != policy.UsersetTreeUnion || len(tree.Children) != 3 {
+			t.Fatalf("Expected the plain leaf, the caveated leaf and the group, got %+v", tree)
+		}
+		if plain := tree.Children[0]; plain.Caveat != nil || !reflect.DeepEqual(plain.Subjects, []string{"user:bob"}) {
+			t.Errorf("Expected user:bob in an unconditional leaf, got %+v", plain)
+		}
+		if alice := tree.Children[1]; alice.Caveat == nil || alice.Caveat.Name != "on_network" || !reflect.DeepEqual(alice.Subjects, []string{"user:alice"}) {
+			t.Errorf("Expected user:alice in a leaf conditioned on on_network, got %+v", alice)
+		}
+		group := tree.Children[2]
+		if group.Object != "group:eng" || group.Caveat == nil || group.Caveat.Name != "on_network" {
+			t.Fatalf("Expected group:eng conditioned on on_network, got %+v", group)
+		}
+		if len(group.Children) != 2 || group.Children[0].Caveat != nil || group.Children[1].Caveat == nil ||
+			!reflect.DeepEqual(group.Children[1].Subjects, []string{"user:dan"}) {
+			t.Errorf("Expected user:dan to be conditional within the group, got %+v", group.Children)
+		}
+	})
+
+	testCases := []struct {
+		resource    string
+		subjects    []string
+		conditional map[string][]string
+	}{
+		{
+			resource: "document:plan",
+			subjects: []string{"group:eng#member", "user:alice", "user:bob", "user:carol", "user:dan"},
+			conditional: map[string][]string{
+				"group:eng#member": {"on_network"},
+				"user:alice":       {"on_network"},
+				"user:carol":       {"on_network"},
+				"user:dan":         {"on_network"},
+			},
+		},
+		{
+			resource:    "document:report",
+			subjects:    []string{"group:eng#member", "group:ops#member", "user:carol", "user:dan"},
+			conditional: map[string][]string{"user:dan": {"on_network"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.resource, func(t *testing.T) {
+			subjects, conditional, _, err := policyStore.ExpandWithConsistency(tc.resource, "viewer", policy.Consistency{})
+			if err != nil {
+				t.Fatalf("ExpandWithConsistency failed: %v", err)
+			}
+			sort.Strings(subjects)
+			if !reflect.DeepEqual(subjects, tc.subjects) {
+				t.Errorf("Expected subjects %v, got %v", tc.subjects, subjects)
+			}
+			if !reflect.DeepEqual(conditional, tc.conditional) {
+				t.Errorf("Expected conditional subjects %v, got %v", tc.conditional, conditional)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestExpiringRelationships(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+
+	if _, err := policyStore.AddExpiringRelationship("document:incident", "viewer", "user:bob", time.Now().Add(-time.Minute)); err == nil {
+		t.Errorf("Expected an error for an expiry in the past")
+	}
+
+	start, err := policyStore.AddRelationship("document:incident", "owner", "user:alice")
+	if err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.AddExpiringRelationship("document:incident", "viewer", "user:bob", time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatalf("AddExpiringRelationship failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := policyStore.Watch(ctx, start, policy.WatchFilter{Relation: "viewer"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if event := nextWatchEvent(t, events); event.Type != policy.WatchEventAdd || event.Relationship.ExpiresAt.IsZero() {
+		t.Errorf("Expected add event carrying the expiry, got %+v", event)
+	}
+
+	allowed, _, err := policyStore.Check("user:bob", "document:incident", "view")
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !allowed {
+		t.Errorf("Expected access before expiry")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// Expired relationships are absent right away, before any sweep
+	allowed, _, err = policyStore.Check("user:bob", "document:incident", "view")
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if allowed {
+		t.Errorf("Expected no access after expiry")
+	}
+	subjects, err := policyStore.Expand("document:incident", "viewer")
+	if err != nil {
+		t.Fatalf("Expand failed: %v", err)
+	}
+	if len(subjects) != 0 {
+		t.Errorf("Expected no viewers after expiry, got %v", subjects)
+	}
+	relationships, err := policyStore.ListRelationships()
+	if err != nil {
+		t.Fatalf("ListRelationships failed: %v", err)
+	}
+	if len(relationships) != 1 {
+		t.Errorf("Expected only the owner to be listed, got %v", relationships)
+	}
+
+	// Sweeping purges the tuple and records the deletion as a change event
+	swept, err := policyStore.SweepExpired()
+	if err != nil {
+		t.Fatalf("SweepExpired failed: %v", err)
+	}
+	if swept != 1 {
+		t.Errorf("Expected 1 relationship swept, got %d", swept)
+	}
+	if event := nextWatchEvent(t, events); event.Type != policy.WatchEventDelete || event.Relationship.Subject != "user:bob" {
+		t.Errorf("Expected delete event for user:bob, got %+v", event)
+	}
+	if swept, _ := policyStore.SweepExpired(); swept != 0 {
+		t.Errorf("Expected nothing left to sweep, got %d", swept)
+	}
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestCheckExplain(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+
+	explain := func(t *testing.T, subject string, explain bool) *policy.CheckResult {
+		t.Helper()
+		result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:  subject,
+			Resource: "document:report",
+			Action:   "view",
+			Explain:  explain,
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		return result
+	}
+
+	t.Run("Without explain", func(t *testing.T) {
+		if result := explain(t, "user:eve", false); result.Trace != nil {
+			t.Errorf("Expected no trace, got %+v", result.Trace)
+		}
+	})
+
+	t.Run("Allowed through parent folder", func(t *testing.T) {
+		trace := explain(t, "user:eve", true).Trace
+		if trace == nil {
+			t.Fatalf("Expected a trace")
+		}
+		if trace.Type != policy.TraceNodePermission || trace.Object != "document:report" || trace.Relation != "view" || !trace.Result {
+			t.Errorf("Unexpected root node %+v", trace)
+		}
+
+		ttu := findTraceNode(trace, func(n *policy.TraceNode) bool {
+			return n.Type == string(schema.UsersetRewriteTupleToUserset) && n.Result
+		})
+		if ttu == nil {
+			t.Fatalf("Expected a successful tuple_to_userset node")
+		}
+		if len(ttu.Tuples) != 1 || ttu.Tuples[0] != "document:report#parent@folder:projects" {
+			t.Errorf("Expected the parent tuple to be consulted, got %v", ttu.Tuples)
+		}
+		if ttu.Duration == "" {
+			t.Errorf("Expected time spent to be recorded")
+		}
+	})
+
+	t.Run("Denied visits every relation", func(t *testing.T) {
+		trace := explain(t, "user:zoe", true).Trace
+		if trace.Result {
+			t.Errorf("Expected a denied root node")
+		}
+		var relations []string
+		for _, child := range trace.Children {
+			relations = append(relations, child.Relation)
+		}
+		if len(relations) != 3 || relations[0] != "owner" || relations[1] != "editor" || relations[2] != "viewer" {
+			t.Errorf("Expected owner, editor and viewer in order, got %v", relations)
+		}
+		if findTraceNode(trace, func(n *policy.TraceNode) bool { return n.Cached }) == nil {
+			t.Errorf("Expected repeated relations to be marked as cached")
+		}
+		if findTraceNode(trace, func(n *policy.TraceNode) bool { return n.Result }) != nil {
+			t.Errorf("Expected every node to be denied")
+		}
+	})
+}
+
+// findTraceNode returns the first node of the tree, depth first, that matches
+func findTraceNode(node *policy.TraceNode, match func(*policy.TraceNode) bool) *policy.TraceNode {
+	if match(node) {
+		return node
+	}
+	for _, child := range node.Children {
+		if found := findTraceNode(child, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
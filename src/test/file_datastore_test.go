@@ -0,0 +1,265 @@
+package test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestFileDatastoreConformance(t *testing.T) {
+	runDatastoreConformance(t, func(t *testing.T) datastore.Datastore {
+		return openFileDatastore(t, t.TempDir(), 0)
+	})
+}
+
+func TestFileDatastoreRecoversAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openFileDatastore(t, dir, 0)
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "viewer", "user:bob"))
+	writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:alice"))
+	if err := ds.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened := openFileDatastore(t, dir, 0)
+	defer reopened.Close()
+
+	assertHead(t, reopened, 3)
+	assertKeys(t, queryAtHead(t, reopened, datastore.Filter{}), "document:a#viewer@user:bob")
+
+	// Deleted versions are part of the snapshot, so history survives the restart
+	assertKeys(t, queryAt(t, reopened, 2, datastore.Filter{}), "document:a#owner@user:alice", "document:a#viewer@user:bob")
+}
+
+func TestFileDatastoreReplaysLogOnTopOfSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	// Snapshot every two writes, so the fifth write only exists in the log
+	ds := openFileDatastore(t, dir, 2)
+	for _, resource := range []string{"document:a", "document:b", "document:c", "document:d", "document:e"} {
+		writeTuples(t, ds, datastore.UpdateTouch, tuple(resource, "owner", "user:alice"))
+	}
+
+	// Simulate a crash: the datastore is abandoned without Close
+	reopened := openFileDatastore(t, dir, 2)
+	defer reopened.Close()
+
+	assertHead(t, reopened, 5)
+	assertKeys(t, queryAtHead(t, reopened, datastore.Filter{}),
+		"document:a#owner@user:alice",
+		"document:b#owner@user:alice",
+		"document:c#owner@user:alice",
+		"document:d#owner@user:alice",
+		"document:e#owner@user:alice",
+	)
+}
+
+func TestFileDatastoreTornFinalRecord(t *testing.T) {
+	fullHeader := make([]byte, 8)
+	binary.LittleEndian.PutUint32(fullHeader[0:4], 100)
+	binary.LittleEndian.PutUint32(fullHeader[4:8], 12345)
+
+	testCases := []struct {
+		name string
+		tail []byte
+	}{
+		{
+			name: "Partial header",
+			tail: fullHeader[:3],
+		},
+		{
+			name: "Partial payload",
+			tail: append(append([]byte{}, fullHeader...), []byte(`{"revision":`)...),
+		},
+		{
+			name: "Checksum mismatch",
+			tail: func() []byte {
+				payload := []byte(`{"revision":4,"updates":[]}`)
+				header := make([]byte, 8)
+				binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+				binary.LittleEndian.PutUint32(header[4:8], 12345)
+				return append(header, payload...)
+			}(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// Every write below is acknowledged before the crash
+			ds := openFileDatastore(t, dir, 0)
+			writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+			writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "viewer", "user:bob"))
+			writeTuples(t, ds, datastore.UpdateTouch, tuple("document:b", "owner", "user:carol"))
+
+			// Simulate a crash in the middle of appending the next record
+			appendToFile(t, filepath.Join(dir, "wal.log"), tc.tail)
+
+			recovered := openFileDatastore(t, dir, 0)
+			assertHead(t, recovered, 3)
+			assertKeys(t, queryAtHead(t, recovered, datastore.Filter{}),
+				"document:a#owner@user:alice",
+				"document:a#viewer@user:bob",
+				"document:b#owner@user:carol",
+			)
+
+			// Writes after recovery must not be hidden behind the torn record
+			writeTuples(t, recovered, datastore.UpdateTouch, tuple("document:c", "owner", "user:dave"))
+
+			again := openFileDatastore(t, dir, 0)
+			defer again.Close()
+			assertHead(t, again, 4)
+			assertKeys(t, queryAtHead(t, again, datastore.Filter{Subject: "user:dave"}), "document:c#owner@user:dave")
+		})
+	}
+}
+
+func TestFileDatastoreCorruptRecordInsideLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+
+	ds := openFileDatastore(t, dir, 0)
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "viewer", "user:bob"))
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:b", "owner", "user:carol"))
+
+	// Simulate a crash, so that the writes only exist in the log, then flip a byte in the payload of the first record, which acknowledged writes follow
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	log[8+4] ^= 0xff
+	if err := os.WriteFile(path, log, 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+
+	if _, err := datastore.NewFileDatastore(dir, datastore.FileOptions{}); !errors.Is(err, datastore.ErrCorruptLog) {
+		t.Fatalf("Expected ErrCorruptLog, got %v", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if string(after) != string(log) {
+		t.Errorf("Expected the log to be left untouched, got %d of %d bytes", len(after), len(log))
+	}
+}
+
+// openFileDatastore opens a file datastore in dir and fails the test on error
+func openFileDatastore(t *testing.T, dir string, snapshotEvery int) *datastore.FileDatastore {
+	t.Helper()
+
+	ds, err := datastore.NewFileDatastore(dir, datastore.FileOptions{SnapshotEvery: snapshotEvery})
+	if err != nil {
+		t.Fatalf("NewFileDatastore failed: %v", err)
+	}
+	return ds
+}
+
+// appendToFile appends raw bytes to a file
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("Failed to append to %s: %v", path, err)
+	}
+}
+
+// assertHead checks the head revision of the datastore
+func assertHead(t *testing.T, ds datastore.Datastore, expected datastore.Revision) {
+	t.Helper()
+
+	head, err := ds.HeadRevision()
+	if err != nil {
+		t.Fatalf("HeadRevision failed: %v", err)
+	}
+	if head != expected {
+		t.Errorf("Expected head revision %d, got %d", expected, head)
+	}
+}
+
+func TestFileDatastoreGarbageCollectionSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openFileDatastore(t, dir, 0)
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:a", "owner", "user:alice"))
+	writeTuples(t, ds, datastore.UpdateDelete, tuple("document:a", "owner", "user:alice"))
+	writeTuples(t, ds, datastore.UpdateTouch, tuple("document:b", "owner", "user:alice"))
+	if _, err := ds.GarbageCollect(time.Now()); err != nil {
+		t.Fatalf("GarbageCollect failed: %v", err)
+	}
+
+	// Simulate a crash: the compacted snapshot is already on disk
+	reopened := openFileDatastore(t, dir, 0)
+	defer reopened.Close()
+
+	assertHead(t, reopened, 3)
+	if _, err := reopened.SnapshotReader(2); !errors.Is(err, datastore.ErrSnapshotExpired) {
+		t.Errorf("Expected ErrSnapshotExpired after restart, got %v", err)
+	}
+	assertKeys(t, queryAtHead(t, reopened, datastore.Filter{}), "document:b#owner@user:alice")
+}
+
+func TestSampleDataKeepsRecoveredRelationships(t *testing.T) {
+	dir := t.TempDir()
+
+	// start initializes the sample data on a store over the file datastore, as main does
+	start := func(t *testing.T) (*policy.Store, datastore.Datastore) {
+		t.Helper()
+		ds := openFileDatastore(t, dir, 0)
+		policyStore := policy.NewStoreWithDatastore(schema.LoadDefaultSchema(), ds)
+		if err := policyStore.InitializeWithSampleData(); err != nil {
+			t.Fatalf("InitializeWithSampleData failed: %v", err)
+		}
+		return policyStore, ds
+	}
+
+	policyStore, ds := start(t)
+	if _, err := policyStore.AddRelationship("document:plan", "viewer", "user:zoe"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	head := storeHead(t, policyStore)
+	if err := ds.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	restarted, reopened := start(t)
+	defer reopened.Close()
+
+	if again := storeHead(t, restarted); again != head {
+		t.Errorf("Expected the restart to write nothing, head moved from %d to %d", head, again)
+	}
+	allowed, _, err := restarted.Check("user:zoe", "document:plan", "view")
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !allowed {
+		t.Error("Expected the relationship written before the restart to survive it")
+	}
+}
+
+// storeHead returns the head revision of a store
+func storeHead(t *testing.T, policyStore *policy.Store) datastore.Revision {
+	t.Helper()
+	head, err := policyStore.HeadRevision()
+	if err != nil {
+		t.Fatalf("HeadRevision failed: %v", err)
+	}
+	return head
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestGarbageCollectionExpiresOldZookies(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStoreWithOptions(schemaStore, policy.StoreOptions{RetentionWindow: 50 * time.Millisecond})
+
+	old, err := policyStore.AddRelationship("document:plan", "owner", "user:alice")
+	if err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.RemoveRelationship("document:plan", "owner", "user:alice"); err != nil {
+		t.Fatalf("RemoveRelationship failed: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	recent, err := policyStore.AddRelationship("document:plan", "owner", "user:bob")
+	if err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	result, err := policyStore.GarbageCollect()
+	if err != nil {
+		t.Fatalf("GarbageCollect failed: %v", err)
+	}
+	if result.MinRevision != 2 || result.CollectedVersions != 1 {
+		t.Errorf("Expected the deleted version to be collected up to revision 2, got %+v", result)
+	}
+
+	check := func(zookie string) error {
+		_, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:     "user:bob",
+			Resource:    "document:plan",
+			Action:      "view",
+			Consistency: policy.Consistency{Mode: policy.AtExactSnapshot, Zookie: zookie},
+		})
+		return err
+	}
+	if err := check(old); !errors.Is(err, datastore.ErrSnapshotExpired) {
+		t.Errorf("Expected ErrSnapshotExpired for a zookie older than the window, got %v", err)
+	}
+	if err := check(recent); err != nil {
+		t.Errorf("Expected a zookie within the window to be accepted, got %v", err)
+	}
+	if _, err := policyStore.Watch(context.Background(), old, policy.WatchFilter{}, 0); !errors.Is(err, datastore.ErrSnapshotExpired) {
+		t.Errorf("Expected watch from an expired zookie to fail, got %v", err)
+	}
+
+	stats := policyStore.GCStats()
+	if stats.Runs != 1 || stats.MinRevision != 2 || stats.HeadRevision != 3 || stats.TotalCollectedVersions != 1 {
+		t.Errorf("Unexpected GC stats: %+v", stats)
+	}
+}
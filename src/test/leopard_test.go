@@ -0,0 +1,282 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+// groupSchema has nested groups and documents shared with users and groups
+func groupSchema(t *testing.T) *schema.Schema {
+	t.Helper()
+
+	s := schema.NewSchema()
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "group",
+			Relations: map[string]schema.Relation{
+				"member": {Subjects: []schema.Subject{{Type: "user"}, {Type: "group", Relation: "member"}}},
+			},
+		},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"viewer": {Subjects: []schema.Subject{{Type: "user"}, {Type: "group", Relation: "member"}}},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "viewer"}},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	return s
+}
+
+func TestLeopardIndexDeepNesting(t *testing.T) {
+	ds := datastore.NewMemoryDatastore()
+	indexed := policy.NewStoreWithOptions(groupSchema(t), policy.StoreOptions{Datastore: ds, MaxDepth: 10})
+	recursive := policy.NewStoreWithOptions(groupSchema(t), policy.StoreOptions{Datastore: ds, MaxDepth: 10, DisableLeopardIndex: true})
+
+	// document:org <- group:0#member <- group:1#member <- ... <- group:30#member <- user:alice
+	for i := 0; i < 30; i++ {
+		if _, err := indexed.AddRelationship(fmt.Sprintf("group:%d", i), "member", fmt.Sprintf("group:%d#member", i+1)); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+	if _, err := indexed.AddRelationship("group:30", "member", "user:alice"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := indexed.AddRelationship("document:org", "viewer", "group:0#member"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	allowed, _, err := indexed.Check("user:alice", "document:org", "view")
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !allowed {
+		t.Error("Expected the index to resolve the nested membership")
+	}
+
+	var depthErr *policy.MaxDepthExceededError
+	if _, _, err := recursive.Check("user:alice", "document:org", "view"); !errors.As(err, &depthErr) {
+		t.Errorf("Expected recursion to exceed the max depth, got %v", err)
+	}
+
+	t.Run("Explained", func(t *testing.T) {
+		result, err := indexed.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:  "user:alice",
+			Resource: "document:org",
+			Action:   "view",
+			Explain:  true,
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		node := findTraceNode(result.Trace, func(n *policy.TraceNode) bool {
+			return n.Type == policy.TraceNodeLeopard && n.Object == "group:0"
+		})
+		if node == nil || !node.Result {
+			t.Errorf("Expected a leopard node granting group:0#member, got %+v", node)
+		}
+	})
+}
+
+func TestLeopardIndexIncrementalUpdates(t *testing.T) {
+	ds := datastore.NewMemoryDatastore()
+	indexed := policy.NewStoreWithOptions(groupSchema(t), policy.StoreOptions{Datastore: ds})
+	recursive := policy.NewStoreWithOptions(groupSchema(t), policy.StoreOptions{Datastore: ds, DisableLeopardIndex: true})
+
+	write := func(t *testing.T, op policy.WriteOperation, resource, subject string, expiresAt time.Time) {
+		t.Helper()
+		_, err := indexed.WriteRelationships([]policy.RelationshipUpdate{{
+			Operation:    op,
+			Relationship: policy.Relationship{Resource: resource, Relation: "member", Subject: subject, ExpiresAt: expiresAt},
+		}}, nil)
+		if err != nil {
+			t.Fatalf("WriteRelationships failed: %v", err)
+		}
+	}
+
+	// document:<name> is viewed by group:<name>#member
+	names := []string{"engineering", "frontend", "web"}
+	compare := func(t *testing.T) {
+		t.Helper()
+		for _, subject := range []string{"user:alice", "user:bob"} {
+			for _, name := range names {
+				document := "document:" + name
+				want, _, err := recursive.Check(subject, document, "view")
+				if err != nil {
+					t.Fatalf("Check without index failed: %v", err)
+				}
+				got, _, err := indexed.Check(subject, document, "view")
+				if err != nil {
+					t.Fatalf("Check with index failed: %v", err)
+				}
+				if got != want {
+					t.Errorf("%s on %s: index says %v, recursion says %v", subject, document, got, want)
+				}
+			}
+		}
+
+		verification, err := indexed.VerifyLeopardIndex()
+		if err != nil {
+			t.Fatalf("VerifyLeopardIndex failed: %v", err)
+		}
+		if !verification.Consistent {
+			t.Errorf("Expected the index to be consistent, got %v", verification.Mismatches)
+		}
+		if len(verification.Relations) != 1 || verification.Relations[0] != "group#member" {
+			t.Errorf("Expected the index to hold group#member, got %v", verification.Relations)
+		}
+	}
+
+	for _, name := range names {
+		if _, err := indexed.AddRelationship("document:"+name, "viewer", "group:"+name+"#member"); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+
+	steps := []struct {
+		name      string
+		op        policy.WriteOperation
+		resource  string
+		subject   string
+		expiresAt time.Time
+	}{
+		{name: "Direct member", op: policy.WriteTouch, resource: "group:web", subject: "user:alice"},
+		{name: "Nested group", op: policy.WriteTouch, resource: "group:frontend", subject: "group:web#member"},
+		{name: "Doubly nested group", op: policy.WriteTouch, resource: "group:engineering", subject: "group:frontend#member"},
+		{name: "Expiring member", op: policy.WriteTouch, resource: "group:frontend", subject: "user:bob", expiresAt: time.Now().Add(time.Hour)},
+		{name: "Expiring member removed", op: policy.WriteDelete, resource: "group:frontend", subject: "user:bob"},
+		{name: "Middle edge removed", op: policy.WriteDelete, resource: "group:frontend", subject: "group:web#member"},
+		{name: "Middle edge restored", op: policy.WriteTouch, resource: "group:frontend", subject: "group:web#member"},
+		{name: "Direct member removed", op: policy.WriteDelete, resource: "group:web", subject: "user:alice"},
+	}
+	compare(t)
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			write(t, step.op, step.resource, step.subject, step.expiresAt)
+			compare(t)
+		})
+	}
+
+	t.Run("Earlier revision", func(t *testing.T) {
+		head, err := indexed.HeadRevision()
+		if err != nil {
+			t.Fatalf("HeadRevision failed: %v", err)
+		}
+		// user:alice was removed from group:web by the last write
+		allowed, _, err := indexed.CheckAtRevision("user:alice", "document:engineering", "view", head-1)
+		if err != nil {
+			t.Fatalf("CheckAtRevision failed: %v", err)
+		}
+		if !allowed {
+			t.Error("Expected user:alice to be a nested member before the last write")
+		}
+	})
+}
+
+func TestLeopardIndexVerifiesUnsweptExpiry(t *testing.T) {
+	policyStore := policy.NewStore(groupSchema(t))
+	if _, err := policyStore.AddRelationship("document:plan", "viewer", "group:eng#member"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.AddExpiringRelationship("group:eng", "member", "user:kai", time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("AddExpiringRelationship failed: %v", err)
+	}
+	if allowed, _, err := policyStore.Check("user:kai", "document:plan", "view"); err != nil || !allowed {
+		t.Fatalf("Expected access before expiry, got allowed=%v err=%v", allowed, err)
+	}
+
+	// No sweeper runs, so the expired tuple stays in the index as volatile
+	time.Sleep(100 * time.Millisecond)
+
+	verification, err := policyStore.VerifyLeopardIndex()
+	if err != nil {
+		t.Fatalf("VerifyLeopardIndex failed: %v", err)
+	}
+	if !verification.Consistent {
+		t.Errorf("Expected the index to be consistent, got %v", verification.Mismatches)
+	}
+}
+
+func TestLeopardIndexQuantizedReads(t *testing.T) {
+	policyStore := policy.NewStoreWithOptions(groupSchema(t), policy.StoreOptions{QuantizationWindow: time.Hour})
+
+	// document:plan <- group:eng#member <- group:web#member <- user:bob
+	for _, r := range []policy.Relationship{
+		{Resource: "document:plan", Relation: "viewer", Subject: "group:eng#member"},
+		{Resource: "group:eng", Relation: "member", Subject: "group:web#member"},
+		{Resource: "group:web", Relation: "member", Subject: "user:bob"},
+	} {
+		if _, err := policyStore.TouchRelationship(r); err != nil {
+			t.Fatalf("TouchRelationship failed: %v", err)
+		}
+	}
+
+	// check explains whether a subject can view document:plan and reports whether
+	// the index answered the membership of group:eng
+	check := func(t *testing.T, subject string, consistency policy.Consistency) (allowed, indexed bool) {
+		t.Helper()
+		result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:     subject,
+			Resource:    "document:plan",
+			Action:      "view",
+			Consistency: consistency,
+			Explain:     true,
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		node := findTraceNode(result.Trace, func(n *policy.TraceNode) bool {
+			return n.Type == policy.TraceNodeLeopard && n.Object == "group:eng"
+		})
+		return result.Allowed, node != nil
+	}
+	// write makes a write and brings the index forward to it with a fresh check
+	write := func(t *testing.T, resource, relation, subject string) policy.Consistency {
+		t.Helper()
+		zookie, err := policyStore.AddRelationship(resource, relation, subject)
+		if err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+		fresh := policy.Consistency{Mode: policy.AtLeastAsFresh, Zookie: zookie}
+		check(t, "user:bob", fresh)
+		return fresh
+	}
+
+	if allowed, indexed := check(t, "user:bob", policy.Consistency{}); !allowed || !indexed {
+		t.Fatalf("Expected the index to grant user:bob, got allowed=%v indexed=%v", allowed, indexed)
+	}
+
+	t.Run("Other relation changed", func(t *testing.T) {
+		write(t, "document:memo", "viewer", "user:carol")
+
+		// The quantized revision is behind the index, but group#member is unchanged
+		if allowed, indexed := check(t, "user:bob", policy.Consistency{}); !allowed || !indexed {
+			t.Errorf("Expected the index to answer the quantized read, got allowed=%v indexed=%v", allowed, indexed)
+		}
+	})
+
+	t.Run("Membership changed", func(t *testing.T) {
+		fresh := write(t, "group:web", "member", "user:dan")
+
+		// The index no longer holds the memberships of the quantized revision
+		if allowed, indexed := check(t, "user:dan", policy.Consistency{}); allowed || indexed {
+			t.Errorf("Expected recursion to deny user:dan at the quantized revision, got allowed=%v indexed=%v", allowed, indexed)
+		}
+		if allowed, _ := check(t, "user:dan", fresh); !allowed {
+			t.Error("Expected user:dan to be a nested member at the head revision")
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestLookupResources(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+
+	// Five more documents in folder:projects, one of which dave owns
+	for i := 0; i < 5; i++ {
+		if _, err := policyStore.AddRelationship(fmt.Sprintf("document:doc%d", i), "parent", "folder:projects"); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+	if _, err := policyStore.AddRelationship("document:doc3", "owner", "user:dave"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	lookup := func(t *testing.T, req policy.LookupResourcesRequest) *policy.LookupResourcesResult {
+		t.Helper()
+		req.ResourceType = "document"
+		result, err := policyStore.LookupResources(context.Background(), req)
+		if err != nil {
+			t.Fatalf("LookupResources failed: %v", err)
+		}
+		return result
+	}
+
+	testCases := []struct {
+		name       string
+		subject    string
+		permission string
+		expected   []string
+	}{
+		{
+			name:       "Through parent folder",
+			subject:    "user:eve",
+			permission: "view",
+			expected:   []string{"document:doc0", "document:doc1", "document:doc2", "document:doc3", "document:doc4", "document:report"},
+		},
+		{
+			name:       "Through nested groups and ownership",
+			subject:    "user:dave",
+			permission: "view",
+			expected:   []string{"document:doc3", "document:report"},
+		},
+		{
+			name:       "Through computed usersets",
+			subject:    "user:bob",
+			permission: "edit",
+			expected:   []string{"document:report"},
+		},
+		{
+			name:       "Nothing reachable",
+			subject:    "user:zoe",
+			permission: "view",
+			expected:   []string{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := lookup(t, policy.LookupResourcesRequest{Subject: tc.subject, Permission: tc.permission})
+			if !reflect.DeepEqual(result.Resources, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, result.Resources)
+			}
+			if result.Cursor != "" {
+				t.Errorf("Expected no cursor without a limit, got %q", result.Cursor)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		var pages [][]string
+		req := policy.LookupResourcesRequest{Subject: "user:eve", Permission: "view", Limit: 4}
+		for {
+			result := lookup(t, req)
+			pages = append(pages, result.Resources)
+			if result.Cursor == "" {
+				break
+			}
+			req.Cursor = result.Cursor
+
+			// Later pages are read at the revision of the first page
+			if _, err := policyStore.AddRelationship("document:doc5", "parent", "folder:projects"); err != nil {
+				t.Fatalf("AddRelationship failed: %v", err)
+			}
+		}
+
+		expected := [][]string{
+			{"document:doc0", "document:doc1", "document:doc2", "document:doc3"},
+			{"document:doc4", "document:report"},
+		}
+		if !reflect.DeepEqual(pages, expected) {
+			t.Errorf("Expected pages %v, got %v", expected, pages)
+		}
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		_, err := policyStore.LookupResources(context.Background(), policy.LookupResourcesRequest{
+			Subject:      "user:eve",
+			ResourceType: "document",
+			Permission:   "view",
+			Cursor:       "not a cursor",
+		})
+		if !errors.Is(err, policy.ErrInvalidCursor) {
+			t.Errorf("Expected ErrInvalidCursor, got %v", err)
+		}
+	})
+}
+
+func TestLookupResourcesHonoursExclusion(t *testing.T) {
+	s := schema.NewSchema()
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"reader": {Subjects: []schema.Subject{{Type: "user"}}},
+				"banned": {Subjects: []schema.Subject{{Type: "user"}}},
+				"allowed": {UsersetRewrite: schema.NewExclusionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("banned"),
+				)},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "allowed"}},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	policyStore := policy.NewStore(s)
+
+	relationships := []policy.Relationship{
+		{Resource: "document:a", Relation: "reader", Subject: "user:alice"},
+		{Resource: "document:b", Relation: "reader", Subject: "user:alice"},
+		{Resource: "document:b", Relation: "banned", Subject: "user:alice"},
+		{Resource: "document:c", Relation: "banned", Subject: "user:alice"},
+	}
+	for _, r := range relationships {
+		if _, err := policyStore.AddRelationship(r.Resource, r.Relation, r.Subject); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+
+	result, err := policyStore.LookupResources(context.Background(), policy.LookupResourcesRequest{
+		Subject:      "user:alice",
+		ResourceType: "document",
+		Permission:   "view",
+	})
+	if err != nil {
+		t.Fatalf("LookupResources failed: %v", err)
+	}
+	if expected := []string{"document:a"}; !reflect.DeepEqual(result.Resources, expected) {
+		t.Errorf("Expected %v, got %v", expected, result.Resources)
+	}
+}
@@ -0,0 +1,271 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestLookupSubjects(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		permission  string
+		subjectType string
+		expected    []string
+	}{
+		{
+			name:        "Permission through rewrites, groups and parent folder",
+			permission:  "view",
+			subjectType: "user",
+			expected:    []string{"user:alice", "user:bob", "user:charlie", "user:dave", "user:eve"},
+		},
+		{
+			name:        "Permission through computed usersets",
+			permission:  "edit",
+			subjectType: "user",
+			expected:    []string{"user:alice", "user:bob"},
+		},
+		{
+			name:        "Relation with another subject type",
+			permission:  "parent",
+			subjectType: "folder",
+			expected:    []string{"folder:projects"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := policyStore.LookupSubjects(context.Background(), policy.LookupSubjectsRequest{
+				Resource:    "document:report",
+				Permission:  tc.permission,
+				SubjectType: tc.subjectType,
+			})
+			if err != nil {
+				t.Fatalf("LookupSubjects failed: %v", err)
+			}
+			if !reflect.DeepEqual(result.Subjects, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, result.Subjects)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		var pages [][]string
+		req := policy.LookupSubjectsRequest{Resource: "document:report", Permission: "view", SubjectType: "user", Limit: 2}
+		for {
+			result, err := policyStore.LookupSubjects(context.Background(), req)
+			if err != nil {
+				t.Fatalf("LookupSubjects failed: %v", err)
+			}
+			pages = append(pages, result.Subjects)
+			if result.Cursor == "" {
+				break
+			}
+			req.Cursor = result.Cursor
+		}
+
+		expected := [][]string{{"user:alice", "user:bob"}, {"user:charlie", "user:dave"}, {"user:eve"}}
+		if !reflect.DeepEqual(pages, expected) {
+			t.Errorf("Expected pages %v, got %v", expected, pages)
+		}
+	})
+}
+
+func TestLookupSubjectsSetOperations(t *testing.T) {
+	s := schema.NewSchema()
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"reader":   {Subjects: []schema.Subject{{Type: "user"}, {Type: "user", Wildcard: true}}},
+				"banned":   {Subjects: []schema.Subject{{Type: "user"}}},
+				"approved": {Subjects: []schema.Subject{{Type: "user"}}},
+				"allowed": {UsersetRewrite: schema.NewExclusionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("banned"),
+				)},
+				"vetted": {UsersetRewrite: schema.NewIntersectionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("approved"),
+				)},
+			},
+			Permissions: map[string]schema.Permission{
+				"view":   {Expression: "allowed"},
+				"review": {Expression: "vetted"},
+			},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	policyStore := policy.NewStore(s)
+
+	relationships := []policy.Relationship{
+		{Resource: "document:public", Relation: "reader", Subject: "user:*"},
+		{Resource: "document:public", Relation: "banned", Subject: "user:mallory"},
+		{Resource: "document:public", Relation: "approved", Subject: "user:alice"},
+		{Resource: "document:private", Relation: "reader", Subject: "user:alice"},
+		{Resource: "document:private", Relation: "reader", Subject: "user:bob"},
+		{Resource: "document:private", Relation: "banned", Subject: "user:bob"},
+		{Resource: "document:private", Relation: "approved", Subject: "user:carol"},
+	}
+	for _, r := range relationships {
+		if _, err := policyStore.AddRelationship(r.Resource, r.Relation, r.Subject); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		resource   string
+		permission string
+		expected   []string
+		excluded   []string
+	}{
+		{name: "Exclusion", resource: "document:private", permission: "view", expected: []string{"user:alice"}},
+		{name: "Wildcard minus banned", resource: "document:public", permission: "view", expected: []string{"user:*"}, excluded: []string{"user:mallory"}},
+		{name: "Intersection", resource: "document:private", permission: "review", expected: []string{}},
+		{name: "Wildcard intersection", resource: "document:public", permission: "review", expected: []string{"user:alice"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := policyStore.LookupSubjects(context.Background(), policy.LookupSubjectsRequest{
+				Resource:    tc.resource,
+				Permission:  tc.permission,
+				SubjectType: "user",
+			})
+			if err != nil {
+				t.Fatalf("LookupSubjects failed: %v", err)
+			}
+			if !reflect.DeepEqual(result.Subjects, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, result.Subjects)
+			}
+			if len(result.ExcludedSubjects) != len(tc.excluded) || (len(tc.excluded) > 0 && !reflect.DeepEqual(result.ExcludedSubjects, tc.excluded)) {
+				t.Errorf("Expected excluded %v, got %v", tc.excluded, result.ExcludedSubjects)
+			}
+		})
+	}
+}
+
+func TestLookupSubjectsWildcardAfterExclusions(t *testing.T) {
+	s := schema.NewSchema()
+	definitions := []*schema.Definition{
+		{Type: "user", Relations: map[string]schema.Relation{}},
+		{
+			Type: "group",
+			Relations: map[string]schema.Relation{
+				"reader": {Subjects: []schema.Subject{{Type: "user"}, {Type: "user", Wildcard: true}}},
+				"banned": {Subjects: []schema.Subject{{Type: "user"}}},
+				"member": {UsersetRewrite: schema.NewExclusionRewrite(
+					schema.NewComputedUsersetRewrite("reader"),
+					schema.NewComputedUsersetRewrite("banned"),
+				)},
+			},
+		},
+		{
+			Type: "document",
+			Relations: map[string]schema.Relation{
+				"viewer": {Subjects: []schema.Subject{{Type: "user", Wildcard: true}, {Type: "group", Relation: "member"}}},
+			},
+			Permissions: map[string]schema.Permission{"view": {Expression: "viewer"}},
+		},
+	}
+	for _, def := range definitions {
+		if err := s.AddDefinition(def); err != nil {
+			t.Fatalf("AddDefinition failed: %v", err)
+		}
+	}
+	// The slice datastore returns tuples in the order they were written, so the
+	// subject set carrying the exclusion is merged before the direct wildcard
+	policyStore := policy.NewStoreWithDatastore(s, &sliceDatastore{})
+
+	relationships := []policy.Relationship{
+		{Resource: "group:everyone", Relation: "reader", Subject: "user:*"},
+		{Resource: "group:everyone", Relation: "banned", Subject: "user:bob"},
+		{Resource: "document:notice", Relation: "viewer", Subject: "group:everyone#member"},
+		{Resource: "document:notice", Relation: "viewer", Subject: "user:*"},
+	}
+	for _, r := range relationships {
+		if _, err := policyStore.AddRelationship(r.Resource, r.Relation, r.Subject); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+
+	result, err := policyStore.LookupSubjects(context.Background(), policy.LookupSubjectsRequest{
+		Resource:    "document:notice",
+		Permission:  "view",
+		SubjectType: "user",
+	})
+	if err != nil {
+		t.Fatalf("LookupSubjects failed: %v", err)
+	}
+	if !reflect.DeepEqual(result.Subjects, []string{"user:*"}) || len(result.ExcludedSubjects) != 0 {
+		t.Errorf("Expected user:* without exclusions, got %v excluding %v", result.Subjects, result.ExcludedSubjects)
+	}
+
+	allowed, _, err := policyStore.Check("user:bob", "document:notice", "view")
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !allowed {
+		t.Errorf("Expected user:bob to be allowed by the direct wildcard")
+	}
+}
+
+func TestLookupSubjectsMutuallyNestedGroups(t *testing.T) {
+	policyStore := policy.NewStore(groupSchema(t))
+
+	// group:a and group:b contain each other, and group:a also contains group:c
+	relationships := []policy.Relationship{
+		{Resource: "group:a", Relation: "member", Subject: "group:b#member"},
+		{Resource: "group:b", Relation: "member", Subject: "group:a#member"},
+		{Resource: "group:a", Relation: "member", Subject: "group:c#member"},
+		{Resource: "group:b", Relation: "member", Subject: "user:bob"},
+		{Resource: "group:c", Relation: "member", Subject: "user:carol"},
+		{Resource: "document:plan", Relation: "viewer", Subject: "group:b#member"},
+	}
+	for _, r := range relationships {
+		if _, err := policyStore.AddRelationship(r.Resource, r.Relation, r.Subject); err != nil {
+			t.Fatalf("AddRelationship failed: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		resource   string
+		permission string
+		expected   []string
+	}{
+		{resource: "document:plan", permission: "view", expected: []string{"user:bob", "user:carol"}},
+		{resource: "group:a", permission: "member", expected: []string{"user:bob", "user:carol"}},
+		{resource: "group:c", permission: "member", expected: []string{"user:carol"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.resource, func(t *testing.T) {
+			result, err := policyStore.LookupSubjects(context.Background(), policy.LookupSubjectsRequest{
+				Resource:    tc.resource,
+				Permission:  tc.permission,
+				SubjectType: "user",
+			})
+			if err != nil {
+				t.Fatalf("LookupSubjects failed: %v", err)
+			}
+			if !reflect.DeepEqual(result.Subjects, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, result.Subjects)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestCheckMemoizesSubproblems(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	// Every iteration evaluates at the same revision, so the check cache is
+	// disabled to measure the memo of each request
+	policyStore := policy.NewStoreWithOptions(schemaStore, policy.StoreOptions{DisableCheckCache: true})
+	if err := policyStore.InitializeWithSampleData(); err != nil {
+		t.Fatalf("InitializeWithSampleData failed: %v", err)
+	}
+
+	// view = owner | editor | viewer, editor = this | owner and
+	// viewer = this | editor | parent#viewer, where this follows the
+	// group:engineering#member subject set, whose nested group:frontend#member is
+	// answered by the Leopard index. A denied check visits the whole tree: without a
+	// memo it evaluates eight relations, five of them distinct.
+	for i := 0; i < 20; i++ {
+		result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+			Subject:  "user:zoe",
+			Resource: "document:report",
+			Action:   "view",
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		if result.Allowed {
+			t.Fatalf("Expected user:zoe to be denied")
+		}
+
+		stats := result.Stats
+		if stats.Dispatches < 5 {
+			t.Errorf("Expected every distinct relation to be evaluated, got %+v", stats)
+		}
+		if stats.Dispatches+stats.MemoHits > 8 {
+			t.Errorf("Expected memo hits to prune repeated relations, got %+v", stats)
+		}
+	}
+}
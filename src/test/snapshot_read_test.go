@@ -0,0 +1,64 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestSnapshotReadsAtRevision(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+
+	if _, err := policyStore.AddRelationship("document:plan", "owner", "user:alice"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	before, err := policyStore.HeadRevision()
+	if err != nil {
+		t.Fatalf("HeadRevision failed: %v", err)
+	}
+
+	if _, err := policyStore.RemoveRelationship("document:plan", "owner", "user:alice"); err != nil {
+		t.Fatalf("RemoveRelationship failed: %v", err)
+	}
+
+	allowed, _, err := policyStore.Check("user:alice", "document:plan", "view")
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if allowed {
+		t.Errorf("Expected removed owner to be denied at head")
+	}
+
+	allowed, _, err = policyStore.CheckAtRevision("user:alice", "document:plan", "view", before)
+	if err != nil {
+		t.Fatalf("CheckAtRevision failed: %v", err)
+	}
+	if !allowed {
+		t.Errorf("Expected owner to be allowed at revision %d", before)
+	}
+
+	subjects, err := policyStore.ExpandAtRevision("document:plan", "owner", before)
+	if err != nil {
+		t.Fatalf("ExpandAtRevision failed: %v", err)
+	}
+	if len(subjects) != 1 || subjects[0] != "user:alice" {
+		t.Errorf("Expected [user:alice] at revision %d, got %v", before, subjects)
+	}
+
+	relationships, err := policyStore.ListRelationshipsAtRevision(before)
+	if err != nil {
+		t.Fatalf("ListRelationshipsAtRevision failed: %v", err)
+	}
+	if len(relationships) != 1 {
+		t.Errorf("Expected 1 relationship at revision %d, got %d", before, len(relationships))
+	}
+
+	if _, _, err := policyStore.CheckAtRevision("user:alice", "document:plan", "view", before+100); err == nil {
+		t.Errorf("Expected reading a future revision to fail")
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestWatchStreamsChanges(t *testing.T) {
+	policyStore := policy.NewStore(schema.LoadDefaultSchema())
+
+	start, err := policyStore.AddRelationship("document:report", "owner", "user:alice")
+	if err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := policyStore.Watch(ctx, start, policy.WatchFilter{ResourceType: "document"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	// The group write is filtered out
+	if _, err := policyStore.AddRelationship("group:eng", "member", "user:bob"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.AddRelationship("document:report", "viewer", "user:bob"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.RemoveRelationship("document:report", "owner", "user:alice"); err != nil {
+		t.Fatalf("RemoveRelationship failed: %v", err)
+	}
+
+	expected := []struct {
+		eventType policy.WatchEventType
+		subject   string
+	}{
+		{eventType: policy.WatchEventAdd, subject: "user:bob"},
+		{eventType: policy.WatchEventDelete, subject: "user:alice"},
+	}
+	var lastRevision int64
+	for _, want := range expected {
+		event := nextWatchEvent(t, events)
+		if event.Type != want.eventType || event.Relationship == nil || event.Relationship.Subject != want.subject {
+			t.Fatalf("Expected %s event for %s, got %+v", want.eventType, want.subject, event)
+		}
+		if event.Revision <= lastRevision {
+			t.Errorf("Expected increasing revisions, got %d after %d", event.Revision, lastRevision)
+		}
+		lastRevision = event.Revision
+	}
+
+	// Nothing else changes, so the next event is a heartbeat at the current revision
+	event := nextWatchEvent(t, events)
+	if event.Type != policy.WatchEventHeartbeat || event.Revision != lastRevision {
+		t.Errorf("Expected heartbeat at revision %d, got %+v", lastRevision, event)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchHeartbeatsDuringFilteredChanges(t *testing.T) {
+	policyStore := policy.NewStore(schema.LoadDefaultSchema())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := policyStore.Watch(ctx, "", policy.WatchFilter{ResourceType: "document"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	// Groups change more often than the heartbeat interval, but the watcher sees none of it
+	writes := make(chan error, 1)
+	go func() {
+		defer close(writes)
+		for i := 0; ctx.Err() == nil; i++ {
+			if _, err := policyStore.AddRelationship("group:eng", "member", fmt.Sprintf("user:%d", i)); err != nil {
+				writes <- err
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	event := nextWatchEvent(t, events)
+	if event.Type != policy.WatchEventHeartbeat {
+		t.Errorf("Expected a heartbeat, got %+v", event)
+	}
+
+	cancel()
+	for range events {
+	}
+	if err := <-writes; err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+}
+
+// nextWatchEvent waits for the next event on a watch stream
+func nextWatchEvent(t *testing.T, events <-chan policy.WatchEvent) policy.WatchEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("Watch stream closed unexpectedly")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for a watch event")
+	}
+	return policy.WatchEvent{}
+}
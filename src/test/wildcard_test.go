@@ -0,0 +1,75 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestWildcardSubjects(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+
+	if _, err := policyStore.AddRelationship("document:handbook", "viewer", "user:*"); err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+
+	t.Run("Validation", func(t *testing.T) {
+		testCases := []struct {
+			name     string
+			resource string
+			relation string
+			subject  string
+		}{
+			{name: "Relation without wildcard opt-in", resource: "document:handbook", relation: "owner", subject: "user:*"},
+			{name: "Wildcard of another type", resource: "document:handbook", relation: "viewer", subject: "group:*"},
+			{name: "Wildcard with relation", resource: "document:handbook", relation: "viewer", subject: "group:*#member"},
+			{name: "Wildcard resource", resource: "document:*", relation: "viewer", subject: "user:alice"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				if _, err := policyStore.AddRelationship(tc.resource, tc.relation, tc.subject); err == nil {
+					t.Errorf("Expected %s#%s@%s to be rejected", tc.resource, tc.relation, tc.subject)
+				}
+			})
+		}
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		testCases := []struct {
+			subject string
+			action  string
+			allowed bool
+		}{
+			{subject: "user:anyone", action: "view", allowed: true},
+			{subject: "user:anyone", action: "edit", allowed: false},
+			// Wildcards match subjects of their type, not subject sets
+			{subject: "group:engineering#member", action: "view", allowed: false},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.subject+"/"+tc.action, func(t *testing.T) {
+				allowed, _, err := policyStore.Check(tc.subject, "document:handbook", tc.action)
+				if err != nil {
+					t.Fatalf("Check failed: %v", err)
+				}
+				if allowed != tc.allowed {
+					t.Errorf("Expected allowed=%v, got %v", tc.allowed, allowed)
+				}
+			})
+		}
+	})
+
+	t.Run("Expand reports the wildcard", func(t *testing.T) {
+		subjects, err := policyStore.Expand("document:handbook", "viewer")
+		if err != nil {
+			t.Fatalf("Expand failed: %v", err)
+		}
+		if len(subjects) != 1 || subjects[0] != "user:*" {
+			t.Errorf("Expected [user:*], got %v", subjects)
+		}
+	})
+}
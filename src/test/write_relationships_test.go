@@ -0,0 +1,220 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestWriteRelationships(t *testing.T) {
+	parentOf := func(folder string) policy.Relationship {
+		return policy.Relationship{Resource: "document:plan", Relation: "parent", Subject: folder}
+	}
+
+	testCases := []struct {
+		name          string
+		updates       []policy.RelationshipUpdate
+		preconditions []policy.Precondition
+		err           error
+		expected      []string
+	}{
+		{
+			name: "Move document to another folder",
+			updates: []policy.RelationshipUpdate{
+				{Operation: policy.WriteDelete, Relationship: parentOf("folder:old")},
+				{Operation: policy.WriteCreate, Relationship: parentOf("folder:new")},
+			},
+			preconditions: []policy.Precondition{
+				{Operation: policy.PreconditionMustExist, Filter: policy.RelationshipFilter{Resource: "document:plan", Relation: "parent", Subject: "folder:old"}},
+			},
+			expected: []string{"folder:new"},
+		},
+		{
+			name: "Same relationship updated twice",
+			updates: []policy.RelationshipUpdate{
+				{Operation: policy.WriteDelete, Relationship: parentOf("folder:old")},
+				{Operation: policy.WriteCreate, Relationship: parentOf("folder:old")},
+			},
+			err:      errors.New("updated more than once"),
+			expected: []string{"folder:old"},
+		},
+		{
+			name: "Create conflicts with existing relationship",
+			updates: []policy.RelationshipUpdate{
+				{Operation: policy.WriteTouch, Relationship: parentOf("folder:new")},
+				{Operation: policy.WriteCreate, Relationship: parentOf("folder:old")},
+			},
+			err:      policy.ErrRelationshipExists,
+			expected: []string{"folder:old"},
+		},
+		{
+			name: "Touch of existing relationship succeeds",
+			updates: []policy.RelationshipUpdate{
+				{Operation: policy.WriteTouch, Relationship: parentOf("folder:old")},
+			},
+			expected: []string{"folder:old"},
+		},
+		{
+			name: "Failed precondition writes nothing",
+			updates: []policy.RelationshipUpdate{
+				{Operation: policy.WriteDelete, Relationship: parentOf("folder:old")},
+			},
+			preconditions: []policy.Precondition{
+				{Operation: policy.PreconditionMustNotExist, Filter: policy.RelationshipFilter{ResourceType: "document", Relation: "parent"}},
+			},
+			err:      policy.ErrPreconditionFailed,
+			expected: []string{"folder:old"},
+		},
+		{
+			name: "Invalid relationship writes nothing",
+			updates: []policy.RelationshipUpdate{
+				{Operation: policy.WriteDelete, Relationship: parentOf("folder:old")},
+				{Operation: policy.WriteCreate, Relationship: policy.Relationship{Resource: "document:plan", Relation: "parent", Subject: "user:alice"}},
+			},
+			err:      errors.New("not allowed"),
+			expected: []string{"folder:old"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policyStore := policy.NewStore(schema.LoadDefaultSchema())
+			if _, err := policyStore.AddRelationship("document:plan", "parent", "folder:old"); err != nil {
+				t.Fatalf("AddRelationship failed: %v", err)
+			}
+			before, err := policyStore.HeadRevision()
+			if err != nil {
+				t.Fatalf("HeadRevision failed: %v", err)
+			}
+
+			zookie, err := policyStore.WriteRelationships(tc.updates, tc.preconditions)
+			if tc.err != nil {
+				if err == nil || (!errors.Is(err, tc.err) && !strings.Contains(err.Error(), tc.err.Error())) {
+					t.Errorf("Expected error %v, got %v", tc.err, err)
+				}
+				head, _ := policyStore.HeadRevision()
+				if head != before {
+					t.Errorf("Expected failed batch to leave revision %d, got %d", before, head)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("WriteRelationships failed: %v", err)
+				}
+				if zookie == "" {
+					t.Errorf("Expected a zookie")
+				}
+				head, _ := policyStore.HeadRevision()
+				if head != before+1 {
+					t.Errorf("Expected batch to commit one revision, got %d after %d", head, before)
+				}
+			}
+
+			parents, err := policyStore.Expand("document:plan", "parent")
+			if err != nil {
+				t.Fatalf("Expand failed: %v", err)
+			}
+			if len(parents) != len(tc.expected) || (len(parents) > 0 && parents[0] != tc.expected[0]) {
+				t.Errorf("Expected parents %v, got %v", tc.expected, parents)
+			}
+		})
+	}
+}
+
+func TestDeleteRelationships(t *testing.T) {
+	seed := [][3]string{
+		{"document:a", "owner", "user:alice"},
+		{"document:a", "viewer", "user:bob"},
+		{"document:b", "viewer", "user:alice"},
+		{"document:c", "parent", "folder:x"},
+		{"folder:x", "viewer", "user:alice"},
+	}
+
+	testCases := []struct {
+		name      string
+		filter    policy.RelationshipFilter
+		limit     int
+		deleted   int
+		partial   bool
+		remaining int
+	}{
+		{
+			name:      "User leaves",
+			filter:    policy.RelationshipFilter{ResourceType: "document", Subject: "user:alice"},
+			deleted:   2,
+			remaining: 3,
+		},
+		{
+			name:      "Document destroyed",
+			filter:    policy.RelationshipFilter{ResourceType: "document", Resource: "document:a"},
+			deleted:   2,
+			remaining: 3,
+		},
+		{
+			name:      "By relation and subject type",
+			filter:    policy.RelationshipFilter{ResourceType: "document", Relation: "viewer", SubjectType: "user"},
+			deleted:   2,
+			remaining: 3,
+		},
+		{
+			name:      "Limited",
+			filter:    policy.RelationshipFilter{ResourceType: "document"},
+			limit:     3,
+			deleted:   3,
+			partial:   true,
+			remaining: 2,
+		},
+		{
+			name:      "Nothing matches",
+			filter:    policy.RelationshipFilter{ResourceType: "folder", Subject: "user:bob"},
+			deleted:   0,
+			remaining: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policyStore := policy.NewStore(schema.LoadDefaultSchema())
+			for _, r := range seed {
+				if _, err := policyStore.AddRelationship(r[0], r[1], r[2]); err != nil {
+					t.Fatalf("AddRelationship failed: %v", err)
+				}
+			}
+			before, _ := policyStore.HeadRevision()
+
+			result, err := policyStore.DeleteRelationships(tc.filter, tc.limit)
+			if err != nil {
+				t.Fatalf("DeleteRelationships failed: %v", err)
+			}
+			if result.DeletedCount != tc.deleted || result.Partial != tc.partial {
+				t.Errorf("Expected %d deleted (partial=%v), got %+v", tc.deleted, tc.partial, result)
+			}
+
+			// Everything is deleted at one revision
+			expectedHead := before
+			if tc.deleted > 0 {
+				expectedHead++
+			}
+			if head, _ := policyStore.HeadRevision(); head != expectedHead {
+				t.Errorf("Expected head revision %d, got %d", expectedHead, head)
+			}
+
+			relationships, err := policyStore.ListRelationships()
+			if err != nil {
+				t.Fatalf("ListRelationships failed: %v", err)
+			}
+			if len(relationships) != tc.remaining {
+				t.Errorf("Expected %d relationships left, got %d", tc.remaining, len(relationships))
+			}
+		})
+	}
+
+	t.Run("Resource type is required", func(t *testing.T) {
+		policyStore := policy.NewStore(schema.LoadDefaultSchema())
+		if _, err := policyStore.DeleteRelationships(policy.RelationshipFilter{Subject: "user:alice"}, 0); err == nil {
+			t.Errorf("Expected an error without a resource type")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kanywst/zanzibar/src/datastore"
+	"github.com/kanywst/zanzibar/src/policy"
+	"github.com/kanywst/zanzibar/src/schema"
+)
+
+func TestZookieCodec(t *testing.T) {
+	codec := policy.NewZookieCodec([]byte("secret"))
+	timestamp := time.Unix(1700000000, 42)
+	token := codec.Encode(7, timestamp)
+
+	t.Run("Round trip", func(t *testing.T) {
+		zookie, err := codec.Decode(token)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if zookie.Revision != 7 || !zookie.Timestamp.Equal(timestamp) {
+			t.Errorf("Expected revision 7 at %v, got %+v", timestamp, zookie)
+		}
+	})
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{name: "Empty", token: ""},
+		{name: "Not base64", token: "zk_7"},
+		{name: "Tampered", token: tamper(token)},
+		{name: "Other key", token: policy.NewZookieCodec([]byte("other")).Encode(7, timestamp)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := codec.Decode(tc.token); !errors.Is(err, policy.ErrInvalidZookie) {
+				t.Errorf("Expected ErrInvalidZookie, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckPermissionConsistency(t *testing.T) {
+	schemaStore := schema.LoadDefaultSchema()
+	if err := schemaStore.UpdateDefinitionWithUsersetRewrites(); err != nil {
+		t.Fatalf("Failed to update schema with userset rewrite rules: %v", err)
+	}
+	policyStore := policy.NewStore(schemaStore)
+
+	written, err := policyStore.AddRelationship("document:plan", "owner", "user:alice")
+	if err != nil {
+		t.Fatalf("AddRelationship failed: %v", err)
+	}
+	if _, err := policyStore.RemoveRelationship("document:plan", "owner", "user:alice"); err != nil {
+		t.Fatalf("RemoveRelationship failed: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		consistency policy.Consistency
+		allowed     bool
+		err         error
+	}{
+		{
+			name:        "Minimize latency reads head",
+			consistency: policy.Consistency{},
+			allowed:     false,
+		},
+		{
+			name:        "At least as fresh reads head",
+			consistency: policy.Consistency{Mode: policy.AtLeastAsFresh, Zookie: written},
+			allowed:     false,
+		},
+		{
+			name:        "At exact snapshot reads the zookie's revision",
+			consistency: policy.Consistency{Mode: policy.AtExactSnapshot, Zookie: written},
+			allowed:     true,
+		},
+		{
+			name:        "Missing zookie",
+			consistency: policy.Consistency{Mode: policy.AtExactSnapshot},
+			err:         policy.ErrInvalidZookie,
+		},
+		{
+			name:        "Zookie with minimize latency",
+			consistency: policy.Consistency{Mode: policy.MinimizeLatency, Zookie: written},
+			err:         policy.ErrInvalidConsistency,
+		},
+		{
+			name:        "Zookie from the future",
+			consistency: policy.Consistency{Mode: policy.AtLeastAsFresh, Zookie: policy.NewZookieCodec(nil).Encode(100, time.Now())},
+			err:         policy.ErrInvalidZookie,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+				Subject:     "user:alice",
+				Resource:    "document:plan",
+				Action:      "view",
+				Consistency: tc.consistency,
+			})
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("Expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckPermission failed: %v", err)
+			}
+			if result.Allowed != tc.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tc.allowed, result.Allowed)
+			}
+			if _, err := policyStore.CheckPermission(context.Background(), policy.CheckRequest{
+				Subject:     "user:alice",
+				Resource:    "document:plan",
+				Action:      "view",
+				Consistency: policy.Consistency{Mode: policy.AtExactSnapshot, Zookie: result.ZookieToken},
+			}); err != nil {
+				t.Errorf("Expected returned zookie to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveRevisionRejectsFutureZookie(t *testing.T) {
+	key := []byte("secret")
+	policyStore := policy.NewStoreWithOptions(schema.LoadDefaultSchema(), policy.StoreOptions{ZookieKey: key})
+
+	future := policy.NewZookieCodec(key).Encode(100, time.Now())
+	_, err := policyStore.ResolveRevision(policy.Consistency{Mode: policy.AtLeastAsFresh, Zookie: future})
+	if !errors.Is(err, datastore.ErrFutureRevision) {
+		t.Errorf("Expected ErrFutureRevision, got %v", err)
+	}
+}
+
+// tamper flips one character of a token
+func tamper(token string) string {
+	b := []byte(token)
+	if b[5] == 'A' {
+		b[5] = 'B'
+	} else {
+		b[5] = 'A'
+	}
+	return string(b)
+}